@@ -6,6 +6,8 @@ import (
 	"flag"
 	"fmt"
 	uds_pkg "infinite-live/internal/pkg/protocol"
+	"infinite-live/internal/pkg/transport"
+	"infinite-live/internal/pkg/workerclient"
 	"io"
 	"log"
 	"math/rand"
@@ -40,6 +42,11 @@ var (
 	// Video Gen Config
 	genAPI     = "http://192.168.50.56:8000/generate_stream"
 	localImage = "assets/IMG-20251126-WA0003.jpg"
+
+	// 临时 socket 的权限：默认 0660，Python 与本进程不同用户时用 GEN_SOCK_GROUP 指定共同的组
+	genSocketPerms = transport.SocketPerms{Mode: 0660, Group: os.Getenv("GEN_SOCK_GROUP")}
+	// GEN_ALLOW_USERS / GEN_ALLOW_GROUPS: 可选，按 SO_PEERCRED 只接受这些进程推流
+	genAllowlist *transport.PeerAllowlist
 )
 
 func init() {
@@ -51,9 +58,45 @@ func init() {
 	rand.New(rand.NewSource(time.Now().UnixNano()))
 }
 
-// UDS Connection to Server
-var udsConn net.Conn
-var udsLock sync.Mutex
+// engine is the connection to the InfiniteLive engine (auto-reconnecting)
+var engine *workerclient.Client
+
+// pendingComments 记录已发给豆包、尚未生成回复的评论 ID (FIFO)，
+// 回复的 UtteranceStart/End 会带上对应的 comment_id
+var pendingComments commentQueue
+
+type commentQueue struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+// push appends id and returns how many comments are ahead of it.
+func (q *commentQueue) push(id string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ids = append(q.ids, id)
+	return len(q.ids) - 1
+}
+
+func (q *commentQueue) peek() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.ids) == 0 {
+		return ""
+	}
+	return q.ids[0]
+}
+
+func (q *commentQueue) pop() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.ids) == 0 {
+		return ""
+	}
+	id := q.ids[0]
+	q.ids = q.ids[1:]
+	return id
+}
 
 func main() {
 	_ = flag.Set("logtostderr", "true")
@@ -62,20 +105,40 @@ func main() {
 	if appid == "" || accessToken == "" {
 		log.Fatal("ERROR: DOUBAO_APPID and DOUBAO_TOKEN environment variables must be set.")
 	}
-
-	// 1. Connect to UDS Server
-	var err error
-	udsConn, err = net.Dial("unix", "/tmp/infinite-live.sock")
+	allow, err := transport.ParsePeerAllowlist(os.Getenv("GEN_ALLOW_USERS"), os.Getenv("GEN_ALLOW_GROUPS"), "")
 	if err != nil {
-		log.Fatalf("Failed to connect to UDS: %v", err)
+		log.Fatalf("bad GEN_ALLOW_* config: %v", err)
 	}
-	defer udsConn.Close()
-	log.Println("Connected to UDS Server")
+	genAllowlist = allow
 
-	// 2. Connect to Doubao WS
+	// 1. Connect to UDS Server (reconnects on its own; see workerclient)
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	cfg, err := workerclient.ConfigFromEnv(workerclient.Config{
+		Hello: uds_pkg.Hello{
+			Role:     uds_pkg.RoleTalking,
+			WorkerID: "doubao-" + uuid.New().String()[:8],
+			Codecs:   []string{"vp8", "opus"},
+			FPS:      25,
+			Features: []string{uds_pkg.FeatureTimestamps, uds_pkg.FeatureComments, uds_pkg.FeatureSync, uds_pkg.FeatureHeartbeat, uds_pkg.FeatureJobs},
+		},
+		OnConnect: func(*uds_pkg.HelloAck) {
+			log.Println("Connected to UDS Server")
+		},
+	})
+	if err != nil {
+		log.Fatalf("bad engine TLS config: %v", err)
+	}
+	engine = workerclient.New(cfg)
+	go func() {
+		if err := engine.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("❌ UDS handshake failed: %v", err)
+			stop()
+		}
+	}()
+
+	// 2. Connect to Doubao WS
 	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, wsURL.String(), http.Header{
 		"X-Api-Resource-Id": []string{"volc.speech.dialog"},
 		"X-Api-Access-Key":  []string{accessToken},
@@ -101,23 +164,28 @@ func main() {
 	// 5. Listen for Text from UDS (Browser Comment -> UDS -> Here -> Doubao)
 	go func() {
 		log.Println("🎧 Listening for text commands from UDS...")
-		for {
-			pktType, payload, err := uds_pkg.ReadPacket(udsConn)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("❌ UDS Read Error: %v", err)
-				}
-				stop() // UDS 断开通常意味着主程序挂了，我们也退出
-				return
-			}
-			if pktType == uds_pkg.PacketTypeText {
-				text := string(payload)
-				log.Printf("📩 Received Text: %s", text)
+		for cmd := range engine.Commands() {
+			switch cmd.Kind {
+			case workerclient.CommandComment:
+				comment := cmd.Comment
+				log.Printf("📩 Received Comment %s from %s@%s: %s", comment.ID, comment.Author.DisplayName, comment.Platform, comment.Text)
+				ahead := pendingComments.push(comment.ID)
 
 				// Send to Doubao
-				if err := chatTextQuery(conn, sessionID, &ChatTextQueryPayload{Content: text}); err != nil {
+				if err := chatTextQuery(conn, sessionID, &ChatTextQueryPayload{Content: comment.Text}); err != nil {
 					log.Printf("❌ Failed to send text to Doubao: %v", err)
+					pendingComments.pop()
+					engine.ReportJob(comment.ID, uds_pkg.JobFailed, "doubao: "+err.Error())
+				} else if ahead > 0 {
+					engine.ReportJob(comment.ID, uds_pkg.JobQueued, fmt.Sprintf("%d comments ahead", ahead))
+				} else {
+					engine.ReportJob(comment.ID, uds_pkg.JobLLM, "")
 				}
+			case workerclient.CommandCancel:
+				// 正在推流的 Stream 已被 workerclient 中止，这里只记录
+				log.Printf("🛑 Engine cancelled utterance %s: %s", cmd.Cancel.UtteranceID, cmd.Cancel.Reason)
+			case workerclient.CommandError:
+				log.Printf("❌ Engine error: %v", cmd.Err)
 			}
 		}
 	}()
@@ -189,12 +257,19 @@ func realTimeDialog(ctx context.Context, c *websocket.Conn, sessionID string) {
 					copy(finalAudio, audioBuf.Bytes())
 					audioBuf.Reset()
 
+					commentID := pendingComments.pop()
+					engine.ReportJob(commentID, uds_pkg.JobTTSDone, "")
+					// 豆包按顺序回复：下一条评论开始生成
+					engine.ReportJob(pendingComments.peek(), uds_pkg.JobLLM, "")
+
 					// Run generation in background to not block WS pings
-					go func(data []byte) {
-						if err := generateAndStream(data); err != nil {
-							log.Printf("❌ Generation Failed: %v", err)
+					go func(data []byte, commentID string) {
+						engine.ReportJob(commentID, uds_pkg.JobGenerating, "")
+						if err := generateAndStream(ctx, data, commentID); err != nil {
+							log.Printf("❌ Generation Failed (comment %s): %v", commentID, err)
+							engine.ReportJob(commentID, uds_pkg.JobFailed, err.Error())
 						}
-					}(finalAudio)
+					}(finalAudio, commentID)
 				}
 				if msg.Event == 152 || msg.Event == 153 { // Error/End events
 					return
@@ -226,7 +301,7 @@ func receiveMessage(conn *websocket.Conn) (*Message, error) {
 // -----------------------------------------------------------------------------
 // Core Logic: Generate Video & Stream (Store-and-Forward Mode)
 // -----------------------------------------------------------------------------
-func generateAndStream(audioData []byte) error {
+func generateAndStream(ctx context.Context, audioData []byte, commentID string) error {
 	// 1. Save Audio to Temp File
 	// 使用 UUID 防止文件名冲突
 	tmpID := uuid.New().String()
@@ -242,7 +317,8 @@ func generateAndStream(audioData []byte) error {
 	// 2. Create Temporary UDS Listener for Python
 	tmpSockPath := filepath.Join(os.TempDir(), fmt.Sprintf("stream-%s.sock", tmpID))
 
-	listener, err := net.Listen("unix", tmpSockPath)
+	// 只给 Python 进程所在的用户/组写入权限，不再 0777 (见 genSocketPerms)
+	listener, err := transport.ListenWith(tmpSockPath, transport.ListenConfig{Socket: genSocketPerms})
 	if err != nil {
 		return fmt.Errorf("listen temp uds failed: %w", err)
 	}
@@ -250,8 +326,6 @@ func generateAndStream(audioData []byte) error {
 		listener.Close()
 		os.Remove(tmpSockPath)
 	}()
-	// 给 Python 写入权限
-	os.Chmod(tmpSockPath, 0777)
 
 	// 3. Trigger Python API (Async)
 	go func() {
@@ -306,12 +380,28 @@ func generateAndStream(audioData []byte) error {
 	errChan := make(chan error)
 
 	go func() {
-		c, err := listener.Accept()
-		if err != nil {
-			errChan <- err
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			if !genAllowlist.Empty() {
+				cred, err := transport.PeerCredentials(c)
+				if err != nil {
+					log.Printf("⚠️ Rejected temp uds peer, cannot read credentials: %v", err)
+					c.Close()
+					continue
+				}
+				if !genAllowlist.Allows(cred) {
+					log.Printf("⚠️ Rejected temp uds peer %s (not in GEN_ALLOW_*)", cred)
+					c.Close()
+					continue
+				}
+			}
+			connChan <- c
 			return
 		}
-		connChan <- c
 	}()
 
 	// 设置等待 Python 连接的超时时间 (包含模型加载时间)
@@ -396,49 +486,45 @@ func generateAndStream(audioData []byte) error {
 		// ========================================================
 		log.Println("▶️ Starting Synchronized Playback")
 
-		ticker := time.NewTicker(20 * time.Millisecond)
-		defer ticker.Stop()
+		stream, err := engine.OpenStream(tmpID, workerclient.StreamOptions{
+			Target:    os.Getenv("AVATAR_TARGET"),
+			CommentID: commentID,
+			Pace:      true, // 音频 20ms / 视频 40ms，由 Stream 按 PTS 节拍发送
+		})
+		if err != nil {
+			return fmt.Errorf("open engine stream: %w", err)
+		}
 
 		videoIdx := 0
-		tickCount := 0
 		audioDone := false
 
-		// Helper to write safely
-		writePacket := func(pt byte, data []byte) {
-			udsLock.Lock()
-			defer udsLock.Unlock()
-			uds_pkg.WritePacket(udsConn, pt, data)
-		}
-
 		for {
 			if audioDone && videoIdx >= len(videoBuffer) {
 				log.Println("🏁 Playback Finished.")
-				break
+				return stream.End()
 			}
 
-			<-ticker.C
+			// 按 PTS 交错发送：谁的下一帧更早先发谁
+			sendVideo := videoIdx < len(videoBuffer) &&
+				(audioDone || stream.NextPTS(uds_pkg.PacketTypeVideo) <= stream.NextPTS(uds_pkg.PacketTypeAudio))
 
-			// 1. Audio
-			if !audioDone {
-				page, _, err := oggReader.ParseNextPage()
-				if err != nil {
+			if sendVideo {
+				err = stream.WriteVideo(ctx, videoBuffer[videoIdx], 40*time.Millisecond)
+				videoIdx++
+			} else {
+				page, _, perr := oggReader.ParseNextPage()
+				if perr != nil {
 					audioDone = true
-				} else {
-					writePacket(uds_pkg.PacketTypeAudio, page)
+					continue
 				}
+				err = stream.WriteAudio(ctx, page, 20*time.Millisecond)
 			}
-
-			// 2. Video (每 2 tick 发一帧)
-			if tickCount%2 == 0 {
-				if videoIdx < len(videoBuffer) {
-					writePacket(uds_pkg.PacketTypeVideo, videoBuffer[videoIdx])
-					videoIdx++
-				}
+			if err != nil {
+				stream.Cancel(err.Error())
+				return fmt.Errorf("stream to engine: %w", err)
 			}
-			tickCount++
 		}
 	}
-	return nil
 }
 
 func streamGeneratedFile(path string) error {
@@ -1,124 +1,164 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
-	"net"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"infinite-live/internal/adapter/file"
 	"infinite-live/internal/domain" // Added
 	"infinite-live/internal/pkg/protocol"
+	"infinite-live/internal/pkg/workerclient"
 
 	"github.com/pion/webrtc/v4/pkg/media/oggreader"
 )
 
-const SocketPath = "/tmp/infinite-live.sock"
-
 func main() {
 	log.Println("Mock AI: Starting...")
 	videoPath := "assets/talking.ivf" // 改为 ivf
 	audioPath := "assets/talking.ogg"
 
-	for {
-		// Connect to Engine
-		log.Println("Connecting to Engine...")
-		conn, err := net.Dial("unix", SocketPath)
-		if err != nil {
-			log.Printf("Failed to connect: %v. Retrying in 2s...", err)
-			time.Sleep(2 * time.Second)
-			continue
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connected := make(chan struct{}, 1)
+	cfg, err := workerclient.ConfigFromEnv(workerclient.Config{
+		Hello: protocol.Hello{
+			Role:     protocol.RoleTalking,
+			WorkerID: "mock-ai",
+			Codecs:   []string{"vp8", "opus"},
+			FPS:      25,
+			Features: []string{protocol.FeatureTimestamps, protocol.FeatureSync, protocol.FeatureHeartbeat},
+		},
+		OnConnect: func(*protocol.HelloAck) {
+			log.Println("Mock AI: Connected!")
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		log.Fatalf("Mock AI: bad engine TLS config: %v", err)
+	}
+	client := workerclient.New(cfg)
+	go func() {
+		if err := client.Run(ctx); err != nil && ctx.Err() == nil {
+			// A rejected handshake is a build/config problem, retrying won't help
+			log.Fatalf("Mock AI: %v", err)
+		}
+	}()
+	go func() {
+		for cmd := range client.Commands() {
+			if cmd.Kind == workerclient.CommandComment {
+				log.Printf("Mock AI: ignoring comment %q", cmd.Comment.Text)
+			}
+		}
+	}()
+
+	// One connection, many utterances: each loop is framed by Start/End control packets
+	for n := 1; ctx.Err() == nil; n++ {
+		if !client.Connected() {
+			select {
+			case <-connected:
+			case <-ctx.Done():
+				return
+			}
 		}
-		log.Println("Mock AI: Connected!")
+		if err := playUtterance(ctx, client, n, videoPath, audioPath); err != nil {
+			log.Printf("Utterance failed: %v", err)
+		}
+		log.Println("Utterance Done. Waiting 100ms before next loop...")
+		time.Sleep(100 * time.Millisecond)
+	}
+}
 
-		var wg sync.WaitGroup
-		var mu sync.Mutex
+// playUtterance streams the talking clip once on its own logical stream.
+func playUtterance(ctx context.Context, client *workerclient.Client, n int, videoPath, audioPath string) error {
+	stream, err := client.OpenStream(fmt.Sprintf("mock-%d", n), workerclient.StreamOptions{
+		Target: os.Getenv("AVATAR_TARGET"),
+		Pace:   true,
+		Lead:   10 * time.Millisecond, // Send slightly early to keep buffer healthy
+	})
+	if err != nil {
+		return err
+	}
 
-		wg.Add(2)
+	var wg sync.WaitGroup
+	var writeErr error
+	var errOnce sync.Once
+	fail := func(err error) { errOnce.Do(func() { writeErr = err }) }
 
-		// --- Video Stream (Goroutine) ---
-		go func() {
-			defer wg.Done()
+	wg.Add(2)
+
+	// --- Video Stream (Goroutine) ---
+	go func() {
+		defer wg.Done()
+
+		vSource, err := file.NewSequentialReader(videoPath, domain.StateTalking)
+		if err != nil {
+			log.Printf("Video Source Failed: %v", err)
+			return
+		}
+		defer vSource.Close()
 
-			vSource, err := file.NewSequentialReader(videoPath, domain.StateTalking)
+		for {
+			frame, err := vSource.NextFrame()
 			if err != nil {
-				log.Printf("Video Source Failed: %v", err)
-				return
+				break
 			}
-			defer vSource.Close()
-
-			// Pacing (Send slightly faster than 40ms to keep buffer healthy)
-			// Target 40ms (25fps). Sending at 33ms is safe.
-			ticker := time.NewTicker(33 * time.Millisecond)
-			defer ticker.Stop()
-
-			for range ticker.C {
-				frame, err := vSource.NextFrame()
-				if err != nil {
-					break
-				}
-				frame.Type = protocol.PacketTypeVideo
-
-				mu.Lock()
-				err = protocol.WritePacket(conn, protocol.PacketTypeVideo, frame.Data)
-				mu.Unlock()
-
-				if err != nil {
-					log.Printf("Video Write Failed: %v", err)
-					break
-				}
+			// Pacing 由 Stream 按帧时长完成 (25fps)
+			if err := stream.WriteVideo(ctx, frame.Data, time.Duration(frame.Duration)*time.Millisecond); err != nil {
+				log.Printf("Video Write Failed: %v", err)
+				fail(err)
+				break
 			}
-			log.Println("Video Stream Finished")
-		}()
+		}
+		log.Println("Video Stream Finished")
+	}()
 
-		// --- Audio Stream (Goroutine) ---
-		go func() {
-			defer wg.Done()
+	// --- Audio Stream (Goroutine) ---
+	go func() {
+		defer wg.Done()
 
-			f, err := os.Open(audioPath)
-			if err != nil {
-				log.Printf("Audio File Failed: %v", err)
-				return
-			}
-			defer f.Close()
+		f, err := os.Open(audioPath)
+		if err != nil {
+			log.Printf("Audio File Failed: %v", err)
+			return
+		}
+		defer f.Close()
 
-			ogg, _, err := oggreader.NewWith(f)
+		ogg, _, err := oggreader.NewWith(f)
+		if err != nil {
+			log.Printf("Ogg Reader Failed: %v", err)
+			return
+		}
+
+		for {
+			payload, _, err := ogg.ParseNextPage()
 			if err != nil {
-				log.Printf("Ogg Reader Failed: %v", err)
-				return
+				break // EOF
 			}
-
 			// Pacing for Audio (20ms standard for Opus)
-			// Send slightly faster (15ms) to keep buffer full
-			ticker := time.NewTicker(15 * time.Millisecond)
-			defer ticker.Stop()
-
-			for range ticker.C {
-				payload, _, err := ogg.ParseNextPage()
-				if err != nil {
-					break // EOF
-				}
-
-				mu.Lock()
-				err = protocol.WritePacket(conn, protocol.PacketTypeAudio, payload)
-				mu.Unlock()
-				if err != nil {
-					break
-				}
+			if err := stream.WriteAudio(ctx, payload, 20*time.Millisecond); err != nil {
+				fail(err)
+				break
 			}
-			log.Println("Audio Stream Finished")
-		}()
-
-		wg.Wait()
-
-		// Send EOS
-		mu.Lock()
-		protocol.WritePacket(conn, protocol.PacketTypeVideo, []byte{})
-		mu.Unlock()
+		}
+		log.Println("Audio Stream Finished")
+	}()
 
-		conn.Close()
-		log.Println("Session Done. Waiting 100ms before next loop...")
-		time.Sleep(100 * time.Millisecond)
+	wg.Wait()
+	if writeErr != nil {
+		stream.Cancel(writeErr.Error())
+		return writeErr
 	}
+
+	// End the utterance; the connection stays open for the next one
+	return stream.End()
 }
@@ -1,21 +1,35 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"infinite-live/internal/adapter/file"
 	lkAdapter "infinite-live/internal/adapter/livekit" // 引入新写的 adapter
 	"infinite-live/internal/adapter/uds"
+	pionAdapter "infinite-live/internal/adapter/webrtc"
 	"infinite-live/internal/domain"
 	"infinite-live/internal/infrastructure"
+	"infinite-live/internal/pkg/handoff"
 	"infinite-live/internal/pkg/protocol"
+	"infinite-live/internal/pkg/transport"
 	"infinite-live/internal/usecase"
 
+	"github.com/google/uuid"
 	"github.com/livekit/protocol/auth"
 	lksdk "github.com/livekit/server-sdk-go/v2"
 	"github.com/pion/webrtc/v4"
@@ -25,25 +39,46 @@ import (
 var (
 	currentInteractor *usecase.LiveInteractor
 	broadcaster       *infrastructure.UDSBroadcaster
+	supervisor        *infrastructure.Supervisor // nil unless WORKERS_CONFIG is set
 	LiveKitURL        = os.Getenv("LIVEKITURL")
 	LiveKitAPIKey     = os.Getenv("LIVEKITAPIKEY")
 	LiveKitSecret     = os.Getenv("LIVEKITSECRET")
+	// 运营接口 (打断、队列管理、付费/运营优先级) 要带 Authorization: Bearer <OPERATOR_TOKEN>；不设置时这些接口关闭
+	OperatorToken = os.Getenv("OPERATOR_TOKEN")
 )
 
 // 配置信息 (建议放入环境变量)
 const (
 	RoomName      = "infinite-live-room"
 	ParticipantID = "digital-human-bot"
+	httpAddr      = ":8080"
 )
 
 func main() {
 	log.Println("Starting InfiniteLive Core (LiveKit Edition)...")
 
+	// 0. 接管监听 socket：systemd socket activation (LISTEN_FDS) 或上一个进程的平滑升级 (见 handoff)
+	listeners, err := handoff.Inherit()
+	if err != nil {
+		log.Fatalf("Failed to inherit listeners: %v", err)
+	}
+	if listeners.TakingOver() {
+		log.Println("Started by a graceful upgrade, will take over once ready")
+	}
+
 	// 1. 初始化 LiveKit Room 回调
 	roomCB := &lksdk.RoomCallback{
 		OnParticipantDisconnected: func(p *lksdk.RemoteParticipant) {
 			log.Println("User disconnected:", p.Identity())
 		},
+		// 观众开口说话 → Listening (BARGE_IN=voice 时打断正在播的回复)
+		OnActiveSpeakersChanged: func(speakers []lksdk.Participant) {
+			for _, p := range speakers {
+				if p.Identity() != ParticipantID && currentInteractor != nil {
+					currentInteractor.OnUserVoice(p.Identity())
+				}
+			}
+		},
 	}
 
 	// 2. 连接到 LiveKit 服务器
@@ -111,26 +146,174 @@ func main() {
 	if err != nil {
 		log.Fatalf("Audio init failed: %v (Did you run ffmpeg to generate .ogg?)", err)
 	}
-	// 初始化 UDS 广播器 (保持原有逻辑不变)
-	udsServer, err := infrastructure.NewUDSServer("/tmp/infinite-live.sock")
+	// 初始化 Worker 监听 (默认只有 UDS；远程 GPU 机器可走 TCP/TLS/WebSocket)
+	udsServer, err := newWorkerServer(listeners)
 	if err != nil {
 		log.Fatalf("Failed to start UDS server: %v", err)
 	}
 	defer udsServer.Close()
 	broadcaster = infrastructure.NewUDSBroadcaster(udsServer)
+	// 心跳与卡死检测：UDS_PING_INTERVAL / UDS_PONG_TIMEOUT / UDS_STALL_TIMEOUT (如 "2s", "500ms")
+	heartbeat := infrastructure.DefaultHeartbeatConfig()
+	for env, d := range map[string]*time.Duration{
+		"UDS_PING_INTERVAL": &heartbeat.PingInterval,
+		"UDS_PONG_TIMEOUT":  &heartbeat.PongTimeout,
+		"UDS_STALL_TIMEOUT": &heartbeat.StallTimeout,
+	} {
+		if v := os.Getenv(env); v != "" {
+			if *d, err = time.ParseDuration(v); err != nil {
+				log.Fatalf("%s: %v", env, err)
+			}
+		}
+	}
+	broadcaster.SetHeartbeat(heartbeat)
+	// 新订阅者从缓存的最近一个 GOP 开始解码；UDS_GOP_CACHE_PACKETS=0 关闭
+	if v := os.Getenv("UDS_GOP_CACHE_PACKETS"); v != "" {
+		gop := infrastructure.DefaultGOPCacheConfig()
+		if gop.MaxPackets, err = strconv.Atoi(v); err != nil {
+			log.Fatalf("UDS_GOP_CACHE_PACKETS: %v", err)
+		}
+		broadcaster.SetGOPCache(gop)
+	}
+	// 评论队列：每个 Worker 一次只发一条，它回复结束再发下一条
+	// QUEUE_MAX_LEN (0 不限) / QUEUE_POLICY (reject|drop-oldest) / QUEUE_DEDUPE_WINDOW (0 关闭) / QUEUE_REPLY_TIMEOUT
+	queue := infrastructure.DefaultQueueConfig()
+	if v := os.Getenv("QUEUE_MAX_LEN"); v != "" {
+		if queue.MaxLen, err = strconv.Atoi(v); err != nil {
+			log.Fatalf("QUEUE_MAX_LEN: %v", err)
+		}
+	}
+	if v := os.Getenv("QUEUE_POLICY"); v != "" {
+		if queue.Policy, err = infrastructure.ParseQueuePolicy(v); err != nil {
+			log.Fatalf("QUEUE_POLICY: %v", err)
+		}
+	}
+	queue.DedupeWindow = envDuration("QUEUE_DEDUPE_WINDOW", queue.DedupeWindow)
+	queue.ReplyTimeout = envDuration("QUEUE_REPLY_TIMEOUT", queue.ReplyTimeout)
+	broadcaster.SetQueue(queue)
+	if OperatorToken == "" {
+		log.Println("OPERATOR_TOKEN not set: interrupt and queue endpoints disabled, comment priorities clamped to regular")
+	}
+	broadcaster.OnCommentSent(func(job infrastructure.Job) {
+		if currentInteractor != nil {
+			currentInteractor.OnJobDispatched(job.ID)
+		}
+	})
+	// WORKER_TOKEN: Worker 必须在 Hello 里带上同样的 token (workerclient 读 ENGINE_TOKEN)
+	if token := os.Getenv("WORKER_TOKEN"); token != "" {
+		policy := protocol.DefaultHandshakePolicy()
+		policy.Token = token
+		broadcaster.SetHandshakePolicy(policy)
+		log.Println("Worker handshake requires a token")
+	}
+	// 设置 UDS_RECORD_PATH 后录制与 Worker 的全部往来，可用 cmd/udsreplay 回放
+	if path := os.Getenv("UDS_RECORD_PATH"); path != "" {
+		rec, err := protocol.CreateRecording(path)
+		if err != nil {
+			log.Fatalf("Failed to create recording: %v", err)
+		}
+		defer rec.Close()
+		broadcaster.SetRecorder(rec)
+		log.Println("Recording UDS session to", path)
+	}
 	broadcaster.Start()
 
-	// 订阅 UDS
-	pktCh := broadcaster.Subscribe()
-	talkingSource := uds.NewChannelSource(pktCh)
+	// WORKERS_CONFIG: 可选，由引擎拉起并守护的 Worker 进程 (JSON 数组，见 infrastructure.ProcessSpec)
+	// 例: [{"name":"doubao","command":"./doubao_worker","env":{"AVATAR_TARGET":"main"}}]
+	supervisorCtx, stopSupervisor := context.WithCancel(context.Background())
+	defer stopSupervisor()
+	if path := os.Getenv("WORKERS_CONFIG"); path != "" {
+		specs, err := infrastructure.LoadProcessSpecs(path)
+		if err != nil {
+			log.Fatalf("WORKERS_CONFIG: %v", err)
+		}
+		// 子进程默认连本引擎的第一个监听地址 (ProcessSpec.Env 里可以覆盖)
+		env := []string{"ENGINE_ADDR=" + workerListenAddrs()[0]}
+		if token := os.Getenv("WORKER_TOKEN"); token != "" {
+			env = append(env, "ENGINE_TOKEN="+token)
+		}
+		supervisor = infrastructure.NewSupervisor(infrastructure.SupervisorConfig{
+			MaxBackoff:  envDuration("SUPERVISOR_MAX_BACKOFF", 0),
+			StopTimeout: envDuration("SUPERVISOR_STOP_TIMEOUT", 0),
+			Env:         env,
+		})
+		// 平滑升级时等旧进程停掉它的 Worker 再拉起，否则两套同 ID 的 Worker 会在 register 里互相顶掉
+		go func() {
+			select {
+			case <-listeners.Released():
+			case <-supervisorCtx.Done():
+				return
+			}
+			supervisor.Start(supervisorCtx, specs)
+			log.Printf("Supervising %d worker processes from %s", len(specs), path)
+		}()
+	}
+
+	// 订阅 UDS：推流跟不上时默认整 GOP 丢弃，避免丢关键帧导致画面冻结
+	// (UDS_BACKPRESSURE / UDS_QUEUE_DEPTH 可调，见 infrastructure.BackpressurePolicy)
+	subOpts := infrastructure.SubscribeOptions{Name: "interactor", Policy: infrastructure.DropGOP}
+	if v := os.Getenv("UDS_BACKPRESSURE"); v != "" {
+		if subOpts.Policy, err = infrastructure.ParseBackpressurePolicy(v); err != nil {
+			log.Fatalf("UDS_BACKPRESSURE: %v", err)
+		}
+	}
+	if v := os.Getenv("UDS_QUEUE_DEPTH"); v != "" {
+		if subOpts.Depth, err = strconv.Atoi(v); err != nil {
+			log.Fatalf("UDS_QUEUE_DEPTH: %v", err)
+		}
+	}
+	talkingSource := uds.NewSubscriptionSource(broadcaster.SubscribeWith(context.Background(), subOpts))
 
 	// 使用新的 LiveKit Publisher
 	lkPublisher := lkAdapter.NewLiveKitPublisher(videoTrack, audioTrack)
 
+	var publisher domain.StreamPublisher = lkPublisher
+	// WEBRTC_CONFIG: 内置 Pion 输出的 ICE 配置 (JSON，见 infrastructure.WebRTCConfig)，
+	// 设置后同一路音视频也推给 POST /whep 的观众 (NAT 后面要配 nat_1to1_ips 或 TURN)
+	if path := os.Getenv("WEBRTC_CONFIG"); path != "" {
+		pionPublisher, whep, err := newWHEPOutput(path)
+		if err != nil {
+			log.Fatalf("WEBRTC_CONFIG: %v", err)
+		}
+		defer whep.close()
+		publisher = multiPublisher{lkPublisher, pionPublisher}
+		http.HandleFunc("POST /whep", whep.handleOffer)
+		http.HandleFunc("DELETE /whep/{id}", whep.handleDelete)
+		log.Println("Built-in WebRTC output enabled at POST /whep")
+	}
+
 	// 初始化 Interactor
-	interactor := usecase.NewLiveInteractor(lkPublisher, idleSource, idleAudioSource)
+	interactor := usecase.NewLiveInteractor(publisher, idleSource, idleAudioSource)
+	// 聆听/思考时的循环片段 (逗号分隔的 .ivf)，不配置则继续播 Idle
+	for env, state := range map[string]domain.AvatarState{
+		"LISTENING_CLIPS": domain.StateListening,
+		"THINKING_CLIPS":  domain.StateThinking,
+	} {
+		clips, err := loadClips(os.Getenv(env), state)
+		if err != nil {
+			log.Fatalf("%s: %v", env, err)
+		}
+		interactor.SetStateClips(state, clips...)
+	}
+	interactor.SetStateTimeouts(usecase.StateTimeouts{
+		ListeningMin: envDuration("LISTENING_MIN", usecase.DefaultStateTimeouts().ListeningMin),
+		Listening:    envDuration("LISTENING_TIMEOUT", 0),
+		Thinking:     envDuration("THINKING_TIMEOUT", 0),
+	})
+	// 口型对齐：AV_OFFSET 为正时音频推迟，为负时视频推迟
+	interactor.SetAVSync(usecase.AVSyncConfig{
+		Offset:      envDuration("AV_OFFSET", 0),
+		MaxLateness: envDuration("AV_MAX_LATENESS", 0),
+	})
 	interactor.SetTalkingSource(talkingSource)
+	interactor.SetCanceller(broadcaster)
+	bargeIn, err := parseBargeIn(os.Getenv("BARGE_IN"))
+	if err != nil {
+		log.Fatalf("BARGE_IN: %v", err)
+	}
+	interactor.SetBargeIn(bargeIn)
 	currentInteractor = interactor
+	go publishAvatarAttributes(context.Background(), room.LocalParticipant, interactor)
 
 	// 6. 启动推流循环 (异步启动)
 	// LiveKit 连接成功后，我们就可以一直推流，无论有没有用户在房间里
@@ -139,34 +322,538 @@ func main() {
 
 	// 7. 启动 HTTP 服务 (用于前端页面和 Comment 接口)
 	http.HandleFunc("/comment", handleComment)
+	http.HandleFunc("GET /jobs/{id}", handleJob)
+	http.HandleFunc("/workers", handleWorkers)
+	http.HandleFunc("/subscribers", handleSubscribers)
+	http.HandleFunc("/health", handleHealth)
+	http.HandleFunc("/supervisor", handleSupervisor)
+	http.HandleFunc("GET /state", handleState)
+	http.HandleFunc("GET /events", handleEvents)
+	// 观众打断走评论 / 语音 (BARGE_IN)，这里只给运营用
+	http.HandleFunc("POST /interrupt", requireOperator(handleInterrupt))
+	http.HandleFunc("GET /queue", requireOperator(handleQueue))
+	http.HandleFunc("POST /queue/{id}/move", requireOperator(handleQueueMove))
+	http.HandleFunc("DELETE /queue/{id}", requireOperator(handleQueueRemove))
 	// 在 main 函数里注册
 	http.HandleFunc("/token", handleToken)
 	http.Handle("/", http.FileServer(http.Dir("./static")))
 
-	log.Println("HTTP Server listening on :8080")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	httpLn, _, err := listeners.Listen("tcp", httpAddr, func() (net.Listener, error) { return net.Listen("tcp", httpAddr) })
+	if err != nil {
 		log.Fatal(err)
 	}
+	listeners.CloseUnused()
+	httpServer := &http.Server{}
+	go func() {
+		if err := httpServer.Serve(httpLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	log.Println("HTTP Server listening on", httpAddr)
+
+	// 8. 资源加载完、监听就绪：通知升级我们的旧进程可以退出了
+	if err := listeners.Ready(); err != nil {
+		log.Printf("Failed to signal readiness to the previous process: %v", err)
+	}
+	waitForShutdown(listeners)
+	// 先停自己的 Worker 进程 (它们还能发完 StreamClose)，再让升级后的新进程拉起它的
+	if supervisor != nil {
+		stopSupervisor()
+		supervisor.Wait()
+	}
+	listeners.Release()
+	drain(httpServer, udsServer)
 }
 
-// handleComment 保持不变，它是你的业务触发器
+// waitForShutdown 阻塞到该退出为止：
+//   - SIGHUP: 平滑升级。用同样的参数 exec 新的二进制并移交监听 socket，新进程就绪后返回；失败则继续服务
+//   - SIGINT / SIGTERM: 直接返回
+func waitForShutdown(listeners *handoff.Listeners) {
+	upgradeTimeout := envDuration("UPGRADE_TIMEOUT", 60*time.Second) // 新进程要连 LiveKit、加载素材
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %v, shutting down", sig)
+			return
+		}
+		log.Println("Received SIGHUP, upgrading...")
+		if err := listeners.Upgrade(upgradeTimeout); err != nil {
+			log.Printf("❌ Upgrade failed, keep serving: %v", err)
+			continue
+		}
+		return
+	}
+}
+
+// drain 停止接受新连接，等进行中的 HTTP 请求结束 (最多 DRAIN_TIMEOUT)。
+// 不等 Worker 播完：升级时新进程用同一个 identity 进房间，LiveKit 已经把本进程踢出，
+// 尽快断开 Worker 让它们重连到新进程才是对的。
+func drain(httpServer *http.Server, udsServer *infrastructure.UDSServer) {
+	ctx, cancel := context.WithTimeout(context.Background(), envDuration("DRAIN_TIMEOUT", 10*time.Second))
+	defer cancel()
+
+	udsServer.Close()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("HTTP shutdown: %v", err)
+	}
+	log.Println("Drained, exiting")
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	return d
+}
+
+// parseBargeIn 解析 BARGE_IN，如 "comment,voice"：哪些事件会打断正在播的回复
+func parseBargeIn(v string) (usecase.BargeIn, error) {
+	var b usecase.BargeIn
+	for _, name := range strings.Split(v, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "comment":
+			b.Comment = true
+		case "voice":
+			b.Voice = true
+		default:
+			return b, fmt.Errorf("unknown trigger %q (want comment, voice)", name)
+		}
+	}
+	return b, nil
+}
+
+// loadClips 打开逗号分隔的 .ivf 循环片段
+func loadClips(paths string, state domain.AvatarState) ([]domain.ResettableFrameSource, error) {
+	var clips []domain.ResettableFrameSource
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		clip, err := file.NewLoopReader(path, state)
+		if err != nil {
+			return nil, err
+		}
+		clips = append(clips, clip)
+	}
+	return clips, nil
+}
+
+// newWorkerServer 根据环境变量创建 Worker 监听：
+//   - WORKER_LISTEN: 逗号分隔的地址，如 "/tmp/infinite-live.sock,tls://:7443,ws://:7080/worker"
+//   - WORKER_TLS_CERT / WORKER_TLS_KEY: tls:// 与 wss:// 的证书
+//   - WORKER_TLS_CLIENT_CA: 设置后要求 Worker 出示由该 CA 签发的证书 (mTLS)
+//   - WORKER_SOCKET_MODE / WORKER_SOCKET_OWNER / WORKER_SOCKET_GROUP: Unix socket 的权限 (如 "0660") 与属主
+//   - WORKER_ALLOW_USERS / WORKER_ALLOW_GROUPS / WORKER_ALLOW_PIDS: 逗号分隔，按 SO_PEERCRED 只放行这些本地进程
+//   - WORKER_INSECURE=1: 允许 tcp:// / ws:// 不设 WORKER_TOKEN (只在受信网络里用)
+func newWorkerServer(listeners *handoff.Listeners) (*infrastructure.UDSServer, error) {
+	addrs := workerListenAddrs()
+	if err := checkWorkerAuth(addrs); err != nil {
+		return nil, err
+	}
+
+	cfg := transport.ListenConfig{
+		Source: listeners,
+		Socket: transport.SocketPerms{
+			Owner: os.Getenv("WORKER_SOCKET_OWNER"),
+			Group: os.Getenv("WORKER_SOCKET_GROUP"),
+		},
+	}
+	if v := os.Getenv("WORKER_SOCKET_MODE"); v != "" {
+		mode, err := strconv.ParseUint(v, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("WORKER_SOCKET_MODE: %w", err)
+		}
+		cfg.Socket.Mode = os.FileMode(mode)
+	}
+	if cert := os.Getenv("WORKER_TLS_CERT"); cert != "" {
+		conf, err := transport.ServerTLSConfig(cert, os.Getenv("WORKER_TLS_KEY"), os.Getenv("WORKER_TLS_CLIENT_CA"))
+		if err != nil {
+			return nil, fmt.Errorf("worker TLS: %w", err)
+		}
+		cfg.TLS = conf
+	}
+	allow, err := transport.ParsePeerAllowlist(os.Getenv("WORKER_ALLOW_USERS"), os.Getenv("WORKER_ALLOW_GROUPS"), os.Getenv("WORKER_ALLOW_PIDS"))
+	if err != nil {
+		return nil, fmt.Errorf("worker allowlist: %w", err)
+	}
+
+	server, err := infrastructure.NewServerWith(cfg, addrs...)
+	if err != nil {
+		return nil, err
+	}
+	if !allow.Empty() {
+		server.SetPeerAllowlist(allow)
+		log.Printf("Worker Unix sockets only accept uids=%v gids=%v pids=%v", allow.UIDs, allow.GIDs, allow.PIDs)
+	}
+	return server, nil
+}
+
+// checkWorkerAuth: tcp:// 与 ws:// 既没有 TLS 也没有 SO_PEERCRED，任何连得上端口的人都能冒充 Worker 推流，
+// 所以不设 WORKER_TOKEN 就拒绝启动
+func checkWorkerAuth(addrs []string) error {
+	hasToken := os.Getenv("WORKER_TOKEN") != ""
+	for _, addr := range addrs {
+		a, err := transport.ParseAddress(addr)
+		if err != nil {
+			return err
+		}
+		if !a.Plaintext() {
+			continue
+		}
+		switch {
+		case hasToken:
+			log.Printf("⚠️ Worker listener %s is plaintext: the token and media travel unencrypted, prefer tls:// or wss://", a)
+		case os.Getenv("WORKER_INSECURE") == "1":
+			log.Printf("⚠️ WARNING: worker listener %s accepts anyone, no TLS and no WORKER_TOKEN (WORKER_INSECURE=1)", a)
+		default:
+			return fmt.Errorf("%s has no TLS and no peer credentials: set WORKER_TOKEN, or WORKER_INSECURE=1 on a trusted network", a)
+		}
+	}
+	return nil
+}
+
+func workerListenAddrs() []string {
+	if v := os.Getenv("WORKER_LISTEN"); v != "" {
+		return strings.Split(v, ",")
+	}
+	return []string{"/tmp/infinite-live.sock"}
+}
+
+// handleComment 是你的业务触发器
+// 支持两种 Body：
+//   - application/json: protocol.Comment (id/author/platform/priority/metadata 可选；
+//     priority 高于 regular 需要运营 token，见 isOperator)
+//   - 其它: 纯文本，作为匿名评论
 func handleComment(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	body, _ := io.ReadAll(r.Body)
-	log.Printf("Received Comment: %s", string(body))
+	comment, err := parseComment(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Received Comment %s from %s@%s: %s", comment.ID, comment.Author.DisplayName, comment.Platform, comment.Text)
+
+	route, err := parseRoute(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// 进评论队列，轮到它时发给 Worker AI (按路由选择一个 Worker)，评论变成一个可查询的 job (GET /jobs/{id})
+	if broadcaster == nil {
+		http.Error(w, "engine not ready", http.StatusServiceUnavailable)
+		return
+	}
+	job, err := broadcaster.EnqueueComment(route, comment)
+	if err != nil {
+		log.Printf("Comment %s not accepted: %v", comment.ID, err)
+		status := http.StatusBadGateway
+		switch {
+		case errors.Is(err, infrastructure.ErrWorkerNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, infrastructure.ErrNoWorker):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, infrastructure.ErrQueueFull):
+			status = http.StatusTooManyRequests
+		case errors.Is(err, infrastructure.ErrDuplicateComment):
+			status = http.StatusConflict
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	resp := map[string]interface{}{"comment_id": job.ID, "worker_id": job.WorkerID, "job": job}
+	if job.CoalescedInto != "" {
+		// 和刚才的一条评论重复，合并进那条的回复 (GET /jobs/{id} 跟着那条走)
+		resp["coalesced_into"] = job.CoalescedInto
+	} else if currentInteractor != nil {
+		// 评论确实会被回复才打断 (被拒绝或重复的评论不打断)
+		currentInteractor.OnUserComment(comment.Text)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isOperator 校验 Authorization: Bearer <OPERATOR_TOKEN>
+func isOperator(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && OperatorToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(OperatorToken)) == 1
+}
+
+// requireOperator 只放行带运营 token 的请求
+func requireOperator(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if OperatorToken == "" {
+			http.Error(w, "operator endpoints disabled (OPERATOR_TOKEN not set)", http.StatusForbidden)
+			return
+		}
+		if !isOperator(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "operator token required", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handleQueue 列出正在回复的评论和排队中的评论 (按发送顺序)
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	if broadcaster == nil {
+		http.Error(w, "engine not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(broadcaster.Queue())
+}
+
+// handleQueueMove 把排队中的评论挪到 ?position= (从 1 开始)
+func handleQueueMove(w http.ResponseWriter, r *http.Request) {
+	if broadcaster == nil {
+		http.Error(w, "engine not ready", http.StatusServiceUnavailable)
+		return
+	}
+	position, err := strconv.Atoi(r.URL.Query().Get("position"))
+	if err != nil {
+		http.Error(w, "position: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := broadcaster.MoveQueued(r.PathValue("id"), position); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(broadcaster.Queue())
+}
+
+// handleQueueRemove 把评论从队列里撤掉 (?reason= 记在 job 上)
+func handleQueueRemove(w http.ResponseWriter, r *http.Request) {
+	if broadcaster == nil {
+		http.Error(w, "engine not ready", http.StatusServiceUnavailable)
+		return
+	}
+	if err := broadcaster.RemoveQueued(r.PathValue("id"), r.URL.Query().Get("reason")); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	// 发送给 Worker AI
+// handleJob 返回评论 job 的当前状态与历史 (pending → received → ... → done/failed)
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	if broadcaster == nil {
+		http.Error(w, "engine not ready", http.StatusServiceUnavailable)
+		return
+	}
+	job, ok := broadcaster.Job(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// parseRoute 从查询参数读取路由：?worker=<id> 指定 Worker，
+// 否则 ?role= (默认 talking) 过滤、?route=round_robin|least_busy (默认 least_busy) 选择
+func parseRoute(r *http.Request) (infrastructure.Route, error) {
+	q := r.URL.Query()
+	route := infrastructure.Route{
+		WorkerID: q.Get("worker"),
+		Role:     protocol.RoleTalking,
+		Policy:   infrastructure.RouteLeastBusy,
+	}
+	if role := q.Get("role"); role != "" {
+		route.Role = role
+	}
+	if p := q.Get("route"); p != "" {
+		policy, err := infrastructure.ParseRoutePolicy(p)
+		if err != nil {
+			return route, err
+		}
+		route.Policy = policy
+	}
+	return route, nil
+}
+
+// handleState 返回数字人当前的状态快照
+func handleState(w http.ResponseWriter, r *http.Request) {
+	if currentInteractor == nil {
+		http.Error(w, "engine not ready", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentInteractor.Snapshot())
+}
+
+// handleInterrupt 打断正在播的回复 (?reason= 记录在事件里)，数字人转为 Listening
+func handleInterrupt(w http.ResponseWriter, r *http.Request) {
+	if currentInteractor == nil {
+		http.Error(w, "engine not ready", http.StatusServiceUnavailable)
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "http"
+	}
+	ids := currentInteractor.Interrupt(reason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"interrupted": ids, "state": currentInteractor.Snapshot()})
+}
+
+// sseKeepalive 防止代理把空闲的 SSE 连接断开
+const sseKeepalive = 15 * time.Second
+
+// handleEvents 以 Server-Sent Events 推送数字人事件：先发一个 snapshot，之后每个事件一条
+// (event 名就是 usecase.EventKind，如 state_changed / utterance_started)
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if currentInteractor == nil {
+		http.Error(w, "engine not ready", http.StatusServiceUnavailable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events := currentInteractor.Events(r.Context())
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	payload, _ := json.Marshal(currentInteractor.Snapshot())
+	fmt.Fprintf(w, "event: snapshot\ndata: %s\n\n", payload)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			payload, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Kind, payload)
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+// publishAvatarAttributes 把状态和正在播的回复同步到 LiveKit 参与者属性 (前端用 participant.attributes 读取)
+func publishAvatarAttributes(ctx context.Context, p *lksdk.LocalParticipant, interactor *usecase.LiveInteractor) {
+	update := func() {
+		snap := interactor.Snapshot()
+		p.SetAttributes(map[string]string{
+			"avatar_state": snap.State,
+			"utterance_id": snap.UtteranceID,
+			"comment_id":   snap.CommentID,
+		})
+	}
+	update()
+	for ev := range interactor.Events(ctx) {
+		switch ev.Kind {
+		case usecase.EventStateChanged, usecase.EventUtteranceStarted, usecase.EventUtteranceFinished:
+			update()
+		}
+	}
+}
+
+// handleHealth 汇总 Worker 健康状态：有不健康的 Worker 时 status 为 "degraded"
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Status  string                      `json:"status"`
+		Workers []infrastructure.WorkerInfo `json:"workers"`
+	}{Status: "ok", Workers: []infrastructure.WorkerInfo{}}
 	if broadcaster != nil {
-		broadcaster.SendToWorker(protocol.PacketTypeText, body)
+		resp.Workers = broadcaster.Workers()
+	}
+	for _, worker := range resp.Workers {
+		if !worker.Healthy {
+			resp.Status = "degraded"
+		}
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
 
-	if currentInteractor != nil {
-		currentInteractor.OnUserComment(string(body))
+// handleSubscribers 列出订阅者的队列深度和按包类型统计的丢包数
+func handleSubscribers(w http.ResponseWriter, r *http.Request) {
+	subs := []infrastructure.SubscriberStats{}
+	if broadcaster != nil {
+		subs = broadcaster.SubscriberStats()
 	}
-	w.WriteHeader(http.StatusOK)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(subs)
+}
+
+// handleSupervisor 列出引擎守护的 Worker 进程：PID、运行时长、重启次数、是否 crash loop
+func handleSupervisor(w http.ResponseWriter, r *http.Request) {
+	procs := []infrastructure.ProcessStatus{}
+	if supervisor != nil {
+		procs = supervisor.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(procs)
+}
+
+// handleWorkers 列出当前连接的 Worker 及其负载
+func handleWorkers(w http.ResponseWriter, r *http.Request) {
+	workers := []infrastructure.WorkerInfo{}
+	if broadcaster != nil {
+		workers = broadcaster.Workers()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(workers)
+}
+
+// parseComment 把请求转换成结构化评论，并补齐 ID / 来源 / 时间
+func parseComment(r *http.Request) (*protocol.Comment, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	comment := &protocol.Comment{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(body, comment); err != nil {
+			return nil, fmt.Errorf("invalid comment json: %w", err)
+		}
+	} else {
+		comment.Text = string(body)
+	}
+	if err := comment.Validate(); err != nil {
+		return nil, err
+	}
+	// 请求体谁都能写：付费/运营优先级只认带运营 token 的请求 (如平台的礼物回调)
+	if comment.Priority > protocol.PriorityRegular && !isOperator(r) {
+		log.Printf("Comment %s: priority %d without operator token, treated as regular", comment.ID, comment.Priority)
+		comment.Priority = protocol.PriorityRegular
+	}
+
+	if comment.ID == "" {
+		comment.ID = uuid.New().String()
+	}
+	if comment.Platform == "" {
+		comment.Platform = "web"
+	}
+	if comment.CreatedAt == 0 {
+		comment.CreatedAt = time.Now().UnixMilli()
+	}
+	return comment, nil
 }
 
 func handleToken(w http.ResponseWriter, r *http.Request) {
@@ -188,3 +875,134 @@ func handleToken(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"token": token})
 }
+
+// multiPublisher 把同一帧推给每个输出 (LiveKit + 内置 Pion)，一个出错不影响其他的
+type multiPublisher []domain.StreamPublisher
+
+func (m multiPublisher) Publish(frame *domain.MediaFrame) error {
+	var errs []error
+	for _, p := range m {
+		if err := p.Publish(frame); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// whepOutput 是内置 Pion 输出：每个 WHEP 观众一个 PeerConnection，共享同一对 track
+type whepOutput struct {
+	manager *infrastructure.WebRTCManager
+	tracks  []webrtc.TrackLocal
+	peers   sync.Map // id -> *webrtc.PeerConnection
+}
+
+func newWHEPOutput(configPath string) (*pionAdapter.PionPublisher, *whepOutput, error) {
+	cfg, err := infrastructure.LoadWebRTCConfig(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	manager, err := infrastructure.NewWebRTCManagerWith(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	video, err := pionAdapter.NewVP8Track()
+	if err != nil {
+		manager.Close()
+		return nil, nil, err
+	}
+	audio, err := pionAdapter.NewOpusTrack()
+	if err != nil {
+		manager.Close()
+		return nil, nil, err
+	}
+	return pionAdapter.NewPionPublisher(video, audio), &whepOutput{manager: manager, tracks: []webrtc.TrackLocal{video, audio}}, nil
+}
+
+// handleOffer: body 是 SDP offer，等 ICE 收集完一次性返回 answer (不支持 trickle)
+func (o *whepOutput) handleOffer(w http.ResponseWriter, r *http.Request) {
+	offer, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	pc, err := o.manager.NewPeerConnection()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, track := range o.tracks {
+		sender, err := pc.AddTrack(track)
+		if err != nil {
+			pc.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// 读走 RTCP，否则 interceptor (NACK 等) 收不到反馈
+		go func() {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}()
+	}
+	id := uuid.NewString()
+	o.peers.Store(id, pc)
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateFailed:
+			pc.Close()
+		case webrtc.PeerConnectionStateClosed:
+			o.peers.Delete(id)
+		}
+	})
+	fail := func(code int, err error) {
+		o.peers.Delete(id)
+		pc.Close()
+		http.Error(w, err.Error(), code)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: string(offer)}); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		fail(http.StatusInternalServerError, err)
+		return
+	}
+	select {
+	case <-gathered:
+	case <-r.Context().Done():
+		fail(http.StatusServiceUnavailable, r.Context().Err())
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", "/whep/"+id)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, pc.LocalDescription().SDP)
+}
+
+// handleDelete: 观众离开时 DELETE Location
+func (o *whepOutput) handleDelete(w http.ResponseWriter, r *http.Request) {
+	pc, ok := o.peers.LoadAndDelete(r.PathValue("id"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	pc.(*webrtc.PeerConnection).Close()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (o *whepOutput) close() {
+	o.peers.Range(func(id, pc any) bool {
+		pc.(*webrtc.PeerConnection).Close()
+		return true
+	})
+	o.manager.Close()
+}
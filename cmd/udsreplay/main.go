@@ -0,0 +1,208 @@
+// udsreplay connects to the engine as a worker and replays a session recorded
+// with UDS_RECORD_PATH, so freezes and lip-sync bugs can be reproduced without
+// Doubao or the GPU pipeline.
+//
+//	go run ./cmd/udsreplay -file session.ilrec            # original timing
+//	go run ./cmd/udsreplay -file session.ilrec -speed 2   # twice as fast
+//	go run ./cmd/udsreplay -file session.ilrec -speed 0   # as fast as possible
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+	"infinite-live/internal/pkg/workerclient"
+)
+
+func main() {
+	file := flag.String("file", "", "Recording to replay (required)")
+	addr := flag.String("addr", "", "Engine address (default $ENGINE_ADDR or "+workerclient.DefaultSocketPath+")")
+	speed := flag.Float64("speed", 1, "Timing scale: 1 = original, 2 = twice as fast, 0 = no pacing")
+	loop := flag.Bool("loop", false, "Replay the recording forever")
+	worker := flag.String("worker", "", "Worker ID to replay when several were recorded (default: the first one)")
+	flag.Parse()
+	if *file == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	hello, err := findHello(*file, *worker)
+	if err != nil {
+		log.Fatalf("udsreplay: %v", err)
+	}
+	log.Printf("udsreplay: replaying %s as %s (codecs=%v, features=%v)", *file, hello.WorkerID, hello.Codecs, hello.Features)
+
+	connected := make(chan struct{}, 1)
+	cfg, err := workerclient.ConfigFromEnv(workerclient.Config{
+		Hello: *hello,
+		OnConnect: func(*protocol.HelloAck) {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		log.Fatalf("udsreplay: bad engine TLS config: %v", err)
+	}
+	if *addr != "" {
+		cfg.Addr = *addr
+	}
+	client := workerclient.New(cfg)
+	go func() {
+		if err := client.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Fatalf("udsreplay: %v", err)
+		}
+	}()
+	go func() {
+		for cmd := range client.Commands() {
+			if cmd.Kind == workerclient.CommandComment {
+				log.Printf("udsreplay: engine sent comment %s: %q", cmd.Comment.ID, cmd.Comment.Text)
+			}
+		}
+	}()
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return
+	}
+
+	for n := 1; ; n++ {
+		sent, err := replay(ctx, client, *file, hello.WorkerID, *speed)
+		if err != nil && ctx.Err() == nil {
+			log.Fatalf("udsreplay: pass %d: %v", n, err)
+		}
+		log.Printf("udsreplay: pass %d done, %d packets sent", n, sent)
+		if !*loop || ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// findHello returns the Hello of the first session of workerID in the
+// recording, or of the first session at all if workerID is empty.
+func findHello(path, workerID string) (*protocol.Hello, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rr, err := protocol.NewRecordReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var rec protocol.Record
+	for {
+		if err := rr.Next(&rec); err != nil {
+			if err == io.EOF {
+				if workerID != "" {
+					return nil, fmt.Errorf("recording contains no session of worker %s", workerID)
+				}
+				return nil, errors.New("recording contains no worker session")
+			}
+			return nil, err
+		}
+		if rec.Dir == protocol.DirInbound && rec.Frame.Type == protocol.PacketTypeHello {
+			hello := &protocol.Hello{}
+			if err := json.Unmarshal(rec.Frame.Payload, hello); err != nil {
+				return nil, fmt.Errorf("bad recorded hello: %w", err)
+			}
+			if workerID == "" || hello.WorkerID == workerID {
+				return hello, nil
+			}
+		}
+	}
+}
+
+// replay sends every worker->engine packet of workerID's connections, keeping
+// the recorded gaps between them (scaled by speed). Engine->worker packets are
+// only logged; the live engine produces its own.
+func replay(ctx context.Context, client *workerclient.Client, path, workerID string, speed float64) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rr, err := protocol.NewRecordReader(f)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		rec     protocol.Record
+		sent    int
+		hellos  int
+		conns   = make(map[uint32]bool) // recorded connections of workerID
+		first   = time.Duration(-1)
+		started time.Time
+	)
+	for {
+		if err := rr.Next(&rec); err != nil {
+			if err == io.EOF {
+				return sent, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				log.Println("udsreplay: recording is truncated, stopping at the last complete packet")
+				return sent, nil
+			}
+			return sent, err
+		}
+
+		if rec.Frame.Type == protocol.PacketTypeHello && rec.Dir == protocol.DirInbound {
+			var hello protocol.Hello
+			if json.Unmarshal(rec.Frame.Payload, &hello) == nil && hello.WorkerID == workerID {
+				conns[rec.Conn] = true
+			}
+		}
+		if !conns[rec.Conn] {
+			continue
+		}
+
+		if rec.Dir == protocol.DirOutbound {
+			log.Printf("udsreplay: [%v] engine -> worker type=0x%02x (%d bytes), skipped", rec.At, rec.Frame.Type, len(rec.Frame.Payload))
+			continue
+		}
+		if rec.Frame.Type == protocol.PacketTypeHello {
+			// 录制中 worker 重连过：沿用同一条连接继续回放
+			if hellos++; hellos > 1 {
+				log.Printf("udsreplay: [%v] worker reconnected in recording", rec.At)
+			}
+			continue
+		}
+
+		if first < 0 {
+			first, started = rec.At, time.Now()
+		}
+		if speed > 0 {
+			due := started.Add(time.Duration(float64(rec.At-first) / speed))
+			if wait := time.Until(due); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return sent, ctx.Err()
+				}
+			}
+		}
+
+		if err := client.SendFrame(&rec.Frame); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+}
@@ -27,18 +27,15 @@ CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o server cmd/server/main.go
 echo "📦 Building 'doubao_worker'..."
 CGO_ENABLED=0 GOOS=linux GOARCH=amd64 go build -o doubao_worker cmd/doubao_worker/*.go
 
-# 3. Stop Old Processes (修复：只杀二进制，不杀 tail)
-echo "🔪 Stopping running processes..."
+# 3. Stop Old Worker (server 不停：下面用 SIGHUP 平滑升级，监听 socket 不关，观众不断流)
+echo "🔪 Stopping running worker..."
 
 # 重点修改在这里：
 # 1. 使用 "^" 符号，表示匹配命令行开头。
 # 2. tail 命令是以 "tail" 开头的，所以不会被选中。
 # 3. 我们的程序是以 "/home/..." 开头的，所以会被精准命中。
-# pkill -f "^/home/lan/LightX2V/go/server"; pkill -f "^/home/lan/LightX2V/go/doubao_worker"
-ssh -p $SSH_PORT $REMOTE_HOST "pkill -f \"^$REMOTE_DIR/server\"; pkill -f \"^$REMOTE_DIR/doubao_worker\"" || true
-
-echo "⏳ Waiting 3s for ports to release..."
-sleep 3
+# pkill -f "^/home/lan/LightX2V/go/doubao_worker"
+ssh -p $SSH_PORT $REMOTE_HOST "pkill -f \"^$REMOTE_DIR/doubao_worker\"" || true
 
 echo "📦 Moving old binaries to .old..."
 ssh -p $SSH_PORT $REMOTE_HOST "mv $REMOTE_DIR/server $REMOTE_DIR/server.old 2>/dev/null; mv $REMOTE_DIR/doubao_worker $REMOTE_DIR/doubao_worker.old 2>/dev/null" || true
@@ -62,10 +59,16 @@ echo "🔄 Restarting processes..."
 
 REMOTE_ENV_STR="export DOUBAO_APPID='$DOUBAO_APPID' && export DOUBAO_TOKEN='$DOUBAO_TOKEN'"
 
-# --- 启动 Server ---
-echo "1️⃣  Starting Server..."
-# 使用绝对路径启动，配合上面的 pkill ^...
-ssh -p $SSH_PORT -n -f $REMOTE_HOST "cd $REMOTE_DIR && nohup $REMOTE_DIR/server > server.log 2>&1 < /dev/null &"
+# --- 启动 / 升级 Server ---
+# 已在运行：SIGHUP 让它 exec 新的 $REMOTE_DIR/server 并移交监听 socket，新进程就绪后旧进程自行退出
+# 没在运行：直接启动
+if ssh -p $SSH_PORT $REMOTE_HOST "pkill -HUP -f \"^$REMOTE_DIR/server\""; then
+  echo "1️⃣  Upgrading Server in place (SIGHUP)..."
+else
+  echo "1️⃣  Starting Server..."
+  # 使用绝对路径启动，配合上面的 pkill ^...
+  ssh -p $SSH_PORT -n -f $REMOTE_HOST "cd $REMOTE_DIR && nohup $REMOTE_DIR/server > server.log 2>&1 < /dev/null &"
+fi
 
 echo "⏳ Waiting 5s for Server to initialize..."
 sleep 5
@@ -4,21 +4,140 @@ import (
 	"infinite-live/internal/domain"
 	"infinite-live/internal/infrastructure"
 	"infinite-live/internal/pkg/protocol"
+	"log"
+	"sync"
 )
 
 // ChannelSource adapts a packet channel (from Broadcaster) to FrameSource
 type ChannelSource struct {
 	ch                 <-chan *infrastructure.Packet
+	sub                *infrastructure.Subscription // nil for a plain channel
 	waitingForKeyframe bool
+
+	// Sequence tracking for timed packets, keyed by (worker, stream, type)
+	mu      sync.Mutex
+	lastSeq map[seqKey]uint32
+	stats   SequenceStats
+
+	// Control packets are surfaced here instead of as frames
+	events chan domain.StreamEvent
+}
+
+type seqKey struct {
+	origin   string // stream IDs are only unique per worker
+	streamID uint32
+	pktType  byte
+}
+
+// SequenceStats counts anomalies detected from the extended header.
+type SequenceStats struct {
+	Gaps      uint64 // packets missing between two received ones
+	Reordered uint64 // late or duplicate packets that were dropped
 }
 
 func NewChannelSource(ch <-chan *infrastructure.Packet) *ChannelSource {
 	return &ChannelSource{
 		ch:                 ch,
 		waitingForKeyframe: true,
+		lastSeq:            make(map[seqKey]uint32),
+		events:             make(chan domain.StreamEvent, 64),
+	}
+}
+
+// NewSubscriptionSource reads a broadcaster subscription; Close ends it.
+func NewSubscriptionSource(sub *infrastructure.Subscription) *ChannelSource {
+	s := NewChannelSource(sub.C)
+	s.sub = sub
+	return s
+}
+
+// Events implements domain.EventSource
+func (s *ChannelSource) Events() <-chan domain.StreamEvent {
+	return s.events
+}
+
+// handleControl converts a control packet to a StreamEvent
+func (s *ChannelSource) handleControl(pkt *infrastructure.Packet) {
+	var ev domain.StreamEvent
+	switch pkt.Type {
+	case protocol.PacketTypeUtteranceStart, protocol.PacketTypeUtteranceEnd, protocol.PacketTypeCancel:
+		body, err := protocol.DecodeUtterance(pkt.Payload)
+		if err != nil {
+			log.Printf("ChannelSource: bad control body (type 0x%02x): %v", pkt.Type, err)
+			return
+		}
+		ev = domain.StreamEvent{
+			UtteranceID: body.UtteranceID,
+			StreamID:    body.StreamID,
+			CommentID:   body.CommentID,
+			Reason:      body.Reason,
+		}
+		switch pkt.Type {
+		case protocol.PacketTypeUtteranceStart:
+			ev.Kind = domain.EventUtteranceStart
+		case protocol.PacketTypeUtteranceEnd:
+			ev.Kind = domain.EventUtteranceEnd
+		default:
+			ev.Kind = domain.EventUtteranceCancel
+		}
+	case protocol.PacketTypeError:
+		remote := protocol.DecodeError(pkt.Payload)
+		ev = domain.StreamEvent{Kind: domain.EventWorkerError, Reason: remote.Code, Err: remote}
+	case protocol.PacketTypeKeepalive:
+		ev = domain.StreamEvent{Kind: domain.EventKeepalive}
+	default:
+		return
+	}
+	ev.Origin = pkt.Origin
+
+	select {
+	case s.events <- ev:
+	default:
+		log.Printf("ChannelSource: event queue full, dropped %s", ev.Kind)
 	}
 }
 
+// Stats returns the gap/reorder counters seen so far.
+func (s *ChannelSource) Stats() SequenceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// resetSequence forgets a stream, so a reused stream ID (e.g. after the worker
+// restarted) starts counting again instead of looking like late packets.
+func (s *ChannelSource) resetSequence(origin string, streamID uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.lastSeq {
+		if key.origin == origin && key.streamID == streamID {
+			delete(s.lastSeq, key)
+		}
+	}
+}
+
+// checkSequence returns false if the packet is late or duplicated and must be dropped.
+func (s *ChannelSource) checkSequence(pkt *infrastructure.Packet) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := seqKey{origin: pkt.Origin, streamID: pkt.StreamID, pktType: pkt.Type}
+	last, seen := s.lastSeq[key]
+	if seen {
+		if int32(pkt.Seq-last) <= 0 {
+			s.stats.Reordered++
+			log.Printf("ChannelSource: %s stream %d type 0x%02x late packet seq=%d (last=%d), dropped", pkt.Origin, pkt.StreamID, pkt.Type, pkt.Seq, last)
+			return false
+		}
+		if missing := pkt.Seq - last - 1; missing > 0 {
+			s.stats.Gaps += uint64(missing)
+			log.Printf("ChannelSource: %s stream %d type 0x%02x gap of %d packets before seq=%d", pkt.Origin, pkt.StreamID, pkt.Type, missing, pkt.Seq)
+		}
+	}
+	s.lastSeq[key] = pkt.Seq
+	return true
+}
+
 func (s *ChannelSource) Type() domain.AvatarState {
 	return domain.StateTalking
 }
@@ -52,6 +171,17 @@ func (s *ChannelSource) NextFrame() (*domain.MediaFrame, error) {
 }
 
 func (s *ChannelSource) processPacket(pkt *infrastructure.Packet) (*domain.MediaFrame, bool, error) {
+	if protocol.IsControl(pkt.Type) {
+		if pkt.Type == protocol.PacketTypeStreamOpen || pkt.Type == protocol.PacketTypeStreamClose {
+			s.resetSequence(pkt.Origin, pkt.StreamID)
+		}
+		s.handleControl(pkt)
+		return nil, false, nil
+	}
+	if pkt.HasTiming && !s.checkSequence(pkt) {
+		return nil, false, nil
+	}
+
 	// 1. 设置正确的 Duration (纳秒级)
 	// 音频 20ms, 视频 40ms (25fps)
 	duration := 40
@@ -59,28 +189,25 @@ func (s *ChannelSource) processPacket(pkt *infrastructure.Packet) (*domain.Media
 		duration = 20
 	}
 
-	// 2. 关键帧判断 (VP8 逻辑)
-	isKey := false
-
-	if pkt.Type == protocol.PacketTypeAudio {
-		// 音频帧总是可以独立解码，视为关键帧
-		isKey = true
-	} else if pkt.Type == protocol.PacketTypeVideo && len(pkt.Payload) > 0 {
-		// VP8 协议定义: 第一个字节的最低位(LSB)是 Keyframe flag
-		// 0 = Key Frame
-		// 1 = Inter Frame
-		// 这一点与 H.264 完全不同，不要用查找 00 00 00 01 的方法
-		isKey = (pkt.Payload[0] & 0x01) == 0
-	}
+	// 2. 关键帧判断 (音频总是可独立解码；VP8 看第一个字节的最低位，见 protocol.IsKeyFrame)
+	isKey := protocol.IsKeyFrame(pkt.Type, pkt.Payload)
 
 	return &domain.MediaFrame{
 		Data:     pkt.Payload,
 		Duration: duration, // 修正单位
 		IsKey:    isKey,    // 修正判断逻辑
 		Type:     pkt.Type,
+		HasPTS:   pkt.HasTiming,
+		PTS:      pkt.PTS,
+		Seq:      pkt.Seq,
+		StreamID: pkt.StreamID,
+		Origin:   pkt.Origin,
 	}, true, nil
 }
 
 func (s *ChannelSource) Close() error {
+	if s.sub != nil {
+		s.sub.Close()
+	}
 	return nil
 }
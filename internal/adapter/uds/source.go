@@ -9,6 +9,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 // UDSReceiverSource adapts a UDS connection to a FrameSource
@@ -35,7 +36,15 @@ func (u *UDSReceiverSource) Start() {
 				log.Printf("UDS Accept Error: %v", err)
 				return
 			}
-			log.Println("UDS Source: Accepted new worker connection")
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			hello, err := protocol.ServerHandshake(conn, receiverPolicy(), "")
+			conn.SetDeadline(time.Time{})
+			if err != nil {
+				log.Printf("UDS Source: Rejected worker: %v", err)
+				conn.Close()
+				continue
+			}
+			log.Printf("UDS Source: Accepted worker %s (role=%s)", hello.WorkerID, hello.Role)
 
 			u.mu.Lock()
 			if u.conn != nil {
@@ -53,6 +62,13 @@ func (u *UDSReceiverSource) Start() {
 	}()
 }
 
+// receiverPolicy 只读、按普通分帧读取，所以不协商任何可选特性 (sync-crc 等)
+func receiverPolicy() protocol.HandshakePolicy {
+	p := protocol.DefaultHandshakePolicy()
+	p.Features = nil
+	return p
+}
+
 func (u *UDSReceiverSource) Type() domain.AvatarState {
 	return domain.StateTalking
 }
@@ -88,6 +104,11 @@ func (u *UDSReceiverSource) NextFrame() (*domain.MediaFrame, error) {
 		return nil, err
 	}
 
+	// 控制包 / 空包不是媒体帧，交给调用方重试
+	if !protocol.IsMedia(pktType) || len(payload) == 0 {
+		return nil, nil
+	}
+
 	// 1. 时间单位修正
 	duration := 40
 	if pktType == protocol.PacketTypeAudio {
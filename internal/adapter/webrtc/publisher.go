@@ -54,3 +54,28 @@ func NewVideoTrack() (*webrtc.TrackLocalStaticSample, error) {
 	}
 	return videoTrack, nil
 }
+
+// NewVP8Track matches the engine's output (IVF clips, the LiveKit track).
+func NewVP8Track() (*webrtc.TrackLocalStaticSample, error) {
+	videoTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		"video",
+		"pion-webrtc",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating track: %w", err)
+	}
+	return videoTrack, nil
+}
+
+func NewOpusTrack() (*webrtc.TrackLocalStaticSample, error) {
+	audioTrack, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		"audio",
+		"pion-webrtc",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating track: %w", err)
+	}
+	return audioTrack, nil
+}
@@ -2,6 +2,7 @@ package domain
 
 import (
 	"errors"
+	"time"
 )
 
 // AvatarState represents the current state of the digital human
@@ -35,6 +36,59 @@ type MediaFrame struct {
 	Duration int
 	IsKey    bool
 	Type     byte // 1=Video, 2=Audio. See protocol package.
+
+	// Media time reported by the worker (extended header). Zero values when HasPTS is false.
+	HasPTS   bool
+	PTS      time.Duration
+	Seq      uint32
+	StreamID uint32
+
+	Origin string // ID of the worker that produced the frame ("" for local files)
+}
+
+// StreamEventKind classifies control events coming from a worker
+type StreamEventKind int
+
+const (
+	EventUtteranceStart StreamEventKind = iota
+	EventUtteranceEnd
+	EventUtteranceCancel
+	EventWorkerError
+	EventKeepalive
+)
+
+func (k StreamEventKind) String() string {
+	switch k {
+	case EventUtteranceStart:
+		return "UtteranceStart"
+	case EventUtteranceEnd:
+		return "UtteranceEnd"
+	case EventUtteranceCancel:
+		return "UtteranceCancel"
+	case EventWorkerError:
+		return "WorkerError"
+	case EventKeepalive:
+		return "Keepalive"
+	default:
+		return "Unknown"
+	}
+}
+
+// StreamEvent is a control signal that travels alongside the media frames
+type StreamEvent struct {
+	Kind        StreamEventKind
+	UtteranceID string
+	StreamID    uint32
+	CommentID   string // Comment the utterance answers, if the worker reported it
+	Reason      string
+	Err         error  // Set for EventWorkerError
+	Origin      string // ID of the worker that sent the control packet
+}
+
+// EventSource is implemented by frame sources that also deliver control events.
+// Events are ordered with respect to the frames returned by the same source.
+type EventSource interface {
+	Events() <-chan StreamEvent
 }
 
 // FrameSource is an interface for getting video/audio frames
@@ -63,6 +117,11 @@ type StreamPublisher interface {
 	Publish(frame *MediaFrame) error
 }
 
+// UtteranceCanceller aborts an utterance at the worker producing it
+type UtteranceCanceller interface {
+	CancelUtterance(origin string, streamID uint32, reason string) error
+}
+
 // AIGenerator is an interface for the AI generation service
 type AIGenerator interface {
 	Generate(text string) (streamID string, err error)
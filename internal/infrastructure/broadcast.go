@@ -1,112 +1,383 @@
 package infrastructure
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"infinite-live/internal/pkg/protocol"
+	"infinite-live/internal/pkg/transport"
 	"io"
 	"log"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
 )
 
-// UDSBroadcaster accepts a connection from Mock AI and broadcasts packets to all listeners.
+// handshakeTimeout bounds how long a freshly accepted worker may take to send Hello.
+const handshakeTimeout = 5 * time.Second
+
+// UDSBroadcaster accepts any number of concurrent workers (see workers.go for
+// the registry and routing) and broadcasts their packets to all listeners.
 type UDSBroadcaster struct {
-	server    *UDSServer
-	listeners map[chan *Packet]struct{}
-	activeConn net.Conn
-	mu        sync.RWMutex
-	stopCh    chan struct{}
+	server       *UDSServer
+	listeners    map[*subscriber]struct{}
+	workers      map[string]*workerConn
+	defaultRoute Route
+	rrNext       int
+	policy       protocol.HandshakePolicy
+	maxPayload   int
+	heartbeat    HeartbeatConfig
+	jobs         *jobStore
+	queue        *commentQueue
+	gop          *gopCache
+	recorder     *protocol.RecordWriter // optional session recording
+	recConns     uint32                 // connections numbered in the recording (atomic)
+	mu           sync.RWMutex
+	stopCh       chan struct{}
 }
 
 type Packet struct {
 	Type    byte
 	Payload []byte
+
+	// Worker that sent the packet; stream IDs are only unique per origin
+	Origin string
+	// Connection (WorkerInfo.Session) of Origin; a reconnect reuses the ID
+	session string
+
+	// Logical stream the packet was demultiplexed to (see protocol.StreamTable)
+	Target string
+
+	// Timing from the extended header; only valid when HasTiming is set.
+	HasTiming bool
+	StreamID  uint32
+	Seq       uint32
+	PTS       time.Duration
 }
 
 func NewUDSBroadcaster(server *UDSServer) *UDSBroadcaster {
-	return &UDSBroadcaster{
-		server:    server,
-		listeners: make(map[chan *Packet]struct{}),
-		stopCh:    make(chan struct{}),
+	b := &UDSBroadcaster{
+		server:     server,
+		listeners:  make(map[*subscriber]struct{}),
+		workers:    make(map[string]*workerConn),
+		policy:     protocol.DefaultHandshakePolicy(),
+		maxPayload: protocol.DefaultMaxPayload,
+		heartbeat:  DefaultHeartbeatConfig(),
+		jobs:       newJobStore(),
+		gop:        newGOPCache(),
+		stopCh:     make(chan struct{}),
 	}
+	b.queue = newCommentQueue(b)
+	b.jobs.done = b.queue.done
+	return b
+}
+
+// SetMaxPayload changes the largest packet accepted from workers. Call it before Start.
+func (b *UDSBroadcaster) SetMaxPayload(n int) {
+	b.mu.Lock()
+	b.maxPayload = n
+	b.mu.Unlock()
+}
+
+// SetHandshakePolicy replaces the compatibility rules applied to new workers.
+// Call it before Start.
+func (b *UDSBroadcaster) SetHandshakePolicy(p protocol.HandshakePolicy) {
+	b.mu.Lock()
+	b.policy = p
+	b.mu.Unlock()
+}
+
+// SetRecorder records every packet exchanged with workers (see cmd/udsreplay).
+// Pass nil to stop recording; closing the recorder is up to the caller.
+func (b *UDSBroadcaster) SetRecorder(rec *protocol.RecordWriter) {
+	b.mu.Lock()
+	b.recorder = rec
+	b.mu.Unlock()
 }
 
+// record appends a packet to the session recording, if any.
+// A failing recorder is dropped so it can't take the live path down with it.
+func (b *UDSBroadcaster) record(dir byte, conn uint32, f *protocol.Frame) {
+	b.mu.RLock()
+	rec := b.recorder
+	b.mu.RUnlock()
+	if rec == nil {
+		return
+	}
+	if err := rec.Record(dir, conn, f); err != nil {
+		log.Printf("Broadcaster: recording failed, disabled: %v", err)
+		b.mu.Lock()
+		if b.recorder == rec {
+			b.recorder = nil
+		}
+		b.mu.Unlock()
+	}
+}
+
+// handshake performs the mandatory HELLO exchange on a freshly accepted connection.
+func (b *UDSBroadcaster) handshake(conn net.Conn, session string) (*protocol.Hello, error) {
+	b.mu.RLock()
+	policy := b.policy
+	b.mu.RUnlock()
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	return protocol.ServerHandshake(conn, policy, session)
+}
+
+// Start accepts workers in the background; each one is served concurrently.
 func (b *UDSBroadcaster) Start() {
 	go func() {
 		for {
-			// Accept ONE connection from Mock AI
 			conn, err := b.server.Accept()
 			if err != nil {
 				log.Printf("Broadcaster Accept Error: %v", err)
 				return
 			}
-			log.Println("Broadcaster: Mock AI Connected. Broadcasting...")
-
-			b.mu.Lock()
-			b.activeConn = conn
-			b.mu.Unlock()
-
-			// Broadcast Loop
-			for {
-				pktType, payload, err := protocol.ReadPacket(conn)
-				if err != nil {
-					if err != io.EOF {
-						log.Printf("Broadcaster Read Error: %v", err)
-					}
-					break
-				}
-
-				pkt := &Packet{Type: pktType, Payload: payload}
-
-				// Fan-out
-				b.mu.RLock()
-				for ch := range b.listeners {
-					// Non-blocking send to avoid stalling
-					select {
-					case ch <- pkt:
-					default:
-						// Drop frame if listener slow
-					}
-				}
-				b.mu.RUnlock()
-			}
-			
-			b.mu.Lock()
-			if b.activeConn == conn {
-				b.activeConn = nil
-			}
-			b.mu.Unlock()
-			
-			conn.Close()
-			log.Println("Broadcaster: Mock AI Disconnected.")
+			go b.serveWorker(conn)
 		}
 	}()
 }
 
-func (b *UDSBroadcaster) SendToWorker(pktType byte, payload []byte) error {
+// serveWorker handshakes, registers and serves one worker until it disconnects.
+func (b *UDSBroadcaster) serveWorker(conn net.Conn) {
+	defer conn.Close()
+
+	session := uuid.New().String()
+	peer := transport.DescribePeer(conn)
+	hello, err := b.handshake(conn, session)
+	if err != nil {
+		log.Printf("Broadcaster: Rejected worker from %s: %v", peer, err)
+		return
+	}
+	log.Printf("Broadcaster: Worker %s (role=%s, v%d, codecs=%v, %dx%d@%dfps) Connected from %s.",
+		hello.WorkerID, hello.Role, hello.Version, hello.Codecs, hello.Width, hello.Height, hello.FPS, peer)
+
+	b.mu.RLock()
+	features := b.policy.Negotiate(hello)
+	b.mu.RUnlock()
+
+	w := &workerConn{
+		info: WorkerInfo{
+			ID:          hello.WorkerID,
+			Role:        hello.Role,
+			Version:     hello.Version,
+			Codecs:      hello.Codecs,
+			Features:    features,
+			Width:       hello.Width,
+			Height:      hello.Height,
+			FPS:         hello.FPS,
+			Session:     session,
+			Remote:      peer,
+			ConnectedAt: time.Now(),
+			Healthy:     true,
+			LastSeen:    time.Now(),
+		},
+		conn:       conn,
+		recID:      atomic.AddUint32(&b.recConns, 1),
+		writer:     protocol.NewWriter(conn, protocol.CodecOptions(features)...),
+		utterances: make(map[uint32]*utteranceState),
+		cancelled:  make(map[uint32]bool),
+	}
+	// 录制里每段 worker 会话都以它的 Hello 开头，回放时用它来握手 (token 不落盘)
+	if payload, err := json.Marshal(hello.Redacted()); err == nil {
+		b.record(protocol.DirInbound, w.recID, &protocol.Frame{Type: protocol.PacketTypeHello, Payload: payload})
+	}
+
+	b.register(w)
+	done := make(chan struct{})
+	go b.monitor(w, done)
+	b.serveConn(w)
+	close(done)
+	b.unregister(w)
+	b.gop.dropSession(session)
+	b.jobs.failSession(w.info.ID, session, "worker disconnected", time.Now())
+	log.Printf("Broadcaster: Worker %s Disconnected.", hello.WorkerID)
+}
+
+// serveConn is the broadcast loop of one worker connection.
+func (b *UDSBroadcaster) serveConn(w *workerConn) {
+	workerID := w.info.ID
 	b.mu.RLock()
-	defer b.mu.RUnlock()
-	if b.activeConn == nil {
-		return io.ErrClosedPipe
+	// Payloads are shared by every subscriber, so they are not pooled
+	rd := protocol.NewReader(w.conn, protocol.CodecOptions(w.info.Features,
+		protocol.WithMaxPayload(b.maxPayload),
+		protocol.WithResyncHandler(func(skippedBytes, skippedPackets uint64) {
+			log.Printf("Broadcaster: worker %s resynced, skipped %d bytes / %d packets", workerID, skippedBytes, skippedPackets)
+		}),
+	)...)
+	b.mu.RUnlock()
+
+	streams := protocol.NewStreamTable()
+	var f protocol.Frame
+	for {
+		err := rd.ReadFrame(&f)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("Broadcaster: worker %s read error: %v", workerID, err)
+			}
+			break
+		}
+		b.record(protocol.DirInbound, w.recID, &f)
+
+		pkt := &Packet{
+			Type:      f.Type,
+			Payload:   f.Payload,
+			Origin:    workerID,
+			session:   w.info.Session,
+			HasTiming: f.Extended,
+			StreamID:  f.StreamID,
+			Seq:       f.Seq,
+			PTS:       f.PTS,
+		}
+
+		// 兼容旧 Worker：空的媒体包曾被当作 EOS，现在翻译成 UtteranceEnd，而不是断开连接
+		if protocol.IsMedia(pkt.Type) && len(pkt.Payload) == 0 {
+			pkt.Type = protocol.PacketTypeUtteranceEnd
+			pkt.Payload, _ = json.Marshal(&protocol.UtteranceBody{StreamID: f.StreamID, Reason: "legacy_eos"})
+		}
+
+		if !b.demux(streams, pkt) {
+			continue
+		}
+		now := time.Now()
+		pong, publish := w.observe(pkt, now)
+		if pong != nil {
+			payload, _ := json.Marshal(pong)
+			b.sendTo(w, protocol.PacketTypeKeepalive, payload)
+		}
+		if !b.trackJob(workerID, pkt, now) {
+			publish = false
+		}
+		if publish {
+			b.publish(pkt)
+		}
+	}
+
+	// Worker gone: tell subscribers every stream it still had open is over
+	for _, info := range streams.CloseAll() {
+		payload, _ := json.Marshal(&protocol.StreamInfo{StreamID: info.StreamID, Reason: "worker_disconnected"})
+		b.publish(&Packet{
+			Type:     protocol.PacketTypeStreamClose,
+			Payload:  payload,
+			Origin:   workerID,
+			session:  w.info.Session,
+			Target:   info.Target,
+			StreamID: info.StreamID,
+		})
 	}
-	// Direct write to the worker socket
-	// Note: protocol.WritePacket is thread-safe if we assume only one writer (Server) -> Worker
-	// If Start() loop also writes (unlikely), we might need lock on conn.
-	// For now, Start() only READS. SendToWorker WRITES.
-	// net.Conn is thread-safe for concurrent Read and Write.
-	return protocol.WritePacket(b.activeConn, pktType, payload)
 }
 
-func (b *UDSBroadcaster) Subscribe() chan *Packet {
-	ch := make(chan *Packet, 100)
+// demux assigns the packet to its logical stream. Returns false if it must be dropped.
+func (b *UDSBroadcaster) demux(streams *protocol.StreamTable, pkt *Packet) bool {
+	switch pkt.Type {
+	case protocol.PacketTypeStreamOpen:
+		info, err := protocol.DecodeStreamInfo(pkt.Payload)
+		if err != nil {
+			log.Printf("Broadcaster: bad StreamOpen: %v", err)
+			return false
+		}
+		if err := streams.Open(*info); err != nil {
+			log.Printf("Broadcaster: StreamOpen %d rejected: %v", info.StreamID, err)
+			return false
+		}
+		pkt.StreamID, pkt.Target = info.StreamID, info.Target
+	case protocol.PacketTypeStreamClose:
+		info, err := protocol.DecodeStreamInfo(pkt.Payload)
+		if err != nil {
+			log.Printf("Broadcaster: bad StreamClose: %v", err)
+			return false
+		}
+		closed, err := streams.Close(info.StreamID)
+		if err != nil {
+			log.Printf("Broadcaster: StreamClose %d: %v", info.StreamID, err)
+			return false
+		}
+		pkt.StreamID, pkt.Target = closed.StreamID, closed.Target
+	case protocol.PacketTypeUtteranceStart, protocol.PacketTypeUtteranceEnd, protocol.PacketTypeCancel:
+		// 控制包的 StreamID 在 body 里
+		if body, err := protocol.DecodeUtterance(pkt.Payload); err == nil {
+			pkt.StreamID = body.StreamID
+		}
+		info := streams.Resolve(pkt.StreamID)
+		pkt.Target = info.Target
+		// 隐式打开的流随 utterance 结束而关闭，避免流表无限增长
+		if info.Implicit && pkt.Type != protocol.PacketTypeUtteranceStart {
+			streams.Close(info.StreamID)
+		}
+	default:
+		pkt.Target = streams.Resolve(pkt.StreamID).Target
+	}
+	return true
+}
+
+// publish fans a packet out to every interested listener. What a slow
+// listener loses is up to its BackpressurePolicy (see subscriber.go).
+func (b *UDSBroadcaster) publish(pkt *Packet) {
+	b.gop.mu.Lock()
+	b.gop.add(pkt)
+	b.mu.RLock()
+	subs := make([]*subscriber, 0, len(b.listeners))
+	for s := range b.listeners {
+		if s.wants(pkt) {
+			subs = append(subs, s)
+		}
+	}
+	b.mu.RUnlock()
+	b.gop.mu.Unlock()
+
+	// push 可能阻塞 (Block 策略)，不能持有 b.mu
+	for _, s := range subs {
+		s.push(pkt)
+	}
+}
+
+// Subscribe receives the packets matching filter until ctx is done or the
+// subscription is closed.
+func (b *UDSBroadcaster) Subscribe(ctx context.Context, filter PacketFilter) *Subscription {
+	return b.SubscribeWith(ctx, SubscribeOptions{Filter: filter})
+}
+
+// SubscribeWith subscribes with an explicit queue depth and backpressure policy.
+// Streams already on air are primed from the GOP cache (see gop.go), so the
+// subscriber starts at their latest keyframe instead of mid-GOP.
+func (b *UDSBroadcaster) SubscribeWith(ctx context.Context, opts SubscribeOptions) *Subscription {
+	s := newSubscriber(opts)
+	b.gop.mu.Lock()
+	s.prime(b.gop.snapshot(opts.Filter))
 	b.mu.Lock()
-	b.listeners[ch] = struct{}{}
+	b.listeners[s] = struct{}{}
 	b.mu.Unlock()
-	return ch
+	b.gop.mu.Unlock()
+
+	sub := &Subscription{C: s.out, b: b, s: s, done: make(chan struct{})}
+	sub.stop = context.AfterFunc(ctx, sub.Close)
+	return sub
 }
 
-func (b *UDSBroadcaster) Unsubscribe(ch chan *Packet) {
+func (b *UDSBroadcaster) removeSubscriber(s *subscriber) {
 	b.mu.Lock()
-	delete(b.listeners, ch)
-	close(ch) // Close channel
+	delete(b.listeners, s)
 	b.mu.Unlock()
 }
+
+// SubscriberStats reports queue depth and drop counters of every subscriber.
+func (b *UDSBroadcaster) SubscriberStats() []SubscriberStats {
+	b.mu.RLock()
+	subs := make([]*subscriber, 0, len(b.listeners))
+	for s := range b.listeners {
+		subs = append(subs, s)
+	}
+	b.mu.RUnlock()
+
+	out := make([]SubscriberStats, 0, len(subs))
+	for _, s := range subs {
+		out = append(out, s.stats())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
@@ -0,0 +1,169 @@
+package infrastructure
+
+import (
+	"log"
+	"sort"
+	"sync"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+// GOPCacheConfig bounds the per-stream cache that primes late subscribers.
+type GOPCacheConfig struct {
+	// MaxPackets per stream, video and audio together; 0 disables the cache.
+	MaxPackets int
+	// MaxBytes of payload per stream (default 8 MiB).
+	MaxBytes int
+}
+
+// DefaultGOPCacheConfig holds a few seconds of 25fps video with 20ms audio.
+func DefaultGOPCacheConfig() GOPCacheConfig {
+	return GOPCacheConfig{MaxPackets: 500, MaxBytes: 8 << 20}
+}
+
+// SetGOPCache replaces the cache bounds. Call it before Start.
+func (b *UDSBroadcaster) SetGOPCache(cfg GOPCacheConfig) {
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = DefaultGOPCacheConfig().MaxBytes
+	}
+	b.gop.mu.Lock()
+	b.gop.cfg = cfg
+	if cfg.MaxPackets <= 0 {
+		b.gop.streams = make(map[gopKey]*gopEntry)
+	}
+	b.gop.mu.Unlock()
+}
+
+// gopKey includes the session: while a reconnecting worker replaces its
+// stale connection, both may be publishing under the same ID and stream IDs.
+type gopKey struct {
+	origin   string // stream IDs are only unique per worker
+	session  string
+	streamID uint32
+}
+
+// gopEntry is what a subscriber joining now needs to decode the stream.
+type gopEntry struct {
+	open      *Packet   // StreamOpen, if the stream was opened explicitly
+	utterance *Packet   // UtteranceStart of the utterance on air
+	media     []*Packet // latest video keyframe onward, with the audio since
+	bytes     int
+	overflow  bool // GOP outgrew the bounds; waiting for the next keyframe
+}
+
+// gopCache keeps the current GOP of every stream. Its mutex is held across
+// cache update and fan-out in publish, and across priming and registration
+// in SubscribeWith, so a new subscriber sees each packet exactly once.
+// Lock order: gopCache.mu before b.mu.
+type gopCache struct {
+	mu      sync.Mutex
+	cfg     GOPCacheConfig
+	streams map[gopKey]*gopEntry
+}
+
+func newGOPCache() *gopCache {
+	return &gopCache{cfg: DefaultGOPCacheConfig(), streams: make(map[gopKey]*gopEntry)}
+}
+
+func (c *gopCache) entry(key gopKey) *gopEntry {
+	e := c.streams[key]
+	if e == nil {
+		e = &gopEntry{}
+		c.streams[key] = e
+	}
+	return e
+}
+
+// add updates the cache with a published packet. Called with c.mu held.
+func (c *gopCache) add(pkt *Packet) {
+	if c.cfg.MaxPackets <= 0 {
+		return
+	}
+	key := gopKey{pkt.Origin, pkt.session, pkt.StreamID}
+	switch pkt.Type {
+	case protocol.PacketTypeStreamOpen:
+		c.streams[key] = &gopEntry{open: pkt}
+	case protocol.PacketTypeStreamClose:
+		delete(c.streams, key)
+	case protocol.PacketTypeUtteranceStart:
+		c.entry(key).utterance = pkt
+	case protocol.PacketTypeUtteranceEnd, protocol.PacketTypeCancel:
+		// 说完的内容不再回放给新订阅者；流本身 (StreamOpen) 仍然有效
+		if e := c.streams[key]; e != nil {
+			if e.open == nil {
+				delete(c.streams, key)
+			} else {
+				*e = gopEntry{open: e.open}
+			}
+		}
+	case protocol.PacketTypeVideo:
+		e := c.entry(key)
+		if protocol.IsKeyFrame(pkt.Type, pkt.Payload) {
+			clear(e.media)
+			e.media, e.bytes, e.overflow = e.media[:0], 0, false
+		} else if len(e.media) == 0 {
+			return // 还没见过关键帧
+		}
+		c.append(e, key, pkt)
+	case protocol.PacketTypeAudio:
+		if e := c.streams[key]; e != nil && len(e.media) > 0 {
+			c.append(e, key, pkt)
+		}
+	}
+}
+
+func (c *gopCache) append(e *gopEntry, key gopKey, pkt *Packet) {
+	e.media = append(e.media, pkt)
+	e.bytes += len(pkt.Payload)
+	if len(e.media) > c.cfg.MaxPackets || e.bytes > c.cfg.MaxBytes {
+		if !e.overflow {
+			log.Printf("Broadcaster: GOP of %s stream %d exceeds the cache (%d packets, %d bytes), late subscribers wait for the next keyframe",
+				key.origin, key.streamID, len(e.media), e.bytes)
+		}
+		e.media, e.bytes, e.overflow = nil, 0, true
+	}
+}
+
+// dropSession forgets every stream of a worker connection.
+func (c *gopCache) dropSession(session string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.streams {
+		if key.session == session {
+			delete(c.streams, key)
+		}
+	}
+}
+
+// snapshot returns, stream by stream, the cached packets matching filter.
+// Called with c.mu held.
+func (c *gopCache) snapshot(filter PacketFilter) [][]*Packet {
+	keys := make([]gopKey, 0, len(c.streams))
+	for key := range c.streams {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].origin != keys[j].origin {
+			return keys[i].origin < keys[j].origin
+		}
+		if keys[i].streamID != keys[j].streamID {
+			return keys[i].streamID < keys[j].streamID
+		}
+		return keys[i].session < keys[j].session
+	})
+
+	var out [][]*Packet
+	for _, key := range keys {
+		e := c.streams[key]
+		var pkts []*Packet
+		for _, p := range append([]*Packet{e.open, e.utterance}, e.media...) {
+			if p != nil && filter.Match(p) {
+				pkts = append(pkts, p)
+			}
+		}
+		if len(pkts) > 0 {
+			out = append(out, pkts)
+		}
+	}
+	return out
+}
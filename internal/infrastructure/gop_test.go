@@ -0,0 +1,137 @@
+package infrastructure
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+func snapshotSeqs(c *gopCache) [][]uint32 {
+	var out [][]uint32
+	for _, pkts := range c.snapshot(PacketFilter{}) {
+		seqs := make([]uint32, len(pkts))
+		for i, p := range pkts {
+			seqs[i] = p.Seq
+		}
+		out = append(out, seqs)
+	}
+	return out
+}
+
+func fromWorker(origin, session string, pkts ...*Packet) []*Packet {
+	for _, p := range pkts {
+		p.Origin, p.session, p.StreamID = origin, session, 1
+	}
+	return pkts
+}
+
+func TestGOPCache(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  GOPCacheConfig
+		pkts []*Packet
+		want [][]uint32
+	}{
+		{
+			name: "starts at the latest keyframe",
+			pkts: []*Packet{audioFrame(1), interFrame(2), keyFrame(3), audioFrame(4), interFrame(5), keyFrame(6), interFrame(7), audioFrame(8)},
+			want: [][]uint32{{6, 7, 8}},
+		},
+		{
+			name: "overflow resets the entry until the next keyframe",
+			cfg:  GOPCacheConfig{MaxPackets: 3, MaxBytes: 1 << 20},
+			pkts: []*Packet{keyFrame(1), audioFrame(2), interFrame(3), audioFrame(4), interFrame(5), audioFrame(6)},
+			want: nil,
+		},
+		{
+			name: "keyframe after overflow",
+			cfg:  GOPCacheConfig{MaxPackets: 3, MaxBytes: 1 << 20},
+			pkts: []*Packet{keyFrame(1), audioFrame(2), interFrame(3), audioFrame(4), interFrame(5), keyFrame(6), audioFrame(7)},
+			want: [][]uint32{{6, 7}},
+		},
+		{
+			name: "overflow by bytes",
+			cfg:  GOPCacheConfig{MaxPackets: 100, MaxBytes: 5},
+			pkts: []*Packet{keyFrame(1), interFrame(2), interFrame(3)},
+			want: nil,
+		},
+		{
+			name: "utterance end clears the media",
+			pkts: []*Packet{{Type: protocol.PacketTypeUtteranceStart, Seq: 1}, keyFrame(2), controlPacket(3), interFrame(4)},
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newGOPCache()
+			if tt.cfg.MaxPackets > 0 {
+				c.cfg = tt.cfg
+			}
+			for _, p := range fromWorker("w1", "s1", tt.pkts...) {
+				c.add(p)
+			}
+			if got := snapshotSeqs(c); !slices.EqualFunc(got, tt.want, slices.Equal) {
+				t.Fatalf("snapshot = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGOPCacheOverflowFlag(t *testing.T) {
+	c := newGOPCache()
+	c.cfg = GOPCacheConfig{MaxPackets: 2, MaxBytes: 1 << 20}
+	for _, p := range fromWorker("w1", "s1", keyFrame(1), interFrame(2), interFrame(3)) {
+		c.add(p)
+	}
+	e := c.streams[gopKey{"w1", "s1", 1}]
+	if e == nil || !e.overflow || e.media != nil || e.bytes != 0 {
+		t.Fatalf("entry after overflow = %+v", e)
+	}
+}
+
+// A worker reconnecting under the same ID must not lose the new
+// connection's GOP when the stale connection is torn down.
+func TestGOPCacheReconnect(t *testing.T) {
+	c := newGOPCache()
+	for _, p := range fromWorker("w1", "old", keyFrame(1), interFrame(2)) {
+		c.add(p)
+	}
+	for _, p := range fromWorker("w1", "new", keyFrame(10), audioFrame(11)) {
+		c.add(p)
+	}
+	// 旧连接断开时补发的 StreamClose 只关自己的流
+	c.add(fromWorker("w1", "old", &Packet{Type: protocol.PacketTypeStreamClose})[0])
+	c.dropSession("old")
+	if got, want := snapshotSeqs(c), [][]uint32{{10, 11}}; !slices.EqualFunc(got, want, slices.Equal) {
+		t.Fatalf("snapshot = %v, want %v", got, want)
+	}
+}
+
+func TestSubscribePrimedFromGOP(t *testing.T) {
+	b := NewUDSBroadcaster(nil)
+	for _, p := range fromWorker("w1", "s1", interFrame(1), keyFrame(2), audioFrame(3), interFrame(4)) {
+		b.publish(p)
+	}
+	sub := b.SubscribeWith(context.Background(), SubscribeOptions{Name: "late"})
+	defer sub.Close()
+	b.publish(fromWorker("w1", "s1", audioFrame(5))[0])
+
+	var got []uint32
+	for len(got) < 4 {
+		select {
+		case p := <-sub.C:
+			got = append(got, p.Seq)
+		case <-time.After(time.Second):
+			t.Fatalf("got %v, timed out", got)
+		}
+	}
+	if want := []uint32{2, 3, 4, 5}; !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if st := sub.Stats(); st.Primed != 3 {
+		t.Fatalf("primed = %d, want 3", st.Primed)
+	}
+}
@@ -0,0 +1,237 @@
+package infrastructure
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+// HeartbeatConfig tunes worker liveness checks.
+type HeartbeatConfig struct {
+	// PingInterval is how often workers that negotiated FeatureHeartbeat are pinged.
+	PingInterval time.Duration
+	// PongTimeout marks such a worker unhealthy after this long without any packet.
+	PongTimeout time.Duration
+	// StallTimeout cancels an utterance that started but sent no media for this long.
+	// Applies to every worker, heartbeat or not.
+	StallTimeout time.Duration
+}
+
+// DefaultHeartbeatConfig returns the settings used unless SetHeartbeat is called.
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		PingInterval: 2 * time.Second,
+		PongTimeout:  6 * time.Second,
+		StallTimeout: 3 * time.Second,
+	}
+}
+
+// healthCheckEvery is the resolution of the stall detector.
+const healthCheckEvery = 100 * time.Millisecond
+
+// utteranceState follows one open utterance for the stall detector.
+type utteranceState struct {
+	id           string
+	commentID    string
+	target       string
+	lastActivity time.Time // start, then last media packet
+}
+
+// SetHeartbeat replaces the liveness settings. Call it before Start.
+func (b *UDSBroadcaster) SetHeartbeat(cfg HeartbeatConfig) {
+	def := DefaultHeartbeatConfig()
+	if cfg.PingInterval <= 0 {
+		cfg.PingInterval = def.PingInterval
+	}
+	if cfg.PongTimeout <= 0 {
+		cfg.PongTimeout = 3 * cfg.PingInterval
+	}
+	if cfg.StallTimeout <= 0 {
+		cfg.StallTimeout = def.StallTimeout
+	}
+	b.mu.Lock()
+	b.heartbeat = cfg
+	b.mu.Unlock()
+}
+
+// setHealth changes the health state and logs transitions. Called with w.mu held.
+func (w *workerConn) setHealth(healthy bool, reason string) {
+	if w.info.Healthy == healthy && w.info.HealthReason == reason {
+		return
+	}
+	w.info.Healthy, w.info.HealthReason = healthy, reason
+	if healthy {
+		log.Printf("Broadcaster: worker %s healthy again", w.info.ID)
+	} else {
+		log.Printf("Broadcaster: worker %s unhealthy: %s", w.info.ID, reason)
+	}
+}
+
+// observe updates health and load from an inbound packet. It returns a pong
+// to send back when the worker pinged us, and whether pkt should be published.
+func (w *workerConn) observe(pkt *Packet, now time.Time) (pong *protocol.KeepaliveBody, publish bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.info.LastSeen = now
+	if !w.info.Healthy && !w.stalled {
+		w.setHealth(true, "")
+	}
+
+	switch pkt.Type {
+	case protocol.PacketTypeVideo, protocol.PacketTypeAudio:
+		if w.stalled {
+			w.stalled = false
+			w.setHealth(true, "")
+		}
+		if w.cancelled[pkt.StreamID] {
+			return nil, false // 已取消的 utterance 迟到的媒体，订阅者已经 flush 过了
+		}
+		if u := w.utterances[pkt.StreamID]; u != nil {
+			u.lastActivity = now
+		}
+	case protocol.PacketTypeStreamClose:
+		delete(w.cancelled, pkt.StreamID)
+	case protocol.PacketTypeUtteranceStart:
+		delete(w.cancelled, pkt.StreamID)
+		body, _ := protocol.DecodeUtterance(pkt.Payload)
+		u := &utteranceState{target: pkt.Target, lastActivity: now}
+		if body != nil {
+			u.id, u.commentID = body.UtteranceID, body.CommentID
+		}
+		w.utterances[pkt.StreamID] = u
+		// 回复开始即视为评论已被受理 (旧 Worker 不回传 comment_id，按 FIFO 计)
+		if w.info.PendingComments > 0 {
+			w.info.PendingComments--
+		}
+	case protocol.PacketTypeUtteranceEnd, protocol.PacketTypeCancel:
+		delete(w.utterances, pkt.StreamID)
+	case protocol.PacketTypeKeepalive:
+		body, err := protocol.DecodeKeepalive(pkt.Payload)
+		if err != nil {
+			return nil, true
+		}
+		if body.Pong {
+			w.info.RTTMillis = body.RTT(now).Milliseconds()
+			return nil, false // 心跳应答只在这里消费，不打扰订阅者
+		}
+		return body.Reply(), true
+	}
+	return nil, true
+}
+
+// stalledUtterance is an utterance the monitor gave up on.
+type stalledUtterance struct {
+	streamID uint32
+	state    *utteranceState
+	idle     time.Duration
+}
+
+// monitor pings the worker and watches for stalls until done is closed.
+func (b *UDSBroadcaster) monitor(w *workerConn, done <-chan struct{}) {
+	b.mu.RLock()
+	cfg := b.heartbeat
+	b.mu.RUnlock()
+	heartbeat := w.info.Has(protocol.FeatureHeartbeat)
+
+	ticker := time.NewTicker(healthCheckEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			var ping *protocol.KeepaliveBody
+			var stalled []stalledUtterance
+
+			w.mu.Lock()
+			if heartbeat {
+				if now.Sub(w.lastPing) >= cfg.PingInterval {
+					w.pingSeq++
+					w.lastPing = now
+					ping = &protocol.KeepaliveBody{Seq: w.pingSeq, SentAt: now.UnixMilli()}
+				}
+				if silent := now.Sub(w.info.LastSeen); silent > cfg.PongTimeout && w.info.Healthy {
+					w.setHealth(false, fmt.Sprintf("no heartbeat for %v", silent.Round(time.Millisecond)))
+				}
+			}
+			for streamID, u := range w.utterances {
+				if idle := now.Sub(u.lastActivity); idle > cfg.StallTimeout {
+					stalled = append(stalled, stalledUtterance{streamID: streamID, state: u, idle: idle})
+					delete(w.utterances, streamID)
+					w.cancelled[streamID] = true
+				}
+			}
+			if len(stalled) > 0 {
+				w.info.Stalls += uint64(len(stalled))
+				w.stalled = true
+				w.setHealth(false, fmt.Sprintf("utterance %q stalled", stalled[0].state.id))
+			}
+			w.mu.Unlock()
+
+			if ping != nil {
+				payload, _ := json.Marshal(ping)
+				if err := b.sendTo(w, protocol.PacketTypeKeepalive, payload); err != nil {
+					log.Printf("Broadcaster: ping to worker %s failed: %v", w.info.ID, err)
+				}
+			}
+			for _, s := range stalled {
+				b.cancelStalled(w, s)
+			}
+		}
+	}
+}
+
+// cancelStalled tells the worker to stop and subscribers to drop what they buffered.
+func (b *UDSBroadcaster) cancelStalled(w *workerConn, s stalledUtterance) {
+	log.Printf("Broadcaster: worker %s utterance %q (stream %d) sent no media for %v, cancelling",
+		w.info.ID, s.state.id, s.streamID, s.idle.Round(time.Millisecond))
+	b.cancelUtterance(w, s.streamID, s.state, "stalled")
+}
+
+// CancelUtterance aborts the utterance a worker is playing on streamID (e.g.
+// the viewer barged in). Like a stall, the worker is told to stop, its late
+// media is dropped and subscribers get a Cancel.
+func (b *UDSBroadcaster) CancelUtterance(workerID string, streamID uint32, reason string) error {
+	b.mu.RLock()
+	w := b.workers[workerID]
+	b.mu.RUnlock()
+	if w == nil {
+		return fmt.Errorf("%w: %s", ErrWorkerNotFound, workerID)
+	}
+	w.mu.Lock()
+	u := w.utterances[streamID]
+	if u != nil {
+		delete(w.utterances, streamID)
+		w.cancelled[streamID] = true
+	}
+	w.mu.Unlock()
+	if u == nil {
+		return fmt.Errorf("%w: stream %d of worker %s", ErrNoUtterance, streamID, workerID)
+	}
+	log.Printf("Broadcaster: cancelling worker %s utterance %q (stream %d): %s", workerID, u.id, streamID, reason)
+	b.cancelUtterance(w, streamID, u, reason)
+	return nil
+}
+
+// cancelUtterance sends the Cancel to the worker and publishes it. The caller
+// has already marked the stream cancelled.
+func (b *UDSBroadcaster) cancelUtterance(w *workerConn, streamID uint32, u *utteranceState, reason string) {
+	payload, _ := json.Marshal(&protocol.UtteranceBody{UtteranceID: u.id, StreamID: streamID, Reason: reason, CommentID: u.commentID})
+	if err := b.sendTo(w, protocol.PacketTypeCancel, payload); err != nil {
+		log.Printf("Broadcaster: cancel to worker %s failed: %v", w.info.ID, err)
+	}
+	pkt := &Packet{
+		Type:     protocol.PacketTypeCancel,
+		Payload:  payload,
+		Origin:   w.info.ID,
+		session:  w.info.Session,
+		Target:   u.target,
+		StreamID: streamID,
+	}
+	b.trackJob(w.info.ID, pkt, time.Now())
+	b.publish(pkt)
+}
@@ -0,0 +1,260 @@
+package infrastructure
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+// ErrDuplicateComment is returned when a comment reuses the ID of a tracked job.
+var ErrDuplicateComment = errors.New("duplicate comment id")
+
+// maxJobs bounds the job history kept for GET /jobs/{id}.
+const maxJobs = 1000
+
+// JobEvent is one transition of a Job.
+type JobEvent struct {
+	State  protocol.JobState `json:"state"`
+	Detail string            `json:"detail,omitempty"`
+	At     time.Time         `json:"at"`
+}
+
+// Job follows one comment from submission to the end of its reply.
+// The job ID is the comment ID. A comment coalesced into another one gets an
+// alias job that reports the state of the job it was merged into.
+type Job struct {
+	ID          string            `json:"id"`
+	Text        string            `json:"text"`
+	WorkerID    string            `json:"worker_id"`
+	State       protocol.JobState `json:"state"`
+	Detail      string            `json:"detail,omitempty"`
+	UtteranceID string            `json:"utterance_id,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+	History     []JobEvent        `json:"history"`
+
+	// CoalescedInto is set on alias jobs: the comment shares the reply to this job.
+	CoalescedInto string `json:"coalesced_into,omitempty"`
+
+	session string // worker connection the job was sent on
+}
+
+// jobStore keeps the most recent jobs.
+type jobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*Job
+	order []string // insertion order, for eviction
+
+	done func(id string) // called (without mu) when a job reaches a terminal state
+}
+
+func newJobStore() *jobStore {
+	return &jobStore{jobs: make(map[string]*Job)}
+}
+
+// add tracks a new job. It reports false, and changes nothing, if a job with
+// the same ID is already tracked.
+func (s *jobStore) add(j *Job) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[j.ID]; ok {
+		return false
+	}
+	s.order = append(s.order, j.ID)
+	s.jobs[j.ID] = j
+	for len(s.order) > maxJobs {
+		delete(s.jobs, s.order[0])
+		s.order[0] = ""
+		s.order = s.order[1:]
+	}
+	// 只从头部切片的话底层数组会一直被引用，定期搬到新数组上
+	if cap(s.order) > 2*maxJobs {
+		s.order = append(make([]string, 0, maxJobs+1), s.order...)
+	}
+	return true
+}
+
+func (s *jobStore) get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	c := *j
+	if target, ok := s.jobs[j.CoalescedInto]; ok {
+		// 别名 job 跟着被合并进去的那条走；那条被淘汰后停在合并时的状态
+		c = *target
+		c.ID, c.Text, c.CreatedAt, c.CoalescedInto = j.ID, j.Text, j.CreatedAt, j.CoalescedInto
+		j = target
+	}
+	c.History = append([]JobEvent(nil), j.History...)
+	return c, true
+}
+
+// transition moves a job forward. Reports from a worker other than the one
+// the job was sent to, and anything after a terminal state, are ignored.
+func (s *jobStore) transition(workerID string, body *protocol.JobStatusBody, now time.Time) {
+	s.mu.Lock()
+	terminal := s.transitionLocked(workerID, body, now)
+	s.mu.Unlock()
+	if terminal && s.done != nil {
+		s.done(body.CommentID)
+	}
+}
+
+// transitionLocked applies a transition and reports whether it ended the job.
+func (s *jobStore) transitionLocked(workerID string, body *protocol.JobStatusBody, now time.Time) bool {
+	j, ok := s.jobs[body.CommentID]
+	if !ok || j.State.Terminal() {
+		return false
+	}
+	if workerID != "" && j.WorkerID != workerID {
+		log.Printf("Jobs: worker %s reported %s for job %s owned by %s, ignored", workerID, body.State, j.ID, j.WorkerID)
+		return false
+	}
+	if body.UtteranceID != "" {
+		j.UtteranceID = body.UtteranceID
+	}
+	if j.State == body.State && body.Detail == "" {
+		return false
+	}
+	j.State, j.Detail, j.UpdatedAt = body.State, body.Detail, now
+	j.History = append(j.History, JobEvent{State: body.State, Detail: body.Detail, At: now})
+	if body.State.Terminal() {
+		log.Printf("Jobs: %s %s after %v %s", j.ID, j.State, now.Sub(j.CreatedAt).Round(time.Millisecond), j.Detail)
+	}
+	return body.State.Terminal()
+}
+
+// assign hands a queued job to the worker it is about to be sent to.
+func (s *jobStore) assign(id, workerID, session string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.State.Terminal() {
+		return
+	}
+	j.WorkerID, j.session = workerID, session
+	j.State, j.Detail, j.UpdatedAt = protocol.JobPending, "", now
+	j.History = append(j.History, JobEvent{State: protocol.JobPending, At: now})
+}
+
+// failSession fails every open job sent on a worker connection.
+func (s *jobStore) failSession(workerID, session, reason string, now time.Time) {
+	s.mu.Lock()
+	var open []string
+	for id, j := range s.jobs {
+		if j.session == session && !j.State.Terminal() {
+			open = append(open, id)
+		}
+	}
+	s.mu.Unlock()
+	for _, id := range open {
+		s.transition(workerID, &protocol.JobStatusBody{CommentID: id, State: protocol.JobFailed, Detail: reason}, now)
+	}
+}
+
+// SubmitComment routes a comment to a worker right away, bypassing the queue
+// (see EnqueueComment), and starts tracking it as a job. A failed send is
+// recorded on the job and returned.
+func (b *UDSBroadcaster) SubmitComment(r Route, c *protocol.Comment) (Job, error) {
+	b.mu.Lock()
+	w, err := b.pickLocked(r)
+	b.mu.Unlock()
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now()
+	added := b.jobs.add(&Job{
+		ID:        c.ID,
+		Text:      c.Text,
+		WorkerID:  w.info.ID,
+		State:     protocol.JobPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+		History:   []JobEvent{{State: protocol.JobPending, At: now}},
+		session:   w.info.Session,
+	})
+	if !added {
+		return Job{}, fmt.Errorf("%w: %s", ErrDuplicateComment, c.ID)
+	}
+	err = b.deliver(w, c)
+	job, _ := b.jobs.get(c.ID)
+	return job, err
+}
+
+// deliver sends a tracked comment. Workers that negotiated FeatureComments
+// get the structured comment, others plain text.
+func (b *UDSBroadcaster) deliver(w *workerConn, c *protocol.Comment) error {
+	var err error
+	if w.info.Has(protocol.FeatureComments) {
+		payload, _ := json.Marshal(c)
+		err = b.sendTo(w, protocol.PacketTypeComment, payload)
+	} else {
+		err = b.sendTo(w, protocol.PacketTypeText, []byte(c.Text))
+	}
+	if err != nil {
+		err = fmt.Errorf("send to worker %s: %w", w.info.ID, err)
+		b.jobs.transition(w.info.ID, &protocol.JobStatusBody{CommentID: c.ID, State: protocol.JobFailed, Detail: err.Error()}, time.Now())
+	}
+	return err
+}
+
+// Job returns the job of a comment.
+func (b *UDSBroadcaster) Job(id string) (Job, bool) {
+	return b.jobs.get(id)
+}
+
+// trackJob updates jobs from an inbound packet and reports whether the packet
+// should still be published (job reports are consumed here).
+func (b *UDSBroadcaster) trackJob(workerID string, pkt *Packet, now time.Time) bool {
+	var state protocol.JobState
+	switch pkt.Type {
+	case protocol.PacketTypeJobStatus:
+		body, err := protocol.DecodeJobStatus(pkt.Payload)
+		if err != nil {
+			log.Printf("Jobs: bad job status from %s: %v", workerID, err)
+			return false
+		}
+		b.jobs.transition(workerID, body, now)
+		return false
+	case protocol.PacketTypeUtteranceStart:
+		state = protocol.JobPlaying
+	case protocol.PacketTypeUtteranceEnd:
+		state = protocol.JobDone
+	case protocol.PacketTypeCancel:
+		state = protocol.JobFailed
+	default:
+		return true
+	}
+	// 不支持 FeatureJobs 的 Worker 也能从 utterance 推断出 playing/done/failed
+	body, err := protocol.DecodeUtterance(pkt.Payload)
+	if err != nil {
+		return true
+	}
+	if body.CommentID == "" {
+		// 旧 Worker 不回传 comment_id：回复结束就当它在回队列里派出去的那条
+		if state != protocol.JobPlaying {
+			b.queue.replyEnded(workerID)
+		}
+		return true
+	}
+	detail := ""
+	if state == protocol.JobFailed {
+		detail = "cancelled: " + body.Reason
+	}
+	b.jobs.transition(workerID, &protocol.JobStatusBody{
+		CommentID:   body.CommentID,
+		State:       state,
+		Detail:      detail,
+		UtteranceID: body.UtteranceID,
+	}, now)
+	return true
+}
@@ -0,0 +1,33 @@
+package infrastructure
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestJobStoreEviction(t *testing.T) {
+	s := newJobStore()
+	for i := range 5 * maxJobs {
+		s.add(&Job{ID: strconv.Itoa(i)})
+		if cap(s.order) > 2*maxJobs {
+			t.Fatalf("after %d jobs order has cap %d", i+1, cap(s.order))
+		}
+	}
+	if len(s.jobs) != maxJobs || len(s.order) != maxJobs {
+		t.Fatalf("kept %d jobs / %d ids, want %d", len(s.jobs), len(s.order), maxJobs)
+	}
+	if _, ok := s.get(strconv.Itoa(4*maxJobs - 1)); ok {
+		t.Fatal("oldest job not evicted")
+	}
+	if _, ok := s.get(strconv.Itoa(4 * maxJobs)); !ok {
+		t.Fatal("newest jobs evicted")
+	}
+
+	// 重复 ID 不能顶掉已有的 job，也不占额外位置
+	if s.add(&Job{ID: strconv.Itoa(5*maxJobs - 1), Text: "again"}) {
+		t.Fatal("re-adding a job succeeded")
+	}
+	if j, _ := s.get(strconv.Itoa(5*maxJobs - 1)); j.Text != "" || len(s.order) != maxJobs {
+		t.Fatalf("re-adding a job: %+v, %d ids", j, len(s.order))
+	}
+}
@@ -0,0 +1,533 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+var (
+	// ErrQueueFull is returned by EnqueueComment when the queue can't take the comment.
+	ErrQueueFull = errors.New("comment queue full")
+	// ErrNotQueued is returned when reordering or removing a comment that isn't waiting.
+	ErrNotQueued = errors.New("comment not queued")
+)
+
+// QueuePolicy decides what happens to a comment arriving at a full queue.
+type QueuePolicy string
+
+const (
+	QueueReject     QueuePolicy = "reject"      // refuse the new comment
+	QueueDropOldest QueuePolicy = "drop-oldest" // drop the oldest comment of the lowest class, unless it outranks the new one
+)
+
+// ParseQueuePolicy parses "reject" or "drop-oldest".
+func ParseQueuePolicy(s string) (QueuePolicy, error) {
+	switch p := QueuePolicy(s); p {
+	case QueueReject, QueueDropOldest:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown queue policy %q (want reject or drop-oldest)", s)
+}
+
+// PriorityClass groups comment priorities; higher classes are answered first.
+type PriorityClass string
+
+const (
+	ClassRegular  PriorityClass = "regular"
+	ClassPaid     PriorityClass = "paid"
+	ClassOperator PriorityClass = "operator"
+)
+
+// ClassOf maps a Comment.Priority to its class.
+func ClassOf(priority int) PriorityClass {
+	switch {
+	case priority >= protocol.PriorityOperator:
+		return ClassOperator
+	case priority >= protocol.PriorityPaid:
+		return ClassPaid
+	}
+	return ClassRegular
+}
+
+func (c PriorityClass) rank() int {
+	switch c {
+	case ClassOperator:
+		return 2
+	case ClassPaid:
+		return 1
+	}
+	return 0
+}
+
+// QueueConfig bounds the comment queue.
+type QueueConfig struct {
+	// MaxLen is how many comments may wait; 0 means unbounded.
+	MaxLen int
+	Policy QueuePolicy
+	// DedupeWindow coalesces a comment into an identical one (same text,
+	// ignoring case and spacing) queued or sent within the window; 0 disables.
+	DedupeWindow time.Duration
+	// ReplyTimeout frees a worker when a comment sent to it never finishes
+	// (e.g. the worker doesn't report jobs or utterances).
+	ReplyTimeout time.Duration
+}
+
+// DefaultQueueConfig returns the settings used unless SetQueue is called.
+func DefaultQueueConfig() QueueConfig {
+	return QueueConfig{
+		MaxLen:       50,
+		Policy:       QueueDropOldest,
+		DedupeWindow: 30 * time.Second,
+		ReplyTimeout: 2 * time.Minute,
+	}
+}
+
+// QueuedComment is a comment in the queue, as shown by Queue.
+type QueuedComment struct {
+	ID         string        `json:"id"`
+	Text       string        `json:"text"`
+	Author     string        `json:"author,omitempty"`
+	Class      PriorityClass `json:"class"`
+	Priority   int           `json:"priority"`
+	EnqueuedAt time.Time     `json:"enqueued_at"`
+	SentAt     time.Time     `json:"sent_at,omitzero"`
+	WorkerID   string        `json:"worker_id,omitempty"` // once sent
+	Coalesced  []string      `json:"coalesced,omitempty"` // IDs of duplicates merged into this one
+
+	route   Route
+	comment *protocol.Comment
+	key     string      // dedupe key
+	stop    func() bool // stops the ReplyTimeout timer once sent
+}
+
+// QueueStatus is the queue as seen from outside.
+type QueueStatus struct {
+	Replying  []QueuedComment `json:"replying"` // sent, reply not finished yet; one per worker, by worker ID
+	Queued    []QueuedComment `json:"queued"`   // in the order they will be sent
+	Rejected  uint64          `json:"rejected"`
+	Dropped   uint64          `json:"dropped"`
+	Coalesced uint64          `json:"coalesced"`
+}
+
+// sentComment is a recently sent comment, kept for dedupe.
+type sentComment struct {
+	id string
+	at time.Time
+}
+
+// commentQueue sends comments to each worker one at a time: a worker gets
+// the next one when its reply to the previous one ends, so its replies never
+// overlap. Lock order: commentQueue.mu before UDSBroadcaster.mu and jobStore.mu.
+type commentQueue struct {
+	b *UDSBroadcaster
+
+	mu        sync.Mutex
+	cfg       QueueConfig
+	items     []*QueuedComment
+	replying  map[string]*QueuedComment // by worker ID
+	recent    map[string]sentComment
+	rejected  uint64
+	dropped   uint64
+	coalesced uint64
+
+	onSend func(Job) // see OnCommentSent
+
+	// 测试里换成假时钟
+	now       func() time.Time
+	afterFunc func(d time.Duration, f func()) (stop func() bool)
+}
+
+func newCommentQueue(b *UDSBroadcaster) *commentQueue {
+	return &commentQueue{
+		b:        b,
+		cfg:      DefaultQueueConfig(),
+		replying: make(map[string]*QueuedComment),
+		recent:   make(map[string]sentComment),
+		now:      time.Now,
+		afterFunc: func(d time.Duration, f func()) func() bool {
+			return time.AfterFunc(d, f).Stop
+		},
+	}
+}
+
+// SetQueue replaces the queue settings. Call it before Start.
+func (b *UDSBroadcaster) SetQueue(cfg QueueConfig) {
+	def := DefaultQueueConfig()
+	if cfg.Policy == "" {
+		cfg.Policy = def.Policy
+	}
+	if cfg.ReplyTimeout <= 0 {
+		cfg.ReplyTimeout = def.ReplyTimeout
+	}
+	b.queue.mu.Lock()
+	b.queue.cfg = cfg
+	b.queue.mu.Unlock()
+}
+
+// OnCommentSent registers fn to be called whenever a queued comment is
+// handed to a worker. Call it before Start.
+func (b *UDSBroadcaster) OnCommentSent(fn func(Job)) {
+	b.queue.mu.Lock()
+	b.queue.onSend = fn
+	b.queue.mu.Unlock()
+}
+
+// dedupeKey normalizes text for duplicate detection.
+func dedupeKey(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
+
+// EnqueueComment queues a comment and tracks it as a job (state queued until
+// it is sent). A comment identical to one queued or sent within the dedupe
+// window isn't queued: it gets an alias job with CoalescedInto set to the
+// earlier comment, which it follows from then on. A comment reusing the ID
+// of a tracked job is refused with ErrDuplicateComment.
+func (b *UDSBroadcaster) EnqueueComment(r Route, c *protocol.Comment) (Job, error) {
+	// 现在就没有能接的 Worker 时直接报错，不让评论在队列里空等
+	if _, err := b.Pick(r); err != nil {
+		return Job{}, err
+	}
+	q := b.queue
+	now := q.now()
+	item := &QueuedComment{
+		ID:         c.ID,
+		Text:       c.Text,
+		Author:     c.Author.DisplayName,
+		Class:      ClassOf(c.Priority),
+		Priority:   c.Priority,
+		EnqueuedAt: now,
+		route:      r,
+		comment:    c,
+		key:        dedupeKey(c.Text),
+	}
+
+	q.mu.Lock()
+	// ID 由客户端给出：重复的 ID 会顶掉别人的 job 和队列项
+	if _, ok := b.jobs.get(c.ID); ok || q.has(c.ID) {
+		q.mu.Unlock()
+		return Job{}, fmt.Errorf("%w: %s", ErrDuplicateComment, c.ID)
+	}
+	if id, ok := q.coalesce(item, now); ok {
+		target, _ := b.jobs.get(id)
+		detail := "coalesced into " + id
+		b.jobs.add(&Job{
+			ID:            c.ID,
+			Text:          c.Text,
+			WorkerID:      target.WorkerID,
+			State:         target.State,
+			Detail:        detail,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+			History:       []JobEvent{{State: target.State, Detail: detail, At: now}},
+			CoalescedInto: id,
+		})
+		q.mu.Unlock()
+		log.Printf("Queue: comment %s coalesced into %s", c.ID, id)
+		job, _ := b.jobs.get(c.ID)
+		return job, nil
+	}
+	var victim *QueuedComment
+	if q.cfg.MaxLen > 0 && len(q.items) >= q.cfg.MaxLen {
+		if q.cfg.Policy == QueueDropOldest {
+			victim = q.oldestBelow(item.Class)
+		}
+		if victim == nil {
+			q.rejected++
+			q.mu.Unlock()
+			return Job{}, fmt.Errorf("%w (%d waiting)", ErrQueueFull, q.cfg.MaxLen)
+		}
+		q.remove(victim.ID)
+		q.dropped++
+	}
+	q.insert(item)
+	// job 要在 pump 能看到这条评论之前建好
+	detail := fmt.Sprintf("position %d", q.position(item.ID))
+	b.jobs.add(&Job{
+		ID:        c.ID,
+		Text:      c.Text,
+		State:     protocol.JobQueued,
+		Detail:    detail,
+		CreatedAt: now,
+		UpdatedAt: now,
+		History:   []JobEvent{{State: protocol.JobQueued, Detail: detail, At: now}},
+	})
+	q.mu.Unlock()
+
+	if victim != nil {
+		log.Printf("Queue: full, dropped %s comment %s", victim.Class, victim.ID)
+		b.jobs.transition("", &protocol.JobStatusBody{CommentID: victim.ID, State: protocol.JobFailed, Detail: "dropped: queue full"}, now)
+	}
+	q.pump()
+	job, _ := b.jobs.get(c.ID)
+	return job, nil
+}
+
+// coalesce merges item into an identical comment queued or sent within the
+// dedupe window, raising the queued one's class if item outranks it. Called
+// with q.mu held.
+func (q *commentQueue) coalesce(item *QueuedComment, now time.Time) (string, bool) {
+	if q.cfg.DedupeWindow <= 0 {
+		return "", false
+	}
+	for _, it := range q.items {
+		if it.key == item.key && now.Sub(it.EnqueuedAt) <= q.cfg.DedupeWindow {
+			it.Coalesced = append(it.Coalesced, item.ID)
+			q.coalesced++
+			if item.Class.rank() > it.Class.rank() {
+				q.remove(it.ID)
+				it.Class, it.Priority = item.Class, item.Priority
+				it.comment.Priority = item.Priority
+				q.insert(it)
+			}
+			return it.ID, true
+		}
+	}
+	for _, it := range q.replying {
+		if it.key == item.key && now.Sub(it.EnqueuedAt) <= q.cfg.DedupeWindow {
+			it.Coalesced = append(it.Coalesced, item.ID)
+			q.coalesced++
+			return it.ID, true
+		}
+	}
+	for key, s := range q.recent {
+		if now.Sub(s.at) > q.cfg.DedupeWindow {
+			delete(q.recent, key)
+		}
+	}
+	if s, ok := q.recent[item.key]; ok {
+		q.coalesced++
+		return s.id, true
+	}
+	return "", false
+}
+
+// insert puts item behind every comment of its class or higher. Called with q.mu held.
+func (q *commentQueue) insert(item *QueuedComment) {
+	i := len(q.items)
+	for i > 0 && q.items[i-1].Class.rank() < item.Class.rank() {
+		i--
+	}
+	q.items = append(q.items, nil)
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = item
+}
+
+// remove takes a comment out of the queue. Called with q.mu held.
+func (q *commentQueue) remove(id string) *QueuedComment {
+	for i, it := range q.items {
+		if it.ID == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			return it
+		}
+	}
+	return nil
+}
+
+// has reports whether a comment is queued or being replied to. Called with q.mu held.
+func (q *commentQueue) has(id string) bool {
+	if q.position(id) > 0 {
+		return true
+	}
+	for _, it := range q.replying {
+		if it.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// position is the 1-based place of a comment in the queue. Called with q.mu held.
+func (q *commentQueue) position(id string) int {
+	for i, it := range q.items {
+		if it.ID == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// oldestBelow picks what drop-oldest drops for a comment of class: the
+// oldest comment of the lowest class queued, if that class isn't above
+// class. Called with q.mu held.
+func (q *commentQueue) oldestBelow(class PriorityClass) *QueuedComment {
+	var victim *QueuedComment
+	for _, it := range q.items {
+		if it.Class.rank() > class.rank() {
+			continue
+		}
+		if victim == nil || it.Class.rank() < victim.Class.rank() ||
+			it.Class == victim.Class && it.EnqueuedAt.Before(victim.EnqueuedAt) {
+			victim = it
+		}
+	}
+	return victim
+}
+
+// pump sends queued comments to the workers that aren't replying. A comment
+// whose workers are all busy (or not connected yet) waits without holding up
+// comments behind it that can go to another worker.
+func (q *commentQueue) pump() {
+	for {
+		q.mu.Lock()
+		item, w, err := q.next()
+		if item == nil {
+			q.mu.Unlock()
+			return
+		}
+		if err != nil {
+			q.mu.Unlock()
+			log.Printf("Queue: comment %s not sent: %v", item.ID, err)
+			q.b.jobs.transition("", &protocol.JobStatusBody{CommentID: item.ID, State: protocol.JobFailed, Detail: err.Error()}, q.now())
+			continue
+		}
+		now := q.now()
+		item.SentAt, item.WorkerID = now, w.info.ID
+		q.replying[w.info.ID] = item
+		q.recent[item.key] = sentComment{id: item.ID, at: now}
+		item.stop = q.afterFunc(q.cfg.ReplyTimeout, func() { q.timeout(item) })
+		onSend := q.onSend
+		q.mu.Unlock()
+
+		q.b.jobs.assign(item.ID, w.info.ID, w.info.Session, now)
+		if onSend != nil {
+			job, _ := q.b.jobs.get(item.ID)
+			onSend(job)
+		}
+		// 发送失败时 job 变成 failed，done 会释放这个 Worker
+		if err := q.b.deliver(w, item.comment); err != nil {
+			log.Printf("Queue: comment %s not sent: %v", item.ID, err)
+		}
+	}
+}
+
+// next takes the first comment that can be sent out of the queue, with the
+// worker to send it to, or with the error that it never can. Called with q.mu held.
+func (q *commentQueue) next() (*QueuedComment, *workerConn, error) {
+	busy := func(workerID string) bool { return q.replying[workerID] != nil }
+	q.b.mu.Lock()
+	defer q.b.mu.Unlock()
+	for i, item := range q.items {
+		w, err := q.b.pickIdleLocked(item.route, busy)
+		if errors.Is(err, errWorkerBusy) || errors.Is(err, ErrNoWorker) {
+			// 等 Worker 空出来或连上来 (register 会再 pump)
+			continue
+		}
+		q.items = append(q.items[:i], q.items[i+1:]...)
+		return item, w, err
+	}
+	return nil, nil, nil
+}
+
+// done frees the worker replying to a job when the job ends.
+func (q *commentQueue) done(id string) {
+	q.mu.Lock()
+	for workerID, it := range q.replying {
+		if it.ID == id {
+			q.release(workerID)
+			q.mu.Unlock()
+			q.pump()
+			return
+		}
+	}
+	q.mu.Unlock()
+}
+
+// replyEnded frees a worker that doesn't report comment IDs when it finishes
+// an utterance; it must have been the reply to what we sent it.
+func (q *commentQueue) replyEnded(workerID string) {
+	q.mu.Lock()
+	if q.replying[workerID] == nil {
+		q.mu.Unlock()
+		return
+	}
+	q.release(workerID)
+	q.mu.Unlock()
+	q.pump()
+}
+
+func (q *commentQueue) timeout(item *QueuedComment) {
+	q.mu.Lock()
+	if q.replying[item.WorkerID] != item {
+		q.mu.Unlock()
+		return
+	}
+	log.Printf("Queue: no end of reply to %s from worker %s after %v, sending it the next comment", item.ID, item.WorkerID, q.cfg.ReplyTimeout)
+	q.release(item.WorkerID)
+	q.mu.Unlock()
+	q.pump()
+}
+
+// release forgets the reply in progress on a worker. Called with q.mu held.
+func (q *commentQueue) release(workerID string) {
+	if it := q.replying[workerID]; it != nil && it.stop != nil {
+		it.stop()
+	}
+	delete(q.replying, workerID)
+}
+
+// Queue returns the comments waiting and those being replied to.
+func (b *UDSBroadcaster) Queue() QueueStatus {
+	q := b.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	st := QueueStatus{
+		Replying:  make([]QueuedComment, 0, len(q.replying)),
+		Queued:    make([]QueuedComment, 0, len(q.items)),
+		Rejected:  q.rejected,
+		Dropped:   q.dropped,
+		Coalesced: q.coalesced,
+	}
+	for _, it := range q.replying {
+		r := *it
+		r.Coalesced = append([]string(nil), r.Coalesced...)
+		st.Replying = append(st.Replying, r)
+	}
+	sort.Slice(st.Replying, func(i, j int) bool { return st.Replying[i].WorkerID < st.Replying[j].WorkerID })
+	for _, it := range q.items {
+		c := *it
+		c.Coalesced = append([]string(nil), c.Coalesced...)
+		st.Queued = append(st.Queued, c)
+	}
+	return st
+}
+
+// MoveQueued moves a waiting comment to position (1-based, clamped to the
+// queue). The operator's order wins over priority classes; later comments
+// are still inserted by class.
+func (b *UDSBroadcaster) MoveQueued(id string, position int) error {
+	q := b.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it := q.remove(id)
+	if it == nil {
+		return fmt.Errorf("%w: %s", ErrNotQueued, id)
+	}
+	i := min(max(position-1, 0), len(q.items))
+	q.items = append(q.items, nil)
+	copy(q.items[i+1:], q.items[i:])
+	q.items[i] = it
+	return nil
+}
+
+// RemoveQueued takes a waiting comment out of the queue; its job fails.
+func (b *UDSBroadcaster) RemoveQueued(id, reason string) error {
+	q := b.queue
+	q.mu.Lock()
+	it := q.remove(id)
+	q.mu.Unlock()
+	if it == nil {
+		return fmt.Errorf("%w: %s", ErrNotQueued, id)
+	}
+	if reason == "" {
+		reason = "removed from queue"
+	}
+	b.jobs.transition("", &protocol.JobStatusBody{CommentID: id, State: protocol.JobFailed, Detail: reason}, q.now())
+	return nil
+}
@@ -0,0 +1,385 @@
+package infrastructure
+
+import (
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+// fakeQueueClock drives the queue's now and ReplyTimeout timers by hand.
+type fakeQueueClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (c *fakeQueueClock) install(q *commentQueue) {
+	c.now = time.Unix(1700000000, 0)
+	q.now = func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.now
+	}
+	q.afterFunc = func(d time.Duration, f func()) func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		t := &fakeTimer{at: c.now.Add(d), f: f}
+		c.timers = append(c.timers, t)
+		return func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			was := !t.stopped
+			t.stopped = true
+			return was
+		}
+	}
+}
+
+// advance moves the clock forward and fires the timers that came due.
+func (c *fakeQueueClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []func()
+	for _, t := range c.timers {
+		if !t.stopped && !t.at.After(c.now) {
+			t.stopped = true
+			due = append(due, t.f)
+		}
+	}
+	c.mu.Unlock()
+	for _, f := range due {
+		f()
+	}
+}
+
+func newTestQueue(cfg QueueConfig, workerIDs ...string) (*UDSBroadcaster, *fakeQueueClock) {
+	b := NewUDSBroadcaster(nil)
+	b.SetQueue(cfg)
+	clock := &fakeQueueClock{}
+	clock.install(b.queue)
+	for _, id := range workerIDs {
+		w := testWorker(id, "", 0, true)
+		w.info.Session = "s-" + id
+		w.writer = protocol.NewWriter(io.Discard)
+		b.workers[id] = w
+	}
+	return b, clock
+}
+
+func enqueue(b *UDSBroadcaster, r Route, id, text string, priority int) (Job, error) {
+	return b.EnqueueComment(r, &protocol.Comment{ID: id, Text: text, Priority: priority})
+}
+
+func queuedIDs(items []QueuedComment) []string {
+	ids := []string{}
+	for _, it := range items {
+		ids = append(ids, it.ID)
+	}
+	return ids
+}
+
+func TestEnqueueComment(t *testing.T) {
+	type step struct {
+		id, text string
+		priority int
+		after    time.Duration // clock advance before enqueueing
+		err      error
+	}
+	tests := []struct {
+		name      string
+		cfg       QueueConfig
+		steps     []step
+		queued    []string
+		replying  []string
+		rejected  uint64
+		dropped   uint64
+		coalesced uint64
+		failed    []string // jobs failed by the queue
+	}{
+		{
+			name: "classes in order, FIFO within a class",
+			cfg:  QueueConfig{},
+			steps: []step{
+				{id: "c1", text: "one"},
+				{id: "c2", text: "two"},
+				{id: "c3", text: "three", priority: protocol.PriorityPaid},
+				{id: "c4", text: "four", priority: protocol.PriorityOperator},
+				{id: "c5", text: "five"},
+				{id: "c6", text: "six", priority: protocol.PriorityPaid},
+			},
+			queued:   []string{"c4", "c3", "c6", "c2", "c5"},
+			replying: []string{"c1"},
+		},
+		{
+			name: "reject when full",
+			cfg:  QueueConfig{MaxLen: 2, Policy: QueueReject},
+			steps: []step{
+				{id: "c1", text: "one"},
+				{id: "c2", text: "two"},
+				{id: "c3", text: "three"},
+				{id: "c4", text: "four", priority: protocol.PriorityOperator, err: ErrQueueFull},
+			},
+			queued:   []string{"c2", "c3"},
+			replying: []string{"c1"},
+			rejected: 1,
+		},
+		{
+			name: "drop oldest of the lowest class",
+			cfg:  QueueConfig{MaxLen: 2, Policy: QueueDropOldest},
+			steps: []step{
+				{id: "c1", text: "one"},
+				{id: "c2", text: "two", priority: protocol.PriorityPaid},
+				{id: "c3", text: "three"},
+				{id: "c4", text: "four", priority: protocol.PriorityPaid},
+			},
+			queued:   []string{"c2", "c4"},
+			replying: []string{"c1"},
+			dropped:  1,
+			failed:   []string{"c3"},
+		},
+		{
+			name: "drop oldest never drops a higher class",
+			cfg:  QueueConfig{MaxLen: 2, Policy: QueueDropOldest},
+			steps: []step{
+				{id: "c1", text: "one"},
+				{id: "c2", text: "two", priority: protocol.PriorityPaid},
+				{id: "c3", text: "three", priority: protocol.PriorityPaid},
+				{id: "c4", text: "four", err: ErrQueueFull},
+			},
+			queued:   []string{"c2", "c3"},
+			replying: []string{"c1"},
+			rejected: 1,
+		},
+		{
+			name: "coalesce into a queued comment",
+			cfg:  QueueConfig{DedupeWindow: 30 * time.Second},
+			steps: []step{
+				{id: "c1", text: "one"},
+				{id: "c2", text: "Hello  there"},
+				{id: "c3", text: "hello there", after: 10 * time.Second},
+			},
+			queued:    []string{"c2"},
+			replying:  []string{"c1"},
+			coalesced: 1,
+		},
+		{
+			name: "coalesce into the reply in progress",
+			cfg:  QueueConfig{DedupeWindow: 30 * time.Second},
+			steps: []step{
+				{id: "c1", text: "hello"},
+				{id: "c2", text: "hello"},
+			},
+			queued:    []string{},
+			replying:  []string{"c1"},
+			coalesced: 1,
+		},
+		{
+			name: "coalescing raises the class",
+			cfg:  QueueConfig{DedupeWindow: 30 * time.Second},
+			steps: []step{
+				{id: "c1", text: "one"},
+				{id: "c2", text: "hello"},
+				{id: "c3", text: "other", priority: protocol.PriorityPaid},
+				{id: "c4", text: "hello", priority: protocol.PriorityOperator},
+			},
+			queued:    []string{"c2", "c3"},
+			replying:  []string{"c1"},
+			coalesced: 1,
+		},
+		{
+			name: "reused comment ID",
+			cfg:  QueueConfig{DedupeWindow: 30 * time.Second},
+			steps: []step{
+				{id: "c1", text: "one"},
+				{id: "c2", text: "two"},
+				{id: "c2", text: "not two", err: ErrDuplicateComment},
+				{id: "c1", text: "one", err: ErrDuplicateComment},
+			},
+			queued:   []string{"c2"},
+			replying: []string{"c1"},
+		},
+		{
+			name: "outside the dedupe window",
+			cfg:  QueueConfig{DedupeWindow: 30 * time.Second},
+			steps: []step{
+				{id: "c1", text: "hello"},
+				{id: "c2", text: "hello", after: 31 * time.Second},
+			},
+			queued:   []string{"c2"},
+			replying: []string{"c1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, clock := newTestQueue(tt.cfg, "a")
+			for _, s := range tt.steps {
+				clock.advance(s.after)
+				_, err := enqueue(b, Route{}, s.id, s.text, s.priority)
+				if !errors.Is(err, s.err) {
+					t.Fatalf("enqueue %s: err = %v, want %v", s.id, err, s.err)
+				}
+			}
+			st := b.Queue()
+			if got := queuedIDs(st.Queued); !slices.Equal(got, tt.queued) {
+				t.Errorf("queued = %v, want %v", got, tt.queued)
+			}
+			if got := queuedIDs(st.Replying); !slices.Equal(got, tt.replying) {
+				t.Errorf("replying = %v, want %v", got, tt.replying)
+			}
+			if st.Rejected != tt.rejected || st.Dropped != tt.dropped || st.Coalesced != tt.coalesced {
+				t.Errorf("rejected/dropped/coalesced = %d/%d/%d, want %d/%d/%d",
+					st.Rejected, st.Dropped, st.Coalesced, tt.rejected, tt.dropped, tt.coalesced)
+			}
+			for _, id := range tt.failed {
+				if job, _ := b.Job(id); job.State != protocol.JobFailed {
+					t.Errorf("job %s = %s, want failed", id, job.State)
+				}
+			}
+		})
+	}
+}
+
+// A coalesced comment gets its own job that follows the one it was merged into.
+func TestQueueCoalescedJob(t *testing.T) {
+	b, _ := newTestQueue(QueueConfig{DedupeWindow: 30 * time.Second}, "a")
+	if _, err := enqueue(b, Route{}, "c1", "hello", 0); err != nil {
+		t.Fatal(err)
+	}
+	job, err := enqueue(b, Route{}, "c2", "HELLO", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.ID != "c2" || job.CoalescedInto != "c1" || job.State != protocol.JobPending || job.WorkerID != "a" {
+		t.Fatalf("coalesced job = %+v, want c2 pending on a, coalesced into c1", job)
+	}
+
+	b.jobs.transition("a", &protocol.JobStatusBody{CommentID: "c1", State: protocol.JobDone}, time.Now())
+	job, ok := b.Job("c2")
+	if !ok || job.ID != "c2" || job.Text != "HELLO" || job.State != protocol.JobDone {
+		t.Fatalf("coalesced job after the reply = %+v, want c2 done", job)
+	}
+	if st := b.Queue(); len(st.Replying) != 0 {
+		t.Fatalf("replying = %v after the reply ended", queuedIDs(st.Replying))
+	}
+}
+
+func TestQueuePump(t *testing.T) {
+	type comment struct {
+		id    string
+		route Route
+	}
+	tests := []struct {
+		name     string
+		workers  []string
+		comments []comment
+		replying []string // by worker ID
+		queued   []string
+	}{
+		{
+			name:     "one reply per worker",
+			workers:  []string{"a", "b"},
+			comments: []comment{{id: "c1"}, {id: "c2"}, {id: "c3"}},
+			replying: []string{"c1", "c2"},
+			queued:   []string{"c3"},
+		},
+		{
+			name:     "a busy worker doesn't hold up the others",
+			workers:  []string{"a", "b"},
+			comments: []comment{{"c1", Route{WorkerID: "a"}}, {"c2", Route{WorkerID: "a"}}, {"c3", Route{WorkerID: "b"}}},
+			replying: []string{"c1", "c3"},
+			queued:   []string{"c2"},
+		},
+		{
+			name:     "waits for the named worker",
+			workers:  []string{"a", "b"},
+			comments: []comment{{"c1", Route{WorkerID: "b"}}, {"c2", Route{WorkerID: "b"}}},
+			replying: []string{"c1"},
+			queued:   []string{"c2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, _ := newTestQueue(QueueConfig{}, tt.workers...)
+			for i, c := range tt.comments {
+				if _, err := enqueue(b, c.route, c.id, "comment "+c.id, 0); err != nil {
+					t.Fatalf("enqueue %d: %v", i, err)
+				}
+			}
+			st := b.Queue()
+			if got := queuedIDs(st.Replying); !slices.Equal(got, tt.replying) {
+				t.Errorf("replying = %v, want %v", got, tt.replying)
+			}
+			if got := queuedIDs(st.Queued); !slices.Equal(got, tt.queued) {
+				t.Errorf("queued = %v, want %v", got, tt.queued)
+			}
+			for _, r := range st.Replying {
+				if job, _ := b.Job(r.ID); job.State != protocol.JobPending || job.WorkerID != r.WorkerID {
+					t.Errorf("job %s = %s on %q, want pending on %s", r.ID, job.State, job.WorkerID, r.WorkerID)
+				}
+			}
+		})
+	}
+}
+
+// What frees a worker for the next comment, and what doesn't.
+func TestQueueRelease(t *testing.T) {
+	const timeout = time.Minute
+	tests := []struct {
+		name string
+		do   func(b *UDSBroadcaster, clock *fakeQueueClock)
+		want string // replying on worker a afterwards
+	}{
+		{"job done", func(b *UDSBroadcaster, _ *fakeQueueClock) {
+			b.jobs.transition("a", &protocol.JobStatusBody{CommentID: "c1", State: protocol.JobDone}, time.Now())
+		}, "c2"},
+		{"job failed", func(b *UDSBroadcaster, _ *fakeQueueClock) {
+			b.jobs.transition("a", &protocol.JobStatusBody{CommentID: "c1", State: protocol.JobFailed}, time.Now())
+		}, "c2"},
+		{"reply ended", func(b *UDSBroadcaster, _ *fakeQueueClock) {
+			b.queue.replyEnded("a")
+		}, "c2"},
+		{"reply ended on another worker", func(b *UDSBroadcaster, _ *fakeQueueClock) {
+			b.queue.replyEnded("b")
+		}, "c1"},
+		{"report from another worker", func(b *UDSBroadcaster, _ *fakeQueueClock) {
+			b.jobs.transition("b", &protocol.JobStatusBody{CommentID: "c1", State: protocol.JobDone}, time.Now())
+		}, "c1"},
+		{"reply timeout", func(_ *UDSBroadcaster, clock *fakeQueueClock) {
+			clock.advance(timeout)
+		}, "c2"},
+		{"before the reply timeout", func(_ *UDSBroadcaster, clock *fakeQueueClock) {
+			clock.advance(timeout - time.Second)
+		}, "c1"},
+		{"stale timeout after the reply ended", func(b *UDSBroadcaster, clock *fakeQueueClock) {
+			clock.advance(timeout / 2)
+			b.queue.replyEnded("a")
+			clock.advance(timeout / 2) // c1 的超时到点也不能放掉 c2
+		}, "c2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, clock := newTestQueue(QueueConfig{ReplyTimeout: timeout}, "a")
+			for _, id := range []string{"c1", "c2", "c3"} {
+				if _, err := enqueue(b, Route{}, id, "comment "+id, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tt.do(b, clock)
+			st := b.Queue()
+			if len(st.Replying) != 1 || st.Replying[0].ID != tt.want {
+				t.Fatalf("replying = %v, want [%s]", queuedIDs(st.Replying), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package infrastructure
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+// BackpressurePolicy decides what a subscriber loses when it falls behind.
+type BackpressurePolicy int
+
+const (
+	// DropNewest discards the incoming packet (the historical behaviour).
+	DropNewest BackpressurePolicy = iota
+	// Block makes the publisher wait up to BlockTimeout for room, then drops the
+	// incoming packet. This slows down the worker's read loop for everyone.
+	Block
+	// DropOldest discards the oldest queued media packet.
+	DropOldest
+	// DropNonKey discards the oldest queued video inter frame, falling back to
+	// DropOldest. Keyframes survive, so the picture recovers at the next GOP at
+	// the latest instead of freezing on a lost keyframe.
+	DropNonKey
+	// DropGOP discards the queued video and every incoming video frame until
+	// the next keyframe, so the decoder never sees a broken GOP. Audio keeps flowing.
+	DropGOP
+)
+
+func (p BackpressurePolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop_newest"
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop_oldest"
+	case DropNonKey:
+		return "drop_non_key"
+	case DropGOP:
+		return "drop_gop"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseBackpressurePolicy is the inverse of BackpressurePolicy.String.
+func ParseBackpressurePolicy(s string) (BackpressurePolicy, error) {
+	for p := DropNewest; p <= DropGOP; p++ {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown backpressure policy %q", s)
+}
+
+const (
+	defaultQueueDepth   = 100
+	defaultBlockTimeout = 50 * time.Millisecond
+)
+
+// PacketFilter selects the packets of a subscription. An empty field matches
+// anything; every set field must match. Stream IDs are only unique per
+// worker, so StreamIDs usually goes with Workers.
+type PacketFilter struct {
+	Types     []byte   // protocol.PacketType*
+	Workers   []string // Packet.Origin
+	StreamIDs []uint32
+	Targets   []string // logical streams (see protocol.StreamTable), "" = default stream
+}
+
+// Match reports whether pkt passes the filter.
+func (f PacketFilter) Match(pkt *Packet) bool {
+	return (len(f.Types) == 0 || slices.Contains(f.Types, pkt.Type)) &&
+		(len(f.Workers) == 0 || slices.Contains(f.Workers, pkt.Origin)) &&
+		(len(f.StreamIDs) == 0 || slices.Contains(f.StreamIDs, pkt.StreamID)) &&
+		(len(f.Targets) == 0 || slices.Contains(f.Targets, pkt.Target))
+}
+
+func (f PacketFilter) String() string {
+	var parts []string
+	if len(f.Types) > 0 {
+		names := make([]string, len(f.Types))
+		for i, t := range f.Types {
+			names[i] = protocol.TypeName(t)
+		}
+		parts = append(parts, "types="+strings.Join(names, ","))
+	}
+	if len(f.Workers) > 0 {
+		parts = append(parts, "workers="+strings.Join(f.Workers, ","))
+	}
+	if len(f.StreamIDs) > 0 {
+		ids := make([]string, len(f.StreamIDs))
+		for i, id := range f.StreamIDs {
+			ids[i] = strconv.FormatUint(uint64(id), 10)
+		}
+		parts = append(parts, "streams="+strings.Join(ids, ","))
+	}
+	if len(f.Targets) > 0 {
+		parts = append(parts, fmt.Sprintf("targets=%q", f.Targets))
+	}
+	if len(parts) == 0 {
+		return "all"
+	}
+	return strings.Join(parts, " ")
+}
+
+// SubscribeOptions configures one subscriber.
+type SubscribeOptions struct {
+	Name   string // For logs and stats
+	Filter PacketFilter
+
+	Depth        int                // Queued packets before the policy kicks in (default 100)
+	Policy       BackpressurePolicy // Default DropNewest
+	BlockTimeout time.Duration      // For Block (default 50ms)
+}
+
+// SubscriberStats is a snapshot of one subscriber's queue.
+type SubscriberStats struct {
+	Name      string            `json:"name"`
+	Policy    string            `json:"policy"`
+	Filter    string            `json:"filter"`
+	Since     time.Time         `json:"since"`
+	Closed    bool              `json:"closed,omitempty"`
+	Depth     int               `json:"depth"`
+	Queued    int               `json:"queued"`
+	Delivered uint64            `json:"delivered"`
+	Primed    int               `json:"primed,omitempty"` // packets replayed from the GOP cache on subscribe
+	Dropped   map[string]uint64 `json:"dropped"`          // by packet type (protocol.TypeName)
+}
+
+// Subscription delivers the packets matching its filter on C until Close is
+// called or its context is done. C is closed after that, once the consumer
+// is no longer being sent to; queued packets are discarded.
+type Subscription struct {
+	C <-chan *Packet
+
+	b    *UDSBroadcaster
+	s    *subscriber
+	stop func() bool // unregisters the context callback
+	once sync.Once
+	done chan struct{}
+}
+
+// Close stops delivery. It is safe to call more than once and from any goroutine.
+func (sub *Subscription) Close() {
+	sub.once.Do(func() {
+		sub.stop()
+		sub.b.removeSubscriber(sub.s)
+		sub.s.close()
+		close(sub.done)
+	})
+}
+
+// Done is closed when the subscription has been closed.
+func (sub *Subscription) Done() <-chan struct{} {
+	return sub.done
+}
+
+// Stats returns this subscription's counters; they stay readable after Close.
+func (sub *Subscription) Stats() SubscriberStats {
+	return sub.s.stats()
+}
+
+// subscriber queues packets for one consumer. A pump goroutine owns the
+// output channel, so the publisher never sends on (or races with closing) it.
+type subscriber struct {
+	opts  SubscribeOptions
+	out   chan *Packet
+	since time.Time
+
+	mu        sync.Mutex
+	queue     []*Packet
+	primed    int // leading queue entries that came from the GOP cache
+	primedAll int
+	closed    bool
+	skipGOP   bool // DropGOP: waiting for the next video keyframe
+	dropping  bool // inside a drop episode (logged once, ends when the queue is half empty)
+	delivered uint64
+	dropped   map[byte]uint64
+
+	wake  chan struct{} // queue got a packet or was closed
+	space chan struct{} // pump took a packet (for Block)
+}
+
+func newSubscriber(opts SubscribeOptions) *subscriber {
+	if opts.Depth <= 0 {
+		opts.Depth = defaultQueueDepth
+	}
+	if opts.BlockTimeout <= 0 {
+		opts.BlockTimeout = defaultBlockTimeout
+	}
+	if opts.Name == "" {
+		opts.Name = "subscriber"
+	}
+	s := &subscriber{
+		opts:    opts,
+		out:     make(chan *Packet),
+		since:   time.Now(),
+		dropped: make(map[byte]uint64),
+		wake:    make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+	}
+	go s.pump()
+	return s
+}
+
+func (s *subscriber) wants(pkt *Packet) bool {
+	return s.opts.Filter.Match(pkt)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// pump moves packets from the queue to the output channel.
+func (s *subscriber) pump() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && !s.closed {
+			s.mu.Unlock()
+			<-s.wake
+			s.mu.Lock()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		pkt := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		if s.primed > 0 {
+			s.primed--
+		}
+		s.mu.Unlock()
+		notify(s.space)
+
+		for sent := false; !sent; {
+			select {
+			case s.out <- pkt:
+				sent = true
+			case <-s.wake:
+				s.mu.Lock()
+				closed := s.closed
+				s.mu.Unlock()
+				if closed {
+					return
+				}
+			}
+		}
+		s.mu.Lock()
+		s.delivered++
+		s.mu.Unlock()
+	}
+}
+
+// close stops the pump; the output channel is closed once it exits. A
+// publisher that still holds s (see publish) finds it closed and returns.
+func (s *subscriber) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.queue, s.primed = nil, 0
+	s.mu.Unlock()
+	notify(s.wake)
+	notify(s.space) // Block 策略下等待空位的发布者
+}
+
+// full reports whether the queue is at depth. Primed packets don't count and
+// are never dropped, so a late subscriber always gets its whole GOP. Called
+// with s.mu held.
+func (s *subscriber) full() bool {
+	return len(s.queue)-s.primed >= s.opts.Depth
+}
+
+// prime queues the GOP cache snapshot of a new subscriber, before it is
+// registered for live packets.
+func (s *subscriber) prime(streams [][]*Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, pkts := range streams {
+		s.queue = append(s.queue, pkts...)
+		s.primed += len(pkts)
+		s.primedAll += len(pkts)
+	}
+	if len(s.queue) > 0 {
+		notify(s.wake)
+	}
+}
+
+// push enqueues pkt according to the policy. Control packets are never
+// dropped and may exceed the depth; they are small and carry state.
+func (s *subscriber) push(pkt *Packet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	media := protocol.IsMedia(pkt.Type)
+	if media && s.opts.Policy == DropGOP && pkt.Type == protocol.PacketTypeVideo {
+		if s.skipGOP && !protocol.IsKeyFrame(pkt.Type, pkt.Payload) {
+			s.drop(pkt)
+			return
+		}
+		s.skipGOP = false
+	}
+
+	if media && s.full() {
+		if !s.makeRoom(pkt) {
+			if !s.closed {
+				s.drop(pkt)
+			}
+			return
+		}
+	} else if media && s.dropping && len(s.queue)-s.primed < s.opts.Depth/2 {
+		s.dropping = false
+		log.Printf("Broadcaster: subscriber %s caught up (dropped so far: %s)", s.opts.Name, s.dropSummary())
+	}
+	s.queue = append(s.queue, pkt)
+	notify(s.wake)
+}
+
+// makeRoom applies the policy to a full queue. Called with s.mu held; may
+// release it while blocking. Returns false if pkt must be dropped instead.
+func (s *subscriber) makeRoom(pkt *Packet) bool {
+	switch s.opts.Policy {
+	case Block:
+		deadline := time.NewTimer(s.opts.BlockTimeout)
+		defer deadline.Stop()
+		for s.full() && !s.closed {
+			s.mu.Unlock()
+			select {
+			case <-s.space:
+			case <-deadline.C:
+				s.mu.Lock()
+				return false
+			}
+			s.mu.Lock()
+		}
+		return !s.closed
+	case DropOldest:
+		return s.dropWhere(func(q *Packet) bool { return protocol.IsMedia(q.Type) })
+	case DropNonKey:
+		if s.dropWhere(func(q *Packet) bool {
+			return q.Type == protocol.PacketTypeVideo && !protocol.IsKeyFrame(q.Type, q.Payload)
+		}) {
+			return true
+		}
+		return s.dropWhere(func(q *Packet) bool { return protocol.IsMedia(q.Type) })
+	case DropGOP:
+		// 丢掉队列里的全部视频 (当前 GOP 已不完整)，视频从下一个关键帧重新开始
+		kept := s.queue[:s.primed]
+		for _, q := range s.queue[s.primed:] {
+			if q.Type == protocol.PacketTypeVideo {
+				s.drop(q)
+				continue
+			}
+			kept = append(kept, q)
+		}
+		for i := len(kept); i < len(s.queue); i++ {
+			s.queue[i] = nil
+		}
+		s.queue = kept
+
+		if pkt.Type == protocol.PacketTypeVideo {
+			if !protocol.IsKeyFrame(pkt.Type, pkt.Payload) {
+				s.skipGOP = true
+				return false
+			}
+		} else {
+			s.skipGOP = true
+		}
+		if s.full() {
+			// 只剩音频也满了：退化为丢最旧
+			return s.dropWhere(func(q *Packet) bool { return protocol.IsMedia(q.Type) })
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// dropWhere removes the oldest queued packet matching fn.
+func (s *subscriber) dropWhere(fn func(*Packet) bool) bool {
+	for i := s.primed; i < len(s.queue); i++ {
+		if q := s.queue[i]; fn(q) {
+			s.drop(q)
+			copy(s.queue[i:], s.queue[i+1:])
+			s.queue[len(s.queue)-1] = nil
+			s.queue = s.queue[:len(s.queue)-1]
+			return true
+		}
+	}
+	return false
+}
+
+// drop counts a lost packet; called with s.mu held.
+func (s *subscriber) drop(pkt *Packet) {
+	s.dropped[pkt.Type]++
+	if !s.dropping {
+		s.dropping = true
+		log.Printf("Broadcaster: subscriber %s is falling behind (policy=%s, depth=%d), dropping %s",
+			s.opts.Name, s.opts.Policy, s.opts.Depth, protocol.TypeName(pkt.Type))
+	}
+}
+
+// dropSummary formats the drop counters; called with s.mu held.
+func (s *subscriber) dropSummary() string {
+	types := make([]int, 0, len(s.dropped))
+	for t := range s.dropped {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	out := ""
+	for i, t := range types {
+		if i > 0 {
+			out += ", "
+		}
+		out += fmt.Sprintf("%s=%d", protocol.TypeName(byte(t)), s.dropped[byte(t)])
+	}
+	if out == "" {
+		return "none"
+	}
+	return out
+}
+
+func (s *subscriber) stats() SubscriberStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SubscriberStats{
+		Name:      s.opts.Name,
+		Policy:    s.opts.Policy.String(),
+		Filter:    s.opts.Filter.String(),
+		Since:     s.since,
+		Closed:    s.closed,
+		Depth:     s.opts.Depth,
+		Queued:    len(s.queue),
+		Delivered: s.delivered,
+		Primed:    s.primedAll,
+		Dropped:   make(map[string]uint64, len(s.dropped)),
+	}
+	for t, n := range s.dropped {
+		st.Dropped[protocol.TypeName(t)] = n
+	}
+	return st
+}
@@ -0,0 +1,156 @@
+package infrastructure
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+// 测试用的包用 Seq 区分
+func keyFrame(seq uint32) *Packet {
+	return &Packet{Type: protocol.PacketTypeVideo, Payload: []byte{0x00, byte(seq)}, Seq: seq}
+}
+
+func interFrame(seq uint32) *Packet {
+	return &Packet{Type: protocol.PacketTypeVideo, Payload: []byte{0x01, byte(seq)}, Seq: seq}
+}
+
+func audioFrame(seq uint32) *Packet {
+	return &Packet{Type: protocol.PacketTypeAudio, Payload: []byte{byte(seq)}, Seq: seq}
+}
+
+func controlPacket(seq uint32) *Packet {
+	return &Packet{Type: protocol.PacketTypeUtteranceEnd, Seq: seq}
+}
+
+// stalledSubscriber is a subscriber whose consumer never reads: no pump
+// runs, so the queue only changes through push.
+func stalledSubscriber(policy BackpressurePolicy, depth int) *subscriber {
+	return &subscriber{
+		opts:    SubscribeOptions{Name: "test", Policy: policy, Depth: depth, BlockTimeout: 5 * time.Millisecond},
+		dropped: make(map[byte]uint64),
+		wake:    make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+	}
+}
+
+func queuedSeqs(s *subscriber) []uint32 {
+	seqs := make([]uint32, len(s.queue))
+	for i, p := range s.queue {
+		seqs[i] = p.Seq
+	}
+	return seqs
+}
+
+func TestSubscriberBackpressure(t *testing.T) {
+	tests := []struct {
+		policy       BackpressurePolicy
+		push         []*Packet // after the queue is full
+		want         []uint32
+		videoDropped uint64
+		audioDropped uint64
+	}{
+		{
+			policy: DropNewest,
+			push:   []*Packet{interFrame(5), controlPacket(6)},
+			want:   []uint32{100, 101, 1, 2, 3, 4, 6},
+			// 控制包不受深度限制
+			videoDropped: 1,
+		},
+		{
+			policy:       Block,
+			push:         []*Packet{interFrame(5), audioFrame(6)},
+			want:         []uint32{100, 101, 1, 2, 3, 4},
+			videoDropped: 1,
+			audioDropped: 1,
+		},
+		{
+			policy:       DropOldest,
+			push:         []*Packet{interFrame(5), audioFrame(6)},
+			want:         []uint32{100, 101, 3, 4, 5, 6},
+			videoDropped: 2,
+		},
+		{
+			policy:       DropNonKey,
+			push:         []*Packet{interFrame(5), audioFrame(6), audioFrame(7)},
+			want:         []uint32{100, 101, 1, 3, 6, 7},
+			videoDropped: 3,
+		},
+		{
+			policy: DropGOP,
+			// 5 满了: 队列里的视频全丢，5 本身也丢；6 等关键帧被丢；8 是关键帧，恢复
+			push:         []*Packet{interFrame(5), interFrame(6), audioFrame(7), keyFrame(8), interFrame(9)},
+			want:         []uint32{100, 101, 3, 7, 8, 9},
+			videoDropped: 5,
+		},
+		{
+			policy: DropGOP,
+			// 满的时候来的是音频：视频丢掉，音频进队，视频从下一个关键帧开始
+			push:         []*Packet{audioFrame(5), interFrame(6), keyFrame(7)},
+			want:         []uint32{100, 101, 3, 5, 7},
+			videoDropped: 4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			s := stalledSubscriber(tt.policy, 4)
+			// 从 GOP 缓存回放的包：不占深度，也永远不丢
+			s.prime([][]*Packet{{keyFrame(100), interFrame(101)}})
+			for _, p := range []*Packet{keyFrame(1), interFrame(2), audioFrame(3), interFrame(4)} {
+				s.push(p)
+			}
+			if len(s.dropped) != 0 {
+				t.Fatalf("dropped %v before the queue was full", s.dropped)
+			}
+			for _, p := range tt.push {
+				s.push(p)
+			}
+
+			if got := queuedSeqs(s); !slices.Equal(got, tt.want) {
+				t.Errorf("queue = %v, want %v", got, tt.want)
+			}
+			if s.primed != 2 {
+				t.Errorf("primed = %d, want 2", s.primed)
+			}
+			st := s.stats()
+			if st.Dropped["video"] != tt.videoDropped || st.Dropped["audio"] != tt.audioDropped {
+				t.Errorf("dropped = %v, want video=%d audio=%d", st.Dropped, tt.videoDropped, tt.audioDropped)
+			}
+		})
+	}
+}
+
+func TestSubscriberPrimedExceedsDepth(t *testing.T) {
+	s := stalledSubscriber(DropOldest, 2)
+	primed := []*Packet{keyFrame(100), interFrame(101), audioFrame(102), interFrame(103)}
+	s.prime([][]*Packet{primed})
+	s.push(interFrame(1))
+	s.push(interFrame(2))
+	s.push(interFrame(3))
+	if got, want := queuedSeqs(s), []uint32{100, 101, 102, 103, 2, 3}; !slices.Equal(got, want) {
+		t.Fatalf("queue = %v, want %v", got, want)
+	}
+}
+
+func TestSubscriberBlockWaitsForConsumer(t *testing.T) {
+	s := newSubscriber(SubscribeOptions{Policy: Block, Depth: 1, BlockTimeout: time.Second})
+	defer s.close()
+	s.push(audioFrame(1)) // 被 pump 取走，挂在 out 上
+	s.push(audioFrame(2)) // 占满队列
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-s.out
+	}()
+	s.push(audioFrame(3))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.dropped) != 0 {
+		t.Fatalf("dropped %v, want the publisher to wait for room", s.dropped)
+	}
+	if got := queuedSeqs(s); !slices.Equal(got, []uint32{2, 3}) && !slices.Equal(got, []uint32{3}) {
+		t.Fatalf("queue = %v", got)
+	}
+}
@@ -0,0 +1,303 @@
+package infrastructure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProcessSpec describes one worker command run by the Supervisor.
+type ProcessSpec struct {
+	Name    string            `json:"name"` // log prefix and status key
+	Command string            `json:"command"`
+	Args    []string          `json:"args,omitempty"`
+	Dir     string            `json:"dir,omitempty"`
+	Env     map[string]string `json:"env,omitempty"` // added to the engine's environment
+}
+
+// LoadProcessSpecs reads a JSON array of ProcessSpec.
+func LoadProcessSpecs(path string) ([]ProcessSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs []ProcessSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, s := range specs {
+		if s.Name == "" || s.Command == "" {
+			return nil, fmt.Errorf("%s: process #%d needs name and command", path, i)
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("%s: duplicate process name %q", path, s.Name)
+		}
+		seen[s.Name] = true
+	}
+	return specs, nil
+}
+
+// SupervisorConfig tunes restarts.
+type SupervisorConfig struct {
+	MinBackoff  time.Duration // First restart delay (default 1s), doubled per quick exit
+	MaxBackoff  time.Duration // Restart delay cap (default 30s)
+	StableAfter time.Duration // A run this long resets the backoff (default 30s)
+
+	// CrashLoopRestarts exits within CrashLoopWindow mark the process as crash
+	// looping; it is then restarted at MaxBackoff only (defaults 5 in 1m).
+	CrashLoopRestarts int
+	CrashLoopWindow   time.Duration
+
+	StopTimeout time.Duration // SIGTERM grace period before SIGKILL (default 5s)
+	Env         []string      // KEY=VALUE injected into every process, before ProcessSpec.Env
+}
+
+func (c *SupervisorConfig) fill() {
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = time.Second
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = 30 * time.Second
+	}
+	if c.StableAfter <= 0 {
+		c.StableAfter = 30 * time.Second
+	}
+	if c.CrashLoopRestarts <= 0 {
+		c.CrashLoopRestarts = 5
+	}
+	if c.CrashLoopWindow <= 0 {
+		c.CrashLoopWindow = time.Minute
+	}
+	if c.StopTimeout <= 0 {
+		c.StopTimeout = 5 * time.Second
+	}
+}
+
+// Process states reported in ProcessStatus.State
+const (
+	ProcStarting  = "starting"
+	ProcRunning   = "running"
+	ProcBackoff   = "backoff"    // waiting to restart
+	ProcCrashLoop = "crash_loop" // waiting to restart, exits too often
+	ProcStopped   = "stopped"
+)
+
+// ProcessStatus is a snapshot of one supervised process.
+type ProcessStatus struct {
+	Name       string    `json:"name"`
+	State      string    `json:"state"`
+	PID        int       `json:"pid,omitempty"`
+	StartedAt  time.Time `json:"started_at,omitempty"`
+	UptimeSec  float64   `json:"uptime_sec"`
+	Restarts   int       `json:"restarts"`
+	LastExit   string    `json:"last_exit,omitempty"` // e.g. "exit status 1"
+	LastExitAt time.Time `json:"last_exit_at,omitempty"`
+	NextStart  time.Time `json:"next_start,omitempty"` // in backoff / crash_loop
+}
+
+// Supervisor starts worker processes and restarts them when they exit.
+type Supervisor struct {
+	cfg SupervisorConfig
+
+	mu    sync.Mutex
+	procs map[string]*process
+	wg    sync.WaitGroup
+
+	// 测试里换成假时钟和假进程
+	now     func() time.Time
+	after   func(time.Duration) <-chan time.Time
+	runProc func(ctx context.Context, p *process) error
+}
+
+type process struct {
+	spec    ProcessSpec
+	status  ProcessStatus
+	exits   []time.Time // recent exits, for crash loop detection
+	looping bool        // crash loop already reported
+}
+
+func NewSupervisor(cfg SupervisorConfig) *Supervisor {
+	cfg.fill()
+	s := &Supervisor{cfg: cfg, procs: make(map[string]*process), now: time.Now, after: time.After}
+	s.runProc = s.runOnce
+	return s
+}
+
+// Start runs every spec until ctx is done; call Wait to block until they are all stopped.
+func (s *Supervisor) Start(ctx context.Context, specs []ProcessSpec) {
+	for _, spec := range specs {
+		p := &process{spec: spec, status: ProcessStatus{Name: spec.Name, State: ProcStarting}}
+		s.mu.Lock()
+		s.procs[spec.Name] = p
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.run(ctx, p)
+	}
+}
+
+// Wait blocks until every process has been stopped after ctx was cancelled.
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Status returns every process ordered by name.
+func (s *Supervisor) Status() []ProcessStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]ProcessStatus, 0, len(s.procs))
+	now := s.now()
+	for _, p := range s.procs {
+		st := p.status
+		if st.State == ProcRunning {
+			st.UptimeSec = now.Sub(st.StartedAt).Seconds()
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func (s *Supervisor) update(p *process, fn func(*ProcessStatus)) {
+	s.mu.Lock()
+	fn(&p.status)
+	s.mu.Unlock()
+}
+
+// run is the restart loop of one process.
+func (s *Supervisor) run(ctx context.Context, p *process) {
+	defer s.wg.Done()
+	defer s.update(p, func(st *ProcessStatus) {
+		st.State, st.PID, st.NextStart = ProcStopped, 0, time.Time{}
+	})
+
+	backoff := s.cfg.MinBackoff
+	for ctx.Err() == nil {
+		started := s.now()
+		err := s.runProc(ctx, p)
+		if ctx.Err() != nil {
+			return
+		}
+
+		now := s.now()
+		if now.Sub(started) >= s.cfg.StableAfter {
+			backoff = s.cfg.MinBackoff
+		}
+		delay, state := backoff, ProcBackoff
+		looping := s.crashLooping(p, now)
+		if looping {
+			delay, state = s.cfg.MaxBackoff, ProcCrashLoop
+			if !p.looping {
+				log.Printf("Supervisor: [%s] is crash looping (%d exits within %v), restarting every %v",
+					p.spec.Name, len(p.exits), s.cfg.CrashLoopWindow, delay)
+			}
+		}
+		p.looping = looping
+		log.Printf("Supervisor: [%s] exited (%v), restarting in %v", p.spec.Name, err, delay)
+		s.update(p, func(st *ProcessStatus) {
+			st.State, st.PID = state, 0
+			st.LastExit, st.LastExitAt = exitString(err), now
+			st.NextStart = now.Add(delay)
+		})
+
+		select {
+		case <-s.after(delay):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > s.cfg.MaxBackoff {
+			backoff = s.cfg.MaxBackoff
+		}
+		s.update(p, func(st *ProcessStatus) { st.Restarts++ })
+	}
+}
+
+// crashLooping records an exit and reports whether there were too many lately.
+func (s *Supervisor) crashLooping(p *process, now time.Time) bool {
+	kept := p.exits[:0]
+	for _, t := range p.exits {
+		if now.Sub(t) < s.cfg.CrashLoopWindow {
+			kept = append(kept, t)
+		}
+	}
+	p.exits = append(kept, now)
+	return len(p.exits) >= s.cfg.CrashLoopRestarts
+}
+
+// runOnce starts the process and waits for it to exit (or be stopped via ctx).
+func (s *Supervisor) runOnce(ctx context.Context, p *process) error {
+	cmd := exec.CommandContext(ctx, p.spec.Command, p.spec.Args...)
+	cmd.Dir = p.spec.Dir
+	cmd.Env = append(os.Environ(), s.cfg.Env...)
+	for k, v := range p.spec.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	// 停止时先 SIGTERM，给 Worker 机会发完 StreamClose 再退出；StopTimeout 后 SIGKILL
+	group := newProcessGroup(cmd)
+	cmd.WaitDelay = s.cfg.StopTimeout
+
+	out := &lineLogger{prefix: "[" + p.spec.Name + "] "}
+	cmd.Stdout, cmd.Stderr = out, out // 同一个 Writer：exec 保证不会并发调用
+
+	s.update(p, func(st *ProcessStatus) { st.State = ProcStarting })
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	now := s.now()
+	s.update(p, func(st *ProcessStatus) {
+		st.State, st.PID, st.StartedAt, st.NextStart = ProcRunning, cmd.Process.Pid, now, time.Time{}
+	})
+	log.Printf("Supervisor: [%s] started %s (pid %d)", p.spec.Name, p.spec.Command, cmd.Process.Pid)
+
+	err := cmd.Wait()
+	// Worker 自己退出了，它拉起的子进程 (如 Python 生成器) 也不能留下
+	group.reap(s.cfg.StopTimeout)
+	out.flush()
+	return err
+}
+
+// lineLogger writes a child's output into the engine log, one entry per line.
+type lineLogger struct {
+	prefix string
+	buf    []byte
+}
+
+const maxLogLine = 64 * 1024
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Print(l.prefix + string(bytes.TrimRight(l.buf[:i], "\r")))
+		l.buf = l.buf[i+1:]
+	}
+	if len(l.buf) > maxLogLine { // 没有换行的超长输出 (比如进度条) 也要输出
+		l.flush()
+	}
+	return len(p), nil
+}
+
+func (l *lineLogger) flush() {
+	if len(l.buf) > 0 {
+		log.Print(l.prefix + string(l.buf))
+		l.buf = nil
+	}
+}
+
+func exitString(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
@@ -0,0 +1,88 @@
+package infrastructure
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alive reports whether pid is a live (not zombie) process.
+func alive(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// pid (comm) state ...
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// A worker's children must not outlive it, even when they ignore SIGTERM.
+func TestSupervisorKillsProcessGroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		stop   bool // cancel the supervisor rather than let the worker exit
+	}{
+		{"stopped, children ignore SIGTERM", `trap '' TERM; sleep 60 & echo $! > "$PIDFILE"; wait`, true},
+		{"stopped, children exit on SIGTERM", `sleep 60 & echo $! > "$PIDFILE"; wait`, true},
+		{"worker exits, child left behind", `sleep 60 & echo $! > "$PIDFILE"; sleep 0.2`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pidfile := filepath.Join(t.TempDir(), "child.pid")
+			s := NewSupervisor(SupervisorConfig{StopTimeout: 300 * time.Millisecond, MinBackoff: time.Hour})
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			exited := make(chan struct{})
+			s.after = func(d time.Duration) <-chan time.Time {
+				close(exited)
+				return time.After(d)
+			}
+			s.Start(ctx, []ProcessSpec{{Name: "w", Command: "sh", Args: []string{"-c", tt.script}, Env: map[string]string{"PIDFILE": pidfile}}})
+
+			var child int
+			waitForPID := time.Now().Add(5 * time.Second)
+			for child == 0 && time.Now().Before(waitForPID) {
+				if b, err := os.ReadFile(pidfile); err == nil && strings.HasSuffix(string(b), "\n") {
+					child, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if child == 0 {
+				t.Fatal("worker never started its child")
+			}
+
+			if tt.stop {
+				cancel()
+				s.Wait()
+			} else {
+				select {
+				case <-exited:
+				case <-time.After(5 * time.Second):
+					t.Fatal("worker never exited")
+				}
+				defer func() { cancel(); s.Wait() }()
+			}
+			// SIGKILL 是异步的，给内核一点时间
+			for deadline := time.Now().Add(time.Second); alive(child) && time.Now().Before(deadline); {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if alive(child) {
+				killStray(child)
+				t.Fatalf("child %d outlived the worker", child)
+			}
+		})
+	}
+}
+
+func killStray(pid int) {
+	if p, err := os.FindProcess(pid); err == nil {
+		p.Kill()
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package infrastructure
+
+import (
+	"os/exec"
+	"time"
+)
+
+// processGroup: 没有进程组的平台上只能停 Worker 本身 (exec 默认 Kill)
+type processGroup struct{}
+
+func newProcessGroup(cmd *exec.Cmd) *processGroup { return &processGroup{} }
+
+func (g *processGroup) reap(grace time.Duration) {}
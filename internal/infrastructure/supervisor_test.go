@@ -0,0 +1,115 @@
+package infrastructure
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// scriptedSupervisor runs fake processes that live for runs[i] of fake time
+// each, and records every restart delay with the state shown meanwhile.
+type scriptedSupervisor struct {
+	*Supervisor
+	clock  time.Time
+	delays []time.Duration
+	states []string
+}
+
+func newScriptedSupervisor(cfg SupervisorConfig, runs []time.Duration) (*scriptedSupervisor, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &scriptedSupervisor{Supervisor: NewSupervisor(cfg), clock: time.Unix(1700000000, 0)}
+	// run 和 after 都在同一个 goroutine 里调用，不用加锁
+	s.now = func() time.Time { return s.clock }
+	s.after = func(d time.Duration) <-chan time.Time {
+		s.delays = append(s.delays, d)
+		s.states = append(s.states, s.Status()[0].State)
+		s.clock = s.clock.Add(d)
+		ch := make(chan time.Time, 1)
+		ch <- s.clock
+		return ch
+	}
+	s.runProc = func(ctx context.Context, p *process) error {
+		if len(runs) == 0 {
+			cancel()
+			return ctx.Err()
+		}
+		s.clock = s.clock.Add(runs[0])
+		runs = runs[1:]
+		return errors.New("exit status 1")
+	}
+	return s, ctx
+}
+
+func TestSupervisorRestarts(t *testing.T) {
+	cfg := SupervisorConfig{
+		MinBackoff:        time.Second,
+		MaxBackoff:        8 * time.Second,
+		StableAfter:       30 * time.Second,
+		CrashLoopRestarts: 100,
+		CrashLoopWindow:   time.Minute,
+	}
+	tests := []struct {
+		name   string
+		cfg    func(*SupervisorConfig)
+		runs   []time.Duration
+		delays []time.Duration
+		states []string
+	}{
+		{
+			name:   "quick exits double the backoff up to the cap",
+			runs:   []time.Duration{0, 0, 0, 0, 0},
+			delays: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second},
+		},
+		{
+			name:   "a stable run resets the backoff",
+			runs:   []time.Duration{0, 0, 0, 30 * time.Second, 0},
+			delays: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 1 * time.Second, 2 * time.Second},
+		},
+		{
+			name:   "a run just short of stable doesn't",
+			runs:   []time.Duration{0, 0, 29 * time.Second},
+			delays: []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second},
+		},
+		{
+			name:   "crash loop restarts at the cap",
+			cfg:    func(c *SupervisorConfig) { c.CrashLoopRestarts = 3 },
+			runs:   []time.Duration{0, 0, 0, 0},
+			delays: []time.Duration{1 * time.Second, 2 * time.Second, 8 * time.Second, 8 * time.Second},
+			states: []string{ProcBackoff, ProcBackoff, ProcCrashLoop, ProcCrashLoop},
+		},
+		{
+			name: "crash loop ends once exits leave the window",
+			cfg: func(c *SupervisorConfig) {
+				c.CrashLoopRestarts, c.CrashLoopWindow, c.StableAfter = 3, 20*time.Second, time.Hour
+			},
+			// 退出时刻: 0, 1, 3, 31 (前三次都已出窗口)
+			runs:   []time.Duration{0, 0, 0, 20 * time.Second},
+			delays: []time.Duration{1 * time.Second, 2 * time.Second, 8 * time.Second, 8 * time.Second},
+			states: []string{ProcBackoff, ProcBackoff, ProcCrashLoop, ProcBackoff},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := cfg
+			if tt.cfg != nil {
+				tt.cfg(&cfg)
+			}
+			s, ctx := newScriptedSupervisor(cfg, tt.runs)
+			s.Start(ctx, []ProcessSpec{{Name: "w", Command: "worker"}})
+			s.Wait()
+
+			if !slices.Equal(s.delays, tt.delays) {
+				t.Errorf("delays = %v, want %v", s.delays, tt.delays)
+			}
+			if tt.states != nil && !slices.Equal(s.states, tt.states) {
+				t.Errorf("states = %v, want %v", s.states, tt.states)
+			}
+			st := s.Status()[0]
+			if st.Restarts != len(tt.runs) || st.State != ProcStopped || st.LastExit != "exit status 1" {
+				t.Errorf("status = %+v, want %d restarts, stopped after exit status 1", st, len(tt.runs))
+			}
+		})
+	}
+}
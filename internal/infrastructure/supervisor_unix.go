@@ -0,0 +1,58 @@
+//go:build unix
+
+package infrastructure
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// processGroup is the process group a worker runs in, so that stopping it
+// also reaches the processes it spawned (e.g. the Python generator).
+type processGroup struct {
+	cmd *exec.Cmd
+
+	mu       sync.Mutex
+	stopping time.Time // when Cancel sent SIGTERM
+}
+
+// newProcessGroup makes cmd lead a new process group that Cancel sends SIGTERM to.
+func newProcessGroup(cmd *exec.Cmd) *processGroup {
+	g := &processGroup{cmd: cmd}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		g.mu.Lock()
+		g.stopping = time.Now()
+		g.mu.Unlock()
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	}
+	return g
+}
+
+// reap ends what is left of the group once its leader has exited: SIGTERM
+// (unless Cancel already sent it), then SIGKILL to the whole group if it is
+// still there grace after the SIGTERM.
+func (g *processGroup) reap(grace time.Duration) {
+	if g.cmd.Process == nil {
+		return
+	}
+	pgid := -g.cmd.Process.Pid
+	if syscall.Kill(pgid, 0) != nil {
+		return // 组里已经没有进程了
+	}
+	g.mu.Lock()
+	stopping := g.stopping
+	g.mu.Unlock()
+	if stopping.IsZero() {
+		stopping = time.Now()
+		syscall.Kill(pgid, syscall.SIGTERM)
+	}
+	for deadline := stopping.Add(grace); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if syscall.Kill(pgid, 0) != nil {
+			return
+		}
+	}
+	syscall.Kill(pgid, syscall.SIGKILL)
+}
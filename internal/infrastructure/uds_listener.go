@@ -1,34 +1,154 @@
 package infrastructure
 
 import (
+	"crypto/tls"
+	"errors"
+	"log"
 	"net"
-	"os"
+	"sync"
+
+	"infinite-live/internal/pkg/transport"
 )
 
+// UDSServer accepts worker connections. Despite the name it can listen on any
+// mix of transports (Unix socket, TCP/TLS, WebSocket, see package transport);
+// connections from all of them come out of Accept as plain net.Conns.
 type UDSServer struct {
-	listener net.Listener
+	listeners []net.Listener
+	conns     chan net.Conn
+
+	mu        sync.RWMutex
+	allowlist *transport.PeerAllowlist                    // Unix socket peers only (TLS has its own client certs)
+	peerCred  func(net.Conn) (*transport.PeerCred, error) // 测试里替换
+
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
+// NewUDSServer listens on a Unix socket only.
 func NewUDSServer(socketPath string) (*UDSServer, error) {
-	// Cleanup old socket
-	if _, err := os.Stat(socketPath); err == nil {
-		os.Remove(socketPath)
+	return NewServer(nil, socketPath)
+}
+
+// NewServer listens on every address (see transport.ParseAddress).
+// tlsConf is used by tls:// and wss:// addresses.
+func NewServer(tlsConf *tls.Config, addrs ...string) (*UDSServer, error) {
+	return NewServerWith(transport.ListenConfig{TLS: tlsConf}, addrs...)
+}
+
+// NewServerWith is NewServer with socket permissions (see transport.ListenConfig).
+func NewServerWith(cfg transport.ListenConfig, addrs ...string) (*UDSServer, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no listen address")
 	}
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := transport.ListenWith(addr, cfg)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		log.Printf("Worker transport listening on %s", addr)
+		listeners = append(listeners, ln)
+	}
+	return NewServerFromListeners(listeners...), nil
+}
 
-	listener, err := net.Listen("unix", socketPath)
-	if err != nil {
-		return nil, err
+// NewServerFromListeners serves already opened listeners.
+func NewServerFromListeners(listeners ...net.Listener) *UDSServer {
+	s := &UDSServer{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		peerCred:  transport.PeerCredentials,
+		done:      make(chan struct{}),
 	}
+	for _, ln := range listeners {
+		go s.acceptLoop(ln)
+	}
+	return s
+}
 
-	return &UDSServer{
-		listener: listener,
-	}, nil
+func (s *UDSServer) acceptLoop(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			// 单个 transport 挂掉不影响其它 transport；Accept 只在 Close 之后返回错误
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Worker transport %s stopped: %v", ln.Addr(), err)
+			}
+			return
+		}
+		if !s.admit(conn) {
+			conn.Close()
+			continue
+		}
+		select {
+		case s.conns <- conn:
+		case <-s.done:
+			conn.Close()
+			return
+		}
+	}
 }
 
+// SetPeerAllowlist restricts which local processes may connect over Unix
+// sockets (checked with SO_PEERCRED). nil or empty admits everyone.
+func (s *UDSServer) SetPeerAllowlist(a *transport.PeerAllowlist) {
+	s.mu.Lock()
+	s.allowlist = a
+	s.mu.Unlock()
+}
+
+// admit checks a Unix socket peer against the allowlist.
+func (s *UDSServer) admit(conn net.Conn) bool {
+	s.mu.RLock()
+	allow, peerCred := s.allowlist, s.peerCred
+	s.mu.RUnlock()
+	if _, unix := conn.(*net.UnixConn); !unix || allow.Empty() {
+		return true
+	}
+	cred, err := peerCred(conn)
+	if err != nil {
+		log.Printf("Worker transport: rejected Unix peer, cannot read credentials: %v", err)
+		return false
+	}
+	if !allow.Allows(cred) {
+		log.Printf("Worker transport: rejected Unix peer %s (not in allowlist)", cred)
+		return false
+	}
+	return true
+}
+
+// Accept waits for the next worker connection on any transport.
 func (s *UDSServer) Accept() (net.Conn, error) {
-	return s.listener.Accept()
+	select {
+	case conn := <-s.conns:
+		return conn, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Addrs returns the addresses actually bound (useful with port 0).
+func (s *UDSServer) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, ln := range s.listeners {
+		addrs[i] = ln.Addr()
+	}
+	return addrs
 }
 
 func (s *UDSServer) Close() {
-	s.listener.Close()
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for _, ln := range s.listeners {
+			ln.Close()
+		}
+	})
 }
@@ -0,0 +1,85 @@
+package infrastructure
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"infinite-live/internal/pkg/transport"
+)
+
+// The test process dials its own socket, so the peer is us.
+func TestUDSServerPeerAllowlist(t *testing.T) {
+	uid, gid, pid := uint32(os.Getuid()), uint32(os.Getgid()), int32(os.Getpid())
+	unreadable := func(net.Conn) (*transport.PeerCred, error) {
+		return nil, errors.New("SO_PEERCRED: bad file descriptor")
+	}
+	tests := []struct {
+		name     string
+		allow    *transport.PeerAllowlist
+		peerCred func(net.Conn) (*transport.PeerCred, error)
+		admitted bool
+	}{
+		{"no allowlist", nil, nil, true},
+		{"allowlisted uid", &transport.PeerAllowlist{UIDs: []uint32{uid + 1, uid}}, nil, true},
+		{"allowlisted uid, gid and pid", &transport.PeerAllowlist{UIDs: []uint32{uid}, GIDs: []uint32{gid}, PIDs: []int32{pid}}, nil, true},
+		{"rejected uid", &transport.PeerAllowlist{UIDs: []uint32{uid + 1}}, nil, false},
+		{"rejected gid", &transport.PeerAllowlist{GIDs: []uint32{gid + 1}}, nil, false},
+		{"uid allowed, gid rejected", &transport.PeerAllowlist{UIDs: []uint32{uid}, GIDs: []uint32{gid + 1}}, nil, false},
+		{"rejected pid", &transport.PeerAllowlist{PIDs: []int32{pid + 1}}, nil, false},
+		{"unreadable credentials with an allowlist", &transport.PeerAllowlist{UIDs: []uint32{uid}}, unreadable, false},
+		{"unreadable credentials, no allowlist", nil, unreadable, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "engine.sock")
+			s, err := NewUDSServer(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			s.SetPeerAllowlist(tt.allow)
+			if tt.peerCred != nil {
+				s.mu.Lock()
+				s.peerCred = tt.peerCred
+				s.mu.Unlock()
+			}
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if c, err := s.Accept(); err == nil {
+					accepted <- c
+				}
+			}()
+			c, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if tt.admitted {
+				select {
+				case sc := <-accepted:
+					sc.Close()
+				case <-time.After(5 * time.Second):
+					t.Fatal("peer not admitted")
+				}
+				return
+			}
+			// 被拒绝的连接由服务端直接关闭
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+				t.Fatalf("rejected peer read %v, want io.EOF", err)
+			}
+			select {
+			case <-accepted:
+				t.Fatal("rejected peer reached Accept")
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
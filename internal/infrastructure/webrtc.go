@@ -1,33 +1,265 @@
 package infrastructure
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
 	"github.com/pion/webrtc/v4"
 )
 
+// ICEServer is a STUN or TURN server. TURN needs Username and Credential.
+type ICEServer struct {
+	URLs       []string `json:"urls"` // e.g. "stun:10.0.0.2:3478", "turn:10.0.0.2:3478?transport=tcp"
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// WebRTCConfig tunes ICE for networks without (or with restricted) internet access.
+type WebRTCConfig struct {
+	// ICEServers may be empty: on a flat private network host candidates are enough.
+	ICEServers []ICEServer `json:"ice_servers"`
+	// ICETransportPolicy "relay" forces all media through TURN; default "all".
+	ICETransportPolicy string `json:"ice_transport_policy,omitempty"`
+
+	// NAT1To1IPs replaces the host candidate addresses (or adds srflx ones,
+	// see NAT1To1CandidateType) with the public addresses of a 1:1 NAT.
+	NAT1To1IPs           []string `json:"nat_1to1_ips,omitempty"`
+	NAT1To1CandidateType string   `json:"nat_1to1_candidate_type,omitempty"` // "host" (default) or "srflx"
+
+	// UDP port range for ICE, to open in the firewall. 0/0 = any ephemeral port.
+	UDPPortMin uint16 `json:"udp_port_min,omitempty"`
+	UDPPortMax uint16 `json:"udp_port_max,omitempty"`
+
+	// Interface filters (path.Match patterns such as "eth*"). Interfaces, if
+	// set, is an allowlist; ExcludeInterfaces is applied afterwards.
+	Interfaces        []string `json:"interfaces,omitempty"`
+	ExcludeInterfaces []string `json:"exclude_interfaces,omitempty"`
+	// IncludeLoopback gathers 127.0.0.1 / ::1 too (single-box lab setups).
+	IncludeLoopback bool `json:"include_loopback,omitempty"`
+
+	// NetworkTypes limits candidates, e.g. ["udp4", "tcp4"]. Default: UDP,
+	// plus TCP when TCPMuxAddr is set.
+	NetworkTypes []string `json:"network_types,omitempty"`
+
+	// ICELite makes this side an ICE-lite agent (only for servers with a
+	// directly reachable address, see NAT1To1IPs).
+	ICELite bool `json:"ice_lite,omitempty"`
+
+	// TCPMuxAddr serves ICE-TCP for all peer connections on one port, e.g.
+	// ":8443", for firewalls that block UDP. Not opened when NetworkTypes
+	// leaves out tcp.
+	TCPMuxAddr string `json:"tcp_mux_addr,omitempty"`
+}
+
+// DefaultWebRTCConfig uses Google's public STUN server (needs internet access).
+func DefaultWebRTCConfig() WebRTCConfig {
+	return WebRTCConfig{
+		ICEServers: []ICEServer{{URLs: []string{"stun:stun.l.google.com:19302"}}},
+	}
+}
+
+// LoadWebRTCConfig reads a WebRTCConfig from a JSON file.
+func LoadWebRTCConfig(file string) (WebRTCConfig, error) {
+	var cfg WebRTCConfig
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return cfg, err
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %w", file, err)
+	}
+	return cfg, nil
+}
+
 // WebRTCManager handles the creation of PeerConnections
 type WebRTCManager struct {
-	api *webrtc.API
+	api    *webrtc.API
+	config webrtc.Configuration
+	tcpMux net.Listener // nil unless ICE-TCP is on
 }
 
-func NewWebRTCManager() *WebRTCManager {
+// NewWebRTCManager uses DefaultWebRTCConfig.
+func NewWebRTCManager() (*WebRTCManager, error) {
+	return NewWebRTCManagerWith(DefaultWebRTCConfig())
+}
+
+// NewWebRTCManagerWith applies cfg to every peer connection it creates.
+func NewWebRTCManagerWith(cfg WebRTCConfig) (*WebRTCManager, error) {
+	ice, err := cfg.resolve()
+	if err != nil {
+		return nil, err
+	}
 	settingEngine := webrtc.SettingEngine{}
-	
-	// You might need to configure NAT 1:1 IPs here for production
-	// settingEngine.SetNAT1To1IPs([]string{"1.2.3.4"}, webrtc.ICMPTypeCandidate)
+	ice.apply(&settingEngine)
+	m := &WebRTCManager{config: ice.config}
+	if ice.tcpMuxAddr != "" {
+		ln, err := net.Listen("tcp", ice.tcpMuxAddr)
+		if err != nil {
+			return nil, fmt.Errorf("ICE TCP mux: %w", err)
+		}
+		m.tcpMux = ln
+		settingEngine.SetICETCPMux(webrtc.NewICETCPMux(nil, ln, 8))
+		log.Printf("WebRTC: ICE-TCP on %s", ln.Addr())
+	}
+	m.api = webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
+	return m, nil
+}
+
+// iceSettings is a checked WebRTCConfig, resolved into SettingEngine and
+// Configuration values.
+type iceSettings struct {
+	nat1To1IPs      []string
+	nat1To1Type     webrtc.ICECandidateType
+	udpPortMin      uint16
+	udpPortMax      uint16
+	interfaceFilter func(string) bool // nil: every interface
+	includeLoopback bool
+	lite            bool
+	networkTypes    []webrtc.NetworkType
+	tcpMuxAddr      string // "" when ICE-TCP is off
+	config          webrtc.Configuration
+}
+
+// resolve checks cfg up front, so mistakes fail at startup rather than
+// during candidate gathering (or, for a typo in a policy, not at all).
+func (cfg WebRTCConfig) resolve() (iceSettings, error) {
+	s := iceSettings{udpPortMin: cfg.UDPPortMin, udpPortMax: cfg.UDPPortMax, includeLoopback: cfg.IncludeLoopback, lite: cfg.ICELite}
+
+	stun := false
+	for _, srv := range cfg.ICEServers {
+		if len(srv.URLs) == 0 {
+			return s, fmt.Errorf("ice_servers: server without urls")
+		}
+		for _, u := range srv.URLs {
+			switch {
+			case strings.HasPrefix(u, "stun:"), strings.HasPrefix(u, "stuns:"):
+				stun = true
+			case strings.HasPrefix(u, "turn:"), strings.HasPrefix(u, "turns:"):
+				if srv.Username == "" || srv.Credential == "" {
+					return s, fmt.Errorf("ice_servers: %s needs username and credential", u)
+				}
+			default:
+				return s, fmt.Errorf("ice_servers: %q is not a stun: or turn: URL", u)
+			}
+		}
+		server := webrtc.ICEServer{URLs: srv.URLs}
+		if srv.Username != "" || srv.Credential != "" {
+			server.Username, server.Credential = srv.Username, srv.Credential
+		}
+		s.config.ICEServers = append(s.config.ICEServers, server)
+	}
+	// NewICETransportPolicy 把不认识的值当成 "all"，拼错 relay 就会悄悄绕过 TURN
+	switch cfg.ICETransportPolicy {
+	case "", "all":
+		s.config.ICETransportPolicy = webrtc.ICETransportPolicyAll
+	case "relay":
+		s.config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return s, fmt.Errorf("ice_transport_policy must be all or relay, got %q", cfg.ICETransportPolicy)
+	}
+
+	if len(cfg.NAT1To1IPs) > 0 {
+		for _, mapping := range cfg.NAT1To1IPs {
+			// "公网IP" 或 "公网IP/内网IP"
+			for _, ip := range strings.Split(mapping, "/") {
+				if net.ParseIP(ip) == nil {
+					return s, fmt.Errorf("nat_1to1_ips: %q is not an IP address", mapping)
+				}
+			}
+		}
+		s.nat1To1IPs, s.nat1To1Type = cfg.NAT1To1IPs, webrtc.ICECandidateTypeHost
+		switch cfg.NAT1To1CandidateType {
+		case "", "host":
+		case "srflx":
+			// pion 在收集候选时才会报错，这里提前拒绝
+			if stun {
+				return s, fmt.Errorf("nat_1to1_candidate_type srflx replaces STUN: remove the stun: servers")
+			}
+			s.nat1To1Type = webrtc.ICECandidateTypeSrflx
+		default:
+			return s, fmt.Errorf("nat_1to1_candidate_type must be host or srflx, got %q", cfg.NAT1To1CandidateType)
+		}
+	}
+
+	if (cfg.UDPPortMin != 0 || cfg.UDPPortMax != 0) && (cfg.UDPPortMin == 0 || cfg.UDPPortMax < cfg.UDPPortMin) {
+		return s, fmt.Errorf("udp port range %d-%d is invalid", cfg.UDPPortMin, cfg.UDPPortMax)
+	}
+
+	if len(cfg.Interfaces) > 0 || len(cfg.ExcludeInterfaces) > 0 {
+		for _, p := range append(append([]string(nil), cfg.Interfaces...), cfg.ExcludeInterfaces...) {
+			if _, err := path.Match(p, ""); err != nil {
+				return s, fmt.Errorf("bad interface pattern %q: %w", p, err)
+			}
+		}
+		s.interfaceFilter = func(name string) bool {
+			return (len(cfg.Interfaces) == 0 || matchAny(cfg.Interfaces, name)) && !matchAny(cfg.ExcludeInterfaces, name)
+		}
+	}
+
+	s.networkTypes = []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	if cfg.TCPMuxAddr != "" {
+		s.networkTypes = append(s.networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+	}
+	if len(cfg.NetworkTypes) > 0 {
+		s.networkTypes = s.networkTypes[:0]
+		for _, n := range cfg.NetworkTypes {
+			t, err := webrtc.NewNetworkType(n)
+			if err != nil {
+				return s, fmt.Errorf("network_types: %w", err)
+			}
+			s.networkTypes = append(s.networkTypes, t)
+		}
+	}
+	if cfg.TCPMuxAddr != "" {
+		tcp := func(t webrtc.NetworkType) bool { return t == webrtc.NetworkTypeTCP4 || t == webrtc.NetworkTypeTCP6 }
+		if slices.ContainsFunc(s.networkTypes, tcp) {
+			s.tcpMuxAddr = cfg.TCPMuxAddr
+		} else {
+			log.Printf("WebRTC: network_types has no tcp, tcp_mux_addr %s not opened", cfg.TCPMuxAddr)
+		}
+	}
+	return s, nil
+}
 
-	api := webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
-	return &WebRTCManager{
-		api: api,
+// apply sets everything but the ICE-TCP mux, which needs a listener.
+func (s iceSettings) apply(se *webrtc.SettingEngine) {
+	if len(s.nat1To1IPs) > 0 {
+		se.SetNAT1To1IPs(s.nat1To1IPs, s.nat1To1Type)
+	}
+	if s.udpPortMin != 0 {
+		se.SetEphemeralUDPPortRange(s.udpPortMin, s.udpPortMax) // resolve 已经检查过范围
+	}
+	if s.interfaceFilter != nil {
+		se.SetInterfaceFilter(s.interfaceFilter)
 	}
+	se.SetIncludeLoopbackCandidate(s.includeLoopback)
+	se.SetLite(s.lite)
+	se.SetNetworkTypes(s.networkTypes)
 }
 
 func (m *WebRTCManager) NewPeerConnection() (*webrtc.PeerConnection, error) {
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-	return m.api.NewPeerConnection(config)
+	return m.api.NewPeerConnection(m.config)
+}
+
+// Close releases the ICE-TCP port.
+func (m *WebRTCManager) Close() error {
+	if m.tcpMux != nil {
+		return m.tcpMux.Close()
+	}
+	return nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
 }
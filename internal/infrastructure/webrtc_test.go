@@ -0,0 +1,206 @@
+package infrastructure
+
+import (
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+func TestWebRTCConfigResolve(t *testing.T) {
+	udp := []webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6}
+	tests := []struct {
+		name   string
+		cfg    WebRTCConfig
+		err    string // substring; "" means valid
+		check  func(t *testing.T, s iceSettings)
+		ifaces map[string]bool // interface name -> gathered
+	}{
+		{
+			name: "defaults",
+			cfg:  DefaultWebRTCConfig(),
+			check: func(t *testing.T, s iceSettings) {
+				if len(s.config.ICEServers) != 1 || s.config.ICETransportPolicy != webrtc.ICETransportPolicyAll {
+					t.Errorf("config = %+v", s.config)
+				}
+				if !slices.Equal(s.networkTypes, udp) || s.tcpMuxAddr != "" || s.interfaceFilter != nil || len(s.nat1To1IPs) != 0 {
+					t.Errorf("settings = %+v", s)
+				}
+			},
+		},
+		{
+			name: "offline lab",
+			cfg:  WebRTCConfig{ICEServers: []ICEServer{}, IncludeLoopback: true, UDPPortMin: 40000, UDPPortMax: 40100},
+			check: func(t *testing.T, s iceSettings) {
+				if len(s.config.ICEServers) != 0 || !s.includeLoopback || s.udpPortMin != 40000 || s.udpPortMax != 40100 {
+					t.Errorf("settings = %+v", s)
+				}
+			},
+		},
+		{
+			name: "TURN relay only",
+			cfg: WebRTCConfig{
+				ICEServers:         []ICEServer{{URLs: []string{"turn:10.0.0.2:3478?transport=tcp"}, Username: "u", Credential: "p"}},
+				ICETransportPolicy: "relay",
+			},
+			check: func(t *testing.T, s iceSettings) {
+				srv := s.config.ICEServers[0]
+				if s.config.ICETransportPolicy != webrtc.ICETransportPolicyRelay || srv.Username != "u" || srv.Credential != "p" {
+					t.Errorf("config = %+v", s.config)
+				}
+			},
+		},
+		{name: "policy typo", cfg: WebRTCConfig{ICETransportPolicy: "realy"}, err: "ice_transport_policy"},
+		{name: "TURN without credentials", cfg: WebRTCConfig{ICEServers: []ICEServer{{URLs: []string{"turn:10.0.0.2"}}}}, err: "username and credential"},
+		{name: "not an ICE URL", cfg: WebRTCConfig{ICEServers: []ICEServer{{URLs: []string{"10.0.0.2:3478"}}}}, err: "not a stun: or turn: URL"},
+		{
+			name: "NAT 1:1 host",
+			cfg:  WebRTCConfig{NAT1To1IPs: []string{"203.0.113.7", "203.0.113.8/10.0.0.8"}},
+			check: func(t *testing.T, s iceSettings) {
+				if len(s.nat1To1IPs) != 2 || s.nat1To1Type != webrtc.ICECandidateTypeHost {
+					t.Errorf("nat = %v %v", s.nat1To1IPs, s.nat1To1Type)
+				}
+			},
+		},
+		{
+			name: "NAT 1:1 srflx without STUN",
+			cfg:  WebRTCConfig{NAT1To1IPs: []string{"203.0.113.7"}, NAT1To1CandidateType: "srflx"},
+			check: func(t *testing.T, s iceSettings) {
+				if s.nat1To1Type != webrtc.ICECandidateTypeSrflx {
+					t.Errorf("nat type = %v", s.nat1To1Type)
+				}
+			},
+		},
+		{
+			name: "NAT 1:1 srflx with STUN",
+			cfg:  WebRTCConfig{ICEServers: DefaultWebRTCConfig().ICEServers, NAT1To1IPs: []string{"203.0.113.7"}, NAT1To1CandidateType: "srflx"},
+			err:  "remove the stun: servers",
+		},
+		{name: "NAT 1:1 relay", cfg: WebRTCConfig{NAT1To1IPs: []string{"203.0.113.7"}, NAT1To1CandidateType: "relay"}, err: "host or srflx"},
+		{name: "NAT 1:1 not an IP", cfg: WebRTCConfig{NAT1To1IPs: []string{"example.com"}}, err: "not an IP"},
+		{name: "port range reversed", cfg: WebRTCConfig{UDPPortMin: 50000, UDPPortMax: 40000}, err: "udp port range"},
+		{name: "port range half open", cfg: WebRTCConfig{UDPPortMax: 40000}, err: "udp port range"},
+		{
+			name:   "interface filters",
+			cfg:    WebRTCConfig{Interfaces: []string{"eth*", "lo"}, ExcludeInterfaces: []string{"eth9"}},
+			ifaces: map[string]bool{"eth0": true, "eth9": false, "lo": true, "docker0": false},
+		},
+		{
+			name:   "exclude only",
+			cfg:    WebRTCConfig{ExcludeInterfaces: []string{"docker*", "veth*"}},
+			ifaces: map[string]bool{"eth0": true, "docker0": false, "veth12ab": false},
+		},
+		{name: "bad interface pattern", cfg: WebRTCConfig{Interfaces: []string{"eth["}}, err: "bad interface pattern"},
+		{
+			name: "TCP mux adds TCP",
+			cfg:  WebRTCConfig{TCPMuxAddr: "127.0.0.1:0"},
+			check: func(t *testing.T, s iceSettings) {
+				want := append(slices.Clone(udp), webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+				if !slices.Equal(s.networkTypes, want) || s.tcpMuxAddr != "127.0.0.1:0" {
+					t.Errorf("network types = %v, tcp mux %q", s.networkTypes, s.tcpMuxAddr)
+				}
+			},
+		},
+		{
+			name: "TCP mux left out by network types",
+			cfg:  WebRTCConfig{TCPMuxAddr: "127.0.0.1:0", NetworkTypes: []string{"udp4"}},
+			check: func(t *testing.T, s iceSettings) {
+				if !slices.Equal(s.networkTypes, []webrtc.NetworkType{webrtc.NetworkTypeUDP4}) || s.tcpMuxAddr != "" {
+					t.Errorf("network types = %v, tcp mux %q", s.networkTypes, s.tcpMuxAddr)
+				}
+			},
+		},
+		{name: "bad network type", cfg: WebRTCConfig{NetworkTypes: []string{"sctp"}}, err: "network_types"},
+		{
+			name: "ICE lite",
+			cfg:  WebRTCConfig{ICELite: true, NAT1To1IPs: []string{"203.0.113.7"}},
+			check: func(t *testing.T, s iceSettings) {
+				if !s.lite {
+					t.Error("lite not set")
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := tt.cfg.resolve()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				if _, err := NewWebRTCManagerWith(tt.cfg); err == nil {
+					t.Fatal("NewWebRTCManagerWith accepted the config")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.check != nil {
+				tt.check(t, s)
+			}
+			for name, want := range tt.ifaces {
+				if got := s.interfaceFilter(name); got != want {
+					t.Errorf("interface %s gathered = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+// Offline, on loopback only: the candidates gathered honour the port range.
+func TestWebRTCManagerGathersOffline(t *testing.T) {
+	m, err := NewWebRTCManagerWith(WebRTCConfig{
+		IncludeLoopback: true,
+		Interfaces:      []string{"lo*"},
+		NetworkTypes:    []string{"udp4"},
+		UDPPortMin:      41000,
+		UDPPortMax:      41100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	pc, err := m.NewPeerConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if _, err := pc.CreateDataChannel("probe", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-gathered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gathering never completed")
+	}
+
+	var candidates int
+	for _, line := range strings.Split(pc.LocalDescription().SDP, "\n") {
+		// a=candidate:<foundation> <component> <proto> <priority> <ip> <port> typ <type>
+		f := strings.Fields(strings.TrimPrefix(strings.TrimSpace(line), "a=candidate:"))
+		if !strings.HasPrefix(line, "a=candidate:") || len(f) < 8 {
+			continue
+		}
+		candidates++
+		port, _ := strconv.Atoi(f[5])
+		if ip := net.ParseIP(f[4]); ip == nil || !ip.IsLoopback() || port < 41000 || port > 41100 || f[7] != "host" {
+			t.Errorf("unexpected candidate %s", strings.TrimSpace(line))
+		}
+	}
+	if candidates == 0 {
+		t.Fatal("no candidates gathered")
+	}
+}
@@ -0,0 +1,318 @@
+package infrastructure
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+var (
+	// ErrNoWorker is returned when no connected worker matches a route.
+	ErrNoWorker = errors.New("no worker available")
+	// ErrWorkerNotFound is returned when a route names a worker that is not connected.
+	ErrWorkerNotFound = errors.New("worker not found")
+	// ErrNoUtterance is returned when cancelling a stream that has no open utterance.
+	ErrNoUtterance = errors.New("no open utterance")
+
+	// errWorkerBusy means every worker a route matches is busy (see pickIdleLocked).
+	errWorkerBusy = errors.New("worker busy")
+)
+
+// RoutePolicy picks one worker among the candidates of a Route.
+type RoutePolicy int
+
+const (
+	RouteRoundRobin RoutePolicy = iota // Rotate through the candidates
+	RouteLeastBusy                     // Fewest open utterances + unanswered comments
+)
+
+func (p RoutePolicy) String() string {
+	switch p {
+	case RouteRoundRobin:
+		return "round_robin"
+	case RouteLeastBusy:
+		return "least_busy"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseRoutePolicy is the inverse of RoutePolicy.String.
+func ParseRoutePolicy(s string) (RoutePolicy, error) {
+	switch s {
+	case "round_robin", "":
+		return RouteRoundRobin, nil
+	case "least_busy":
+		return RouteLeastBusy, nil
+	}
+	return 0, fmt.Errorf("unknown route policy %q", s)
+}
+
+// Route selects the worker an outbound command goes to.
+// WorkerID wins if set; otherwise Role filters the candidates and Policy picks one.
+type Route struct {
+	WorkerID string
+	Role     string
+	Policy   RoutePolicy
+}
+
+// WorkerInfo is a snapshot of a connected worker.
+type WorkerInfo struct {
+	ID          string    `json:"id"`
+	Role        string    `json:"role"`
+	Version     int       `json:"version"`
+	Codecs      []string  `json:"codecs"`
+	Features    []string  `json:"features"` // Negotiated, not just requested
+	Width       int       `json:"width,omitempty"`
+	Height      int       `json:"height,omitempty"`
+	FPS         int       `json:"fps,omitempty"`
+	Session     string    `json:"session"`
+	Remote      string    `json:"remote"`
+	ConnectedAt time.Time `json:"connected_at"`
+
+	ActiveUtterances int `json:"active_utterances"`
+	PendingComments  int `json:"pending_comments"`
+
+	// Health (see health.go)
+	Healthy      bool      `json:"healthy"`
+	HealthReason string    `json:"health_reason,omitempty"`
+	LastSeen     time.Time `json:"last_seen"`
+	RTTMillis    int64     `json:"rtt_ms,omitempty"` // Last heartbeat round trip
+	Stalls       uint64    `json:"stalls"`
+}
+
+// Has reports whether the worker negotiated the feature.
+func (w *WorkerInfo) Has(feature string) bool {
+	for _, f := range w.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// workerConn is one registered worker connection.
+type workerConn struct {
+	conn  net.Conn
+	recID uint32 // connection number in the session recording
+
+	writeMu sync.Mutex // 写端可能来自多个 goroutine (HTTP handler 等)，保证包不交错
+	writer  *protocol.Writer
+
+	// Lock order: UDSBroadcaster.mu before workerConn.mu
+	mu         sync.Mutex
+	info       WorkerInfo                 // identity fields (ID, Role, Features...) never change and may be read without mu
+	utterances map[uint32]*utteranceState // open utterances by stream ID
+	cancelled  map[uint32]bool            // streams whose utterance the engine cancelled; late media is dropped
+	pingSeq    uint64
+	lastPing   time.Time
+	stalled    bool // unhealthy because of a stall (cleared by new media)
+}
+
+// snapshot copies the worker's info.
+func (w *workerConn) snapshot() WorkerInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	info := w.info
+	info.ActiveUtterances = len(w.utterances)
+	return info
+}
+
+func (w *workerConn) load() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.utterances) + w.info.PendingComments
+}
+
+func (w *workerConn) healthy() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.info.Healthy
+}
+
+func (w *workerConn) send(pktType byte, payload []byte) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	return w.writer.WritePacket(pktType, payload)
+}
+
+// register adds a worker. A worker reconnecting under the same ID replaces
+// (and disconnects) its stale connection.
+func (b *UDSBroadcaster) register(w *workerConn) {
+	b.mu.Lock()
+	old := b.workers[w.info.ID]
+	b.workers[w.info.ID] = w
+	b.mu.Unlock()
+	if old != nil {
+		log.Printf("Broadcaster: worker %s reconnected, dropping stale connection from %s", w.info.ID, old.snapshot().Remote)
+		old.conn.Close()
+	}
+	b.queue.pump() // 评论可能在等 Worker
+}
+
+func (b *UDSBroadcaster) unregister(w *workerConn) {
+	b.mu.Lock()
+	if b.workers[w.info.ID] == w {
+		delete(b.workers, w.info.ID)
+	}
+	b.mu.Unlock()
+}
+
+// Workers returns the connected workers ordered by ID.
+func (b *UDSBroadcaster) Workers() []WorkerInfo {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	out := make([]WorkerInfo, 0, len(b.workers))
+	for _, w := range b.workers {
+		out = append(out, w.snapshot())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Worker returns the worker with the given ID.
+func (b *UDSBroadcaster) Worker(id string) (WorkerInfo, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	w, ok := b.workers[id]
+	if !ok {
+		return WorkerInfo{}, false
+	}
+	return w.snapshot(), true
+}
+
+// SetDefaultRoute sets the route used by SendToWorker.
+func (b *UDSBroadcaster) SetDefaultRoute(r Route) {
+	b.mu.Lock()
+	b.defaultRoute = r
+	b.mu.Unlock()
+}
+
+// Pick resolves a route to a worker without sending anything, e.g. to choose
+// the payload format from the worker's features before calling SendTo.
+func (b *UDSBroadcaster) Pick(r Route) (WorkerInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	w, err := b.pickLocked(r)
+	if err != nil {
+		return WorkerInfo{}, err
+	}
+	return w.snapshot(), nil
+}
+
+func (b *UDSBroadcaster) pickLocked(r Route) (*workerConn, error) {
+	return b.pickIdleLocked(r, nil)
+}
+
+// pickIdleLocked is pickLocked skipping the workers busy reports (nil: none).
+// It returns errWorkerBusy when the route only matches busy workers.
+func (b *UDSBroadcaster) pickIdleLocked(r Route, busy func(workerID string) bool) (*workerConn, error) {
+	if r.WorkerID != "" {
+		w, ok := b.workers[r.WorkerID]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrWorkerNotFound, r.WorkerID)
+		}
+		if busy != nil && busy(w.info.ID) {
+			return nil, errWorkerBusy
+		}
+		return w, nil
+	}
+
+	// 优先健康的 Worker；全都不健康时仍然发送，否则卡住的 Worker 永远没机会恢复
+	var healthy, unhealthy []*workerConn
+	for _, w := range b.workers {
+		if r.Role != "" && w.info.Role != r.Role {
+			continue
+		}
+		if w.healthy() {
+			healthy = append(healthy, w)
+		} else {
+			unhealthy = append(unhealthy, w)
+		}
+	}
+	candidates := healthy
+	if len(candidates) == 0 {
+		candidates = unhealthy
+	}
+	if len(candidates) == 0 {
+		if r.Role != "" {
+			return nil, fmt.Errorf("%w (role=%s)", ErrNoWorker, r.Role)
+		}
+		return nil, ErrNoWorker
+	}
+	if busy != nil {
+		// 健康的都忙时等它们，不退到不健康的 Worker 上
+		idle := candidates[:0:0]
+		for _, w := range candidates {
+			if !busy(w.info.ID) {
+				idle = append(idle, w)
+			}
+		}
+		if len(idle) == 0 {
+			return nil, errWorkerBusy
+		}
+		candidates = idle
+	}
+	// map 遍历无序，按 ID 排序保证轮询稳定
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].info.ID < candidates[j].info.ID })
+
+	b.rrNext++
+	switch r.Policy {
+	case RouteLeastBusy:
+		best := candidates[b.rrNext%len(candidates)] // 负载相同时也轮换
+		bestLoad := best.load()
+		for _, w := range candidates {
+			if l := w.load(); l < bestLoad {
+				best, bestLoad = w, l
+			}
+		}
+		return best, nil
+	default:
+		return candidates[b.rrNext%len(candidates)], nil
+	}
+}
+
+// Send routes a packet to one worker and returns the worker's ID.
+func (b *UDSBroadcaster) Send(r Route, pktType byte, payload []byte) (string, error) {
+	b.mu.Lock()
+	w, err := b.pickLocked(r)
+	b.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	return w.info.ID, b.sendTo(w, pktType, payload)
+}
+
+// SendTo sends a packet to the given worker.
+func (b *UDSBroadcaster) SendTo(workerID string, pktType byte, payload []byte) error {
+	_, err := b.Send(Route{WorkerID: workerID}, pktType, payload)
+	return err
+}
+
+// SendToWorker sends a packet along the default route (round robin over all workers unless changed).
+func (b *UDSBroadcaster) SendToWorker(pktType byte, payload []byte) error {
+	b.mu.RLock()
+	r := b.defaultRoute
+	b.mu.RUnlock()
+	_, err := b.Send(r, pktType, payload)
+	return err
+}
+
+func (b *UDSBroadcaster) sendTo(w *workerConn, pktType byte, payload []byte) error {
+	if err := w.send(pktType, payload); err != nil {
+		return err
+	}
+	b.record(protocol.DirOutbound, w.recID, &protocol.Frame{Type: pktType, Payload: payload})
+	if pktType == protocol.PacketTypeComment || pktType == protocol.PacketTypeText {
+		w.mu.Lock()
+		w.info.PendingComments++
+		w.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package infrastructure
+
+import (
+	"errors"
+	"testing"
+)
+
+func testWorker(id, role string, pending int, healthy bool) *workerConn {
+	return &workerConn{
+		info:       WorkerInfo{ID: id, Role: role, PendingComments: pending, Healthy: healthy},
+		utterances: make(map[uint32]*utteranceState),
+	}
+}
+
+func TestPick(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers []*workerConn
+		route   Route
+		want    []string // successive picks
+		err     error
+	}{
+		{
+			name:    "round robin in ID order",
+			workers: []*workerConn{testWorker("b", "", 0, true), testWorker("a", "", 0, true), testWorker("c", "", 0, true)},
+			want:    []string{"b", "c", "a", "b"},
+		},
+		{
+			name:    "least busy",
+			workers: []*workerConn{testWorker("a", "", 2, true), testWorker("b", "", 0, true), testWorker("c", "", 1, true)},
+			route:   Route{Policy: RouteLeastBusy},
+			want:    []string{"b", "b"},
+		},
+		{
+			name:    "role",
+			workers: []*workerConn{testWorker("a", "announcer", 0, true), testWorker("b", "dialog", 0, true)},
+			route:   Route{Role: "dialog"},
+			want:    []string{"b", "b"},
+		},
+		{
+			name:    "healthy first",
+			workers: []*workerConn{testWorker("a", "", 0, false), testWorker("b", "", 0, true)},
+			want:    []string{"b", "b"},
+		},
+		{
+			name:    "unhealthy rather than nothing",
+			workers: []*workerConn{testWorker("a", "", 0, false)},
+			want:    []string{"a"},
+		},
+		{
+			name:    "explicit worker",
+			workers: []*workerConn{testWorker("a", "", 0, true), testWorker("b", "", 0, true)},
+			route:   Route{WorkerID: "a"},
+			want:    []string{"a", "a"},
+		},
+		{
+			name:    "unknown worker",
+			workers: []*workerConn{testWorker("a", "", 0, true)},
+			route:   Route{WorkerID: "x"},
+			err:     ErrWorkerNotFound,
+		},
+		{
+			name:    "no worker with the role",
+			workers: []*workerConn{testWorker("a", "dialog", 0, true)},
+			route:   Route{Role: "announcer"},
+			err:     ErrNoWorker,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewUDSBroadcaster(nil)
+			for _, w := range tt.workers {
+				b.workers[w.info.ID] = w
+			}
+			if tt.err != nil {
+				if _, err := b.Pick(tt.route); !errors.Is(err, tt.err) {
+					t.Fatalf("err = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			for i, want := range tt.want {
+				got, err := b.Pick(tt.route)
+				if err != nil || got.ID != want {
+					t.Fatalf("pick %d = %q, %v; want %q", i, got.ID, err, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,392 @@
+// Package handoff lets the engine restart without closing its listening
+// sockets.
+//
+// On start, Inherit picks up sockets passed in by systemd socket activation
+// (LISTEN_FDS, fds 3..) or by a previous engine process. Listen then serves
+// an inherited socket when one is bound to the requested address and opens a
+// new one otherwise; either way the socket is remembered for the next handoff.
+//
+// Upgrade execs a fresh copy of the binary with the same arguments and passes
+// every remembered socket to it. The child calls Ready once it is able to
+// serve (assets loaded, listeners up); Upgrade returns then and the old
+// process drains and exits. Connections keep queueing in the kernel backlog
+// in between, so clients see a slow accept, not a refused one.
+//
+// What the two processes can't run side by side (e.g. supervised workers that
+// connect under fixed IDs) the child starts only once Released fires: when the
+// old process calls Release or exits.
+//
+// Under systemd prefer a .socket unit and a plain restart: systemd keeps the
+// sockets open itself, and it would not follow a child exec'd by Upgrade.
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment shared with the child. LISTEN_FDS / LISTEN_PID / LISTEN_FDNAMES
+// follow sd_listen_fds(3); HANDOFF_READY_FD is the pipe Ready writes to and
+// HANDOFF_RELEASE_FD the pipe the parent closes in Release.
+const (
+	envListenFDs   = "LISTEN_FDS"
+	envListenPID   = "LISTEN_PID"
+	envListenNames = "LISTEN_FDNAMES"
+	envReadyFD     = "HANDOFF_READY_FD"
+	envReleaseFD   = "HANDOFF_RELEASE_FD"
+
+	firstFD = 3
+)
+
+// ErrUpgradeInProgress is returned by Upgrade while another upgrade runs.
+var ErrUpgradeInProgress = errors.New("handoff: upgrade already in progress")
+
+// filer is implemented by *net.TCPListener and *net.UnixListener.
+type filer interface {
+	File() (*os.File, error)
+}
+
+type entry struct {
+	network string
+	address string
+	ln      net.Listener
+}
+
+// Listeners tracks the sockets of this process. It implements transport.ListenerSource.
+type Listeners struct {
+	mu        sync.Mutex
+	inherited []net.Listener
+	active    []entry
+	ready     *os.File // readiness pipe to the parent, nil when not started by Upgrade
+	upgrading bool
+
+	released chan struct{} // closed once the parent let go (see Released)
+	release  *os.File      // write end of the child's release pipe, after a successful Upgrade
+}
+
+// Inherit collects the sockets passed to this process and clears the
+// environment variables describing them, so they are not inherited twice.
+func Inherit() (*Listeners, error) {
+	l := &Listeners{released: make(chan struct{})}
+	defer func() {
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenPID)
+		os.Unsetenv(envListenNames)
+		os.Unsetenv(envReadyFD)
+		os.Unsetenv(envReleaseFD)
+	}()
+
+	if v := os.Getenv(envReadyFD); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("handoff: bad %s %q", envReadyFD, v)
+		}
+		l.ready = os.NewFile(uintptr(fd), "handoff-ready")
+	}
+	if v := os.Getenv(envReleaseFD); v != "" {
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("handoff: bad %s %q", envReleaseFD, v)
+		}
+		// 父进程调用 Release 或退出时这里读到 EOF
+		f := os.NewFile(uintptr(fd), "handoff-release")
+		go func() {
+			io.Copy(io.Discard, f)
+			f.Close()
+			close(l.released)
+		}()
+	} else {
+		close(l.released)
+	}
+
+	v := os.Getenv(envListenFDs)
+	if v == "" {
+		return l, nil
+	}
+	// systemd 会设置 LISTEN_PID；Upgrade 在 exec 前不知道子进程 PID，所以不设
+	if pid := os.Getenv(envListenPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return l, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("handoff: bad %s %q", envListenFDs, v)
+	}
+	for fd := firstFD; fd < firstFD+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listen-fd-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener dups the fd
+		if err != nil {
+			l.closeInherited()
+			return nil, fmt.Errorf("handoff: fd %d is not a listening socket: %w", fd, err)
+		}
+		log.Printf("handoff: inherited listener %s %s", ln.Addr().Network(), ln.Addr())
+		l.inherited = append(l.inherited, ln)
+	}
+	return l, nil
+}
+
+// TakingOver reports whether a previous process started this one with Upgrade
+// and is waiting for Ready.
+func (l *Listeners) TakingOver() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ready != nil
+}
+
+// Listen returns the inherited listener bound to network/address, or else
+// the one opened by open, and remembers it for the next Upgrade.
+func (l *Listeners) Listen(network, address string, open func() (net.Listener, error)) (net.Listener, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, ln := range l.inherited {
+		if sameAddr(ln.Addr(), network, address) {
+			l.inherited = append(l.inherited[:i], l.inherited[i+1:]...)
+			l.active = append(l.active, entry{network: network, address: address, ln: ln})
+			return ln, true, nil
+		}
+	}
+	ln, err := open()
+	if err != nil {
+		return nil, false, err
+	}
+	l.active = append(l.active, entry{network: network, address: address, ln: ln})
+	return ln, false, nil
+}
+
+// CloseUnused closes inherited sockets nobody asked for (e.g. a listen
+// address removed from the configuration).
+func (l *Listeners) CloseUnused() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ln := range l.inherited {
+		log.Printf("handoff: closing unused inherited listener %s", ln.Addr())
+	}
+	l.closeInherited()
+}
+
+func (l *Listeners) closeInherited() {
+	for _, ln := range l.inherited {
+		ln.Close()
+	}
+	l.inherited = nil
+}
+
+// Ready tells the parent that started this process with Upgrade to hand
+// over. It is a no-op otherwise.
+func (l *Listeners) Ready() error {
+	l.mu.Lock()
+	f := l.ready
+	l.ready = nil
+	l.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	defer f.Close()
+	_, err := f.Write([]byte("ready\n"))
+	return err
+}
+
+// Released is closed once the process that started this one with Upgrade has
+// called Release or exited; it is closed from the start otherwise.
+func (l *Listeners) Released() <-chan struct{} {
+	return l.released
+}
+
+// Release tells the process started by a successful Upgrade that this one
+// has let go of what the two can't share. Exiting does the same.
+func (l *Listeners) Release() {
+	l.mu.Lock()
+	f := l.release
+	l.release = nil
+	l.mu.Unlock()
+	if f != nil {
+		f.Close()
+	}
+}
+
+// Upgrade starts a new copy of this binary with all active sockets and waits
+// until it calls Ready. On success the caller should stop accepting, drain and
+// exit; the sockets stay open in the child. On error the child (if any) is
+// killed and this process carries on serving.
+func (l *Listeners) Upgrade(timeout time.Duration) error {
+	l.mu.Lock()
+	if l.upgrading {
+		l.mu.Unlock()
+		return ErrUpgradeInProgress
+	}
+	l.upgrading = true
+	active := append([]entry(nil), l.active...)
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.upgrading = false
+		l.mu.Unlock()
+	}()
+
+	files := make([]*os.File, 0, len(active)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, e := range active {
+		fl, ok := e.ln.(filer)
+		if !ok {
+			return fmt.Errorf("handoff: listener %s cannot be passed on", e.ln.Addr())
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("handoff: %s: %w", e.ln.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+	releaseR, releaseW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if releaseW != nil {
+			releaseW.Close()
+		}
+	}()
+	files = append(files, releaseR)
+
+	exe, err := executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(childEnv(),
+		envListenFDs+"="+strconv.Itoa(len(active)),
+		envReadyFD+"="+strconv.Itoa(firstFD+len(active)),
+		envReleaseFD+"="+strconv.Itoa(firstFD+len(active)+1),
+	)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("handoff: start %s: %w", exe, err)
+	}
+	readyW.Close() // 只留子进程持有写端，子进程退出时这里读到 EOF
+	files = files[:len(files)-2]
+	releaseR.Close()
+	log.Printf("handoff: started %s (pid %d) with %d listeners, waiting for it to be ready", exe, cmd.Process.Pid, len(active))
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 16)
+		n, err := readyR.Read(buf)
+		if n > 0 {
+			err = nil
+		} else if err == io.EOF {
+			err = errors.New("child closed the readiness pipe without signalling")
+		}
+		ready <- err
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return fmt.Errorf("handoff: %w", err)
+		}
+	case err := <-exited:
+		return fmt.Errorf("handoff: child exited before it was ready: %v", err)
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("handoff: child not ready after %v", timeout)
+	}
+
+	// 子进程接手了：关闭本进程的 Unix socket 时不能把文件删掉
+	for _, e := range active {
+		if ul, ok := e.ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	l.mu.Lock()
+	l.release, releaseW = releaseW, nil
+	l.mu.Unlock()
+	log.Printf("handoff: pid %d is ready and serving", cmd.Process.Pid)
+	return nil
+}
+
+// executable resolves the binary to exec. os.Args[0] is preferred over
+// /proc/self/exe so a binary replaced on disk (mv new over old) is picked up.
+func executable() (string, error) {
+	if p, err := exec.LookPath(os.Args[0]); err == nil {
+		return filepath.Abs(p)
+	}
+	return os.Executable()
+}
+
+func childEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		name := kv
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			name = kv[:i]
+		}
+		switch name {
+		case envListenFDs, envListenPID, envListenNames, envReadyFD, envReleaseFD:
+			continue
+		}
+		env = append(env, kv)
+	}
+	return env
+}
+
+// sameAddr reports whether a bound address satisfies a listen request.
+// A TCP request without host ("":8080") matches any address on that port.
+func sameAddr(bound net.Addr, network, address string) bool {
+	switch network {
+	case "unix":
+		return bound.Network() == "unix" && bound.String() == address
+	case "tcp", "tcp4", "tcp6":
+		ta, ok := bound.(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return false
+		}
+		p, err := net.LookupPort("tcp", port)
+		if err != nil || p != ta.Port {
+			return false
+		}
+		if host == "" {
+			return true
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			return ip.Equal(ta.IP) || ip.IsUnspecified() && ta.IP.IsUnspecified()
+		}
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return false
+		}
+		for _, ip := range ips {
+			if ip.Equal(ta.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
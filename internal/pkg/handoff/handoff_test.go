@@ -0,0 +1,224 @@
+package handoff
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The test binary doubles as the process Upgrade starts: with
+// HANDOFF_TEST_HELPER set it runs helper instead of the tests.
+const (
+	envHelper     = "HANDOFF_TEST_HELPER"
+	envHelperAddr = "HANDOFF_TEST_ADDR"
+	envHelperOut  = "HANDOFF_TEST_OUT"
+)
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(envHelper); mode != "" {
+		os.Exit(helper(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// helper writes what it saw to $HANDOFF_TEST_OUT, one line per step.
+func helper(mode string) int {
+	report := func(format string, args ...any) {
+		f, err := os.OpenFile(os.Getenv(envHelperOut), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			os.Exit(2)
+		}
+		fmt.Fprintf(f, format+"\n", args...)
+		f.Close()
+	}
+	l, err := Inherit()
+	if err != nil {
+		report("inherit: %v", err)
+		return 1
+	}
+	switch mode {
+	case "exit":
+		return 3
+	case "hang":
+		time.Sleep(time.Minute)
+		return 0
+	}
+	addr := os.Getenv(envHelperAddr)
+	_, inherited, err := l.Listen("tcp", addr, func() (net.Listener, error) { return net.Listen("tcp", addr) })
+	report("inherited=%v err=%v taking_over=%v", inherited, err, l.TakingOver())
+	if err := l.Ready(); err != nil {
+		report("ready: %v", err)
+		return 1
+	}
+	select {
+	case <-l.Released():
+		report("released")
+	case <-time.After(10 * time.Second):
+		report("never released")
+	}
+	return 0
+}
+
+// readLines waits until out has at least n lines.
+func readLines(t *testing.T, out string, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := os.ReadFile(out)
+		lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+		if len(b) > 0 && len(lines) >= n {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("helper wrote %q, want %d lines", b, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	l, err := Inherit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, _, err := l.Listen("tcp", "127.0.0.1:0", func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	out := filepath.Join(t.TempDir(), "out")
+	t.Setenv(envHelper, "serve")
+	t.Setenv(envHelperAddr, ln.Addr().String())
+	t.Setenv(envHelperOut, out)
+
+	if err := l.Upgrade(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLines(t, out, 1)[0]; got != "inherited=true err=<nil> taking_over=true" {
+		t.Fatalf("child: %s", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if lines := readLines(t, out, 1); len(lines) != 1 {
+		t.Fatalf("child released before Release: %v", lines)
+	}
+	l.Release()
+	if got := readLines(t, out, 2)[1]; got != "released" {
+		t.Fatalf("child after Release: %s", got)
+	}
+}
+
+func TestUpgradeFails(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []string // any of
+	}{
+		{"hang", []string{"not ready after"}},
+		// 子进程退出和读到 EOF 谁先到都可能
+		{"exit", []string{"exited before it was ready", "closed the readiness pipe without signalling"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			l, err := Inherit()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln, _, err := l.Listen("tcp", "127.0.0.1:0", func() (net.Listener, error) { return net.Listen("tcp", "127.0.0.1:0") })
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			t.Setenv(envHelper, tt.mode)
+			t.Setenv(envHelperOut, filepath.Join(t.TempDir(), "out"))
+
+			start := time.Now()
+			err = l.Upgrade(300 * time.Millisecond)
+			if err == nil || !slices.ContainsFunc(tt.want, func(w string) bool { return strings.Contains(err.Error(), w) }) {
+				t.Fatalf("Upgrade = %v, want %q", err, tt.want)
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("Upgrade didn't give up in time")
+			}
+			// 失败后本进程照常服务，也能再升级
+			if c, err := net.Dial("tcp", ln.Addr().String()); err != nil {
+				t.Fatalf("listener closed after a failed upgrade: %v", err)
+			} else {
+				c.Close()
+			}
+		})
+	}
+}
+
+// Sockets handed over without LISTEN_PID are taken; a LISTEN_PID naming
+// another process (systemd started our parent) means they aren't ours.
+func TestInherit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tests := []struct {
+		name string
+		env  []string
+		want string
+	}{
+		{"passed by a parent", []string{"LISTEN_FDS=1"}, "inherited=true"},
+		{"LISTEN_PID of another process", []string{"LISTEN_FDS=1", "LISTEN_PID=1"}, "inherited=false"},
+		{"bad LISTEN_FDS", []string{"LISTEN_FDS=x"}, "inherit: handoff: bad LISTEN_FDS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := filepath.Join(t.TempDir(), "out")
+			cmd := exec.Command(os.Args[0], "-test.run=^$")
+			cmd.ExtraFiles = []*os.File{f}
+			cmd.Env = append(childEnv(), envHelper+"=listen", envHelperAddr+"="+ln.Addr().String(), envHelperOut+"="+out)
+			cmd.Env = append(cmd.Env, tt.env...)
+			cmd.Run()
+			if got := readLines(t, out, 1)[0]; !strings.HasPrefix(got, tt.want) {
+				t.Fatalf("child: %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameAddr(t *testing.T) {
+	tcp := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	tests := []struct {
+		bound   net.Addr
+		network string
+		address string
+		want    bool
+	}{
+		{tcp("127.0.0.1", 8080), "tcp", ":8080", true},
+		{tcp("0.0.0.0", 8080), "tcp", ":8080", true},
+		{tcp("127.0.0.1", 8080), "tcp", "127.0.0.1:8080", true},
+		{tcp("127.0.0.1", 8080), "tcp4", "127.0.0.1:8080", true},
+		{tcp("127.0.0.1", 8080), "tcp", "127.0.0.2:8080", false},
+		{tcp("127.0.0.1", 8080), "tcp", "127.0.0.1:8081", false},
+		{tcp("::", 8080), "tcp", "0.0.0.0:8080", true}, // 都是通配地址
+		{tcp("0.0.0.0", 80), "tcp", ":http", true},
+		{tcp("127.0.0.1", 8080), "tcp", "localhost:8080", true},
+		{tcp("127.0.0.1", 8080), "tcp", "8080", false},
+		{tcp("127.0.0.1", 8080), "udp", ":8080", false},
+		{&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, "unix", "/tmp/a.sock", true},
+		{&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, "unix", "/tmp/b.sock", false},
+		{&net.UnixAddr{Name: "/tmp/a.sock", Net: "unix"}, "tcp", ":8080", false},
+		{tcp("127.0.0.1", 8080), "unix", "/tmp/a.sock", false},
+	}
+	for _, tt := range tests {
+		if got := sameAddr(tt.bound, tt.network, tt.address); got != tt.want {
+			t.Errorf("sameAddr(%s, %s, %q) = %v, want %v", tt.bound, tt.network, tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrPacketTooLarge is returned when a packet exceeds the configured max payload size.
+var ErrPacketTooLarge = errors.New("packet too large")
+
+// DefaultMaxPayload is the sanity limit used when none is configured (10MB).
+const DefaultMaxPayload = maxPayloadSize
+
+// encodeHeader fills buf with the header of f and returns its length.
+// buf must hold at least extendedHeaderSize bytes.
+func encodeHeader(buf []byte, f *Frame) []byte {
+	if !f.Extended {
+		buf[0] = f.Type
+		binary.BigEndian.PutUint32(buf[1:5], uint32(len(f.Payload)))
+		return buf[:headerSize]
+	}
+	buf[0] = f.Type | FlagExtended
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(f.Payload)))
+	binary.BigEndian.PutUint32(buf[5:9], f.StreamID)
+	binary.BigEndian.PutUint32(buf[9:13], f.Seq)
+	binary.BigEndian.PutUint64(buf[13:21], uint64(f.PTS/time.Microsecond))
+	return buf[:extendedHeaderSize]
+}
+
+// -----------------------------------------------------------------------------
+// Buffer pool
+// -----------------------------------------------------------------------------
+
+// Size classes are powers of two from 512B up to 16MB; anything larger is not pooled.
+const (
+	minPoolShift = 9
+	maxPoolShift = 24
+)
+
+// BufferPool is a sync.Pool-backed allocator for packet payloads.
+// Buffers obtained from it must be handed back with Put (or Frame.Release).
+type BufferPool struct {
+	classes [maxPoolShift - minPoolShift + 1]sync.Pool
+}
+
+func NewBufferPool() *BufferPool {
+	return &BufferPool{}
+}
+
+func sizeClass(n int) int {
+	if n <= 1<<minPoolShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minPoolShift
+}
+
+// Get returns a buffer of length n.
+func (p *BufferPool) Get(n int) []byte {
+	c := sizeClass(n)
+	if c >= len(p.classes) {
+		return make([]byte, n)
+	}
+	if v := p.classes[c].Get(); v != nil {
+		return (*v.(*[]byte))[:n]
+	}
+	return make([]byte, n, 1<<(c+minPoolShift))
+}
+
+// Put returns a buffer obtained from Get. Buffers of foreign capacity are ignored.
+func (p *BufferPool) Put(b []byte) {
+	c := sizeClass(cap(b))
+	if c >= len(p.classes) || cap(b) != 1<<(c+minPoolShift) {
+		return
+	}
+	b = b[:0]
+	p.classes[c].Put(&b)
+}
+
+// Release hands the payload back to the pool it came from.
+// The frame must not be used afterwards. Safe to call on unpooled frames.
+func (f *Frame) Release() {
+	if f.pool != nil && f.Payload != nil {
+		f.pool.Put(f.Payload)
+	}
+	f.Payload = nil
+	f.pool = nil
+}
+
+// -----------------------------------------------------------------------------
+// Reader
+// -----------------------------------------------------------------------------
+
+// Reader decodes packets from a stream, reusing its header buffer between calls.
+type Reader struct {
+	r          io.Reader
+	hdr        [extendedHeaderSize]byte
+	maxPayload int
+	pool       *BufferPool
+
+	// Sync framing only (see sync.go)
+	src       *syncSource
+	onResync  func(skippedBytes, skippedPackets uint64)
+	syncStats SyncStats
+}
+
+// CodecOption configures a Reader or Writer.
+type CodecOption func(*codecConfig)
+
+type codecConfig struct {
+	maxPayload int
+	pool       *BufferPool
+	sync       bool
+	onResync   func(skippedBytes, skippedPackets uint64)
+}
+
+// WithMaxPayload overrides the payload sanity limit.
+func WithMaxPayload(n int) CodecOption {
+	return func(c *codecConfig) { c.maxPayload = n }
+}
+
+// WithPool makes the Reader allocate payloads from p; callers must Release frames.
+func WithPool(p *BufferPool) CodecOption {
+	return func(c *codecConfig) { c.pool = p }
+}
+
+func newCodecConfig(opts []CodecOption) codecConfig {
+	c := codecConfig{maxPayload: DefaultMaxPayload}
+	for _, o := range opts {
+		o(&c)
+	}
+	return c
+}
+
+func NewReader(r io.Reader, opts ...CodecOption) *Reader {
+	c := newCodecConfig(opts)
+	rd := &Reader{r: r, maxPayload: c.maxPayload, pool: c.pool, onResync: c.onResync}
+	if c.sync {
+		rd.src = &syncSource{br: bufio.NewReaderSize(r, 64*1024)}
+	}
+	return rd
+}
+
+func (r *Reader) decodeHeader(f *Frame, hdr []byte) {
+	*f = Frame{Type: hdr[0] &^ FlagExtended}
+	if hdr[0]&FlagExtended != 0 {
+		f.Extended = true
+		f.StreamID = binary.BigEndian.Uint32(hdr[5:9])
+		f.Seq = binary.BigEndian.Uint32(hdr[9:13])
+		f.PTS = time.Duration(binary.BigEndian.Uint64(hdr[13:21])) * time.Microsecond
+	}
+}
+
+func (r *Reader) allocPayload(n int) []byte {
+	if r.pool != nil {
+		return r.pool.Get(n)
+	}
+	return make([]byte, n)
+}
+
+func (r *Reader) releasePayload(b []byte) {
+	if r.pool != nil {
+		r.pool.Put(b)
+	}
+}
+
+// ReadFrame decodes the next packet into f, overwriting all of its fields.
+// When the Reader has a pool, f.Payload is pooled and must be released with f.Release.
+func (r *Reader) ReadFrame(f *Frame) error {
+	if r.src != nil {
+		return r.readSynced(f)
+	}
+
+	hdr := r.hdr[:headerSize]
+	if _, err := io.ReadFull(r.r, hdr); err != nil {
+		return err
+	}
+	if hdr[0]&FlagExtended != 0 {
+		hdr = r.hdr[:extendedHeaderSize]
+		if _, err := io.ReadFull(r.r, hdr[headerSize:]); err != nil {
+			return err
+		}
+	}
+	r.decodeHeader(f, hdr)
+
+	length := binary.BigEndian.Uint32(hdr[1:5])
+	if length == 0 {
+		return nil
+	}
+	if uint64(length) > uint64(r.maxPayload) {
+		return fmt.Errorf("%w: %d", ErrPacketTooLarge, length)
+	}
+
+	f.Payload = r.allocPayload(int(length))
+	f.pool = r.pool
+	if _, err := io.ReadFull(r.r, f.Payload); err != nil {
+		f.Release()
+		return err
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------------
+// Writer
+// -----------------------------------------------------------------------------
+
+// Writer encodes packets, sending header and payload with a single vectored
+// write (writev) when the underlying writer is a net.Conn.
+// A Writer is not safe for concurrent use, even over a net.Conn: it reuses
+// its hdr and bufs arrays on every call. Guard it with a mutex.
+type Writer struct {
+	w          io.Writer
+	hdr        [extendedHeaderSize]byte
+	bufs       [2][]byte
+	maxPayload int
+
+	// Sync framing only (see sync.go)
+	sync     bool
+	hcrc     [crcSize]byte
+	crc      [crcSize]byte
+	syncBufs [5][]byte
+}
+
+func NewWriter(w io.Writer, opts ...CodecOption) *Writer {
+	c := newCodecConfig(opts)
+	return &Writer{w: w, maxPayload: c.maxPayload, sync: c.sync}
+}
+
+// BuffersWriter is implemented by connections that can send a vectored write
+// as one unit but are not a net.Conn (e.g. a WebSocket, one message per packet).
+type BuffersWriter interface {
+	WriteBuffers(bufs net.Buffers) (int64, error)
+}
+
+func (w *Writer) flush(bufs net.Buffers) error {
+	if bw, ok := w.w.(BuffersWriter); ok {
+		_, err := bw.WriteBuffers(bufs)
+		return err
+	}
+	_, err := bufs.WriteTo(w.w)
+	return err
+}
+
+// WriteFrame writes f in one vectored write.
+func (w *Writer) WriteFrame(f *Frame) error {
+	if len(f.Payload) > w.maxPayload {
+		return fmt.Errorf("%w: %d", ErrPacketTooLarge, len(f.Payload))
+	}
+	hdr := encodeHeader(w.hdr[:], f)
+	if w.sync {
+		return w.writeSynced(hdr, f.Payload)
+	}
+	w.bufs = [2][]byte{hdr, f.Payload}
+	err := w.flush(w.bufs[:])
+	w.bufs[1] = nil // don't pin the caller's payload
+	return err
+}
+
+// WritePacket is the Writer equivalent of the package-level WritePacket.
+func (w *Writer) WritePacket(packetType byte, data []byte) error {
+	return w.WriteFrame(&Frame{Type: packetType, Payload: data})
+}
+
+// WriteJSON marshals v and writes it as a single packet.
+func (w *Writer) WriteJSON(packetType byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.WritePacket(packetType, data)
+}
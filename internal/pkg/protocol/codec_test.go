@@ -0,0 +1,160 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// legacyEncode is the wire format as the original WritePacket/WriteFrame
+// produced it, written out by hand so the codec is checked against the
+// format itself rather than against its own wrappers.
+func legacyEncode(f *Frame) []byte {
+	var buf bytes.Buffer
+	typ := f.Type
+	if f.Extended {
+		typ |= FlagExtended
+	}
+	buf.WriteByte(typ)
+	binary.Write(&buf, binary.BigEndian, uint32(len(f.Payload)))
+	if f.Extended {
+		binary.Write(&buf, binary.BigEndian, f.StreamID)
+		binary.Write(&buf, binary.BigEndian, f.Seq)
+		binary.Write(&buf, binary.BigEndian, uint64(f.PTS/time.Microsecond))
+	}
+	buf.Write(f.Payload)
+	return buf.Bytes()
+}
+
+func FuzzReadFrame(f *testing.F) {
+	f.Add(byte(PacketTypeVideo), []byte{0x10, 0x02, 0x00}, false, uint32(0), uint32(0), uint64(0))
+	f.Add(byte(PacketTypeAudio), []byte("opus"), true, uint32(7), uint32(42), uint64(1_000_000))
+	f.Add(byte(PacketTypeUtteranceEnd), []byte{}, false, uint32(0), uint32(0), uint64(0))
+	f.Add(byte(PacketTypeVideo), []byte(nil), true, uint32(1), uint32(1), uint64(40_000))
+	f.Add(byte(PacketTypeText), []byte{0x83, 0, 0, 0, 1}, true, ^uint32(0), ^uint32(0), uint64(1)<<39)
+
+	f.Fuzz(func(t *testing.T, typ byte, payload []byte, extended bool, streamID, seq uint32, ptsUs uint64) {
+		want := Frame{
+			Type:     typ &^ FlagExtended,
+			Payload:  payload,
+			Extended: extended,
+			StreamID: streamID,
+			Seq:      seq,
+			PTS:      time.Duration(ptsUs%(1<<40)) * time.Microsecond,
+		}
+		if !extended {
+			want.StreamID, want.Seq, want.PTS = 0, 0, 0
+		}
+		wire := legacyEncode(&want)
+
+		// Writer produces exactly the original bytes
+		var got bytes.Buffer
+		if err := NewWriter(&got).WriteFrame(&want); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), wire) {
+			t.Fatalf("Writer.WriteFrame = %x, want %x", got.Bytes(), wire)
+		}
+		if !extended {
+			got.Reset()
+			if err := WritePacket(&got, want.Type, payload); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), wire) {
+				t.Fatalf("WritePacket = %x, want %x", got.Bytes(), wire)
+			}
+		}
+
+		// Reader (plain and pooled) and ReadPacket decode it back
+		for _, opts := range [][]CodecOption{nil, {WithPool(NewBufferPool())}} {
+			var fr Frame
+			if err := NewReader(bytes.NewReader(wire), opts...).ReadFrame(&fr); err != nil {
+				t.Fatalf("ReadFrame: %v", err)
+			}
+			if fr.Type != want.Type || fr.Extended != want.Extended || fr.StreamID != want.StreamID ||
+				fr.Seq != want.Seq || fr.PTS != want.PTS || !bytes.Equal(fr.Payload, payload) {
+				t.Fatalf("ReadFrame = %+v, want %+v", fr, want)
+			}
+			if len(payload) == 0 && fr.Payload != nil {
+				t.Fatalf("zero-length payload decoded as %v, want nil", fr.Payload)
+			}
+			fr.Release()
+		}
+		pt, data, err := ReadPacket(bytes.NewReader(wire))
+		if err != nil || pt != want.Type || !bytes.Equal(data, payload) {
+			t.Fatalf("ReadPacket = %x %x %v", pt, data, err)
+		}
+
+		// Arbitrary input: the Reader and ReadPacket agree and never panic
+		var fr Frame
+		errR := NewReader(bytes.NewReader(payload)).ReadFrame(&fr)
+		pt, data, errP := ReadPacket(bytes.NewReader(payload))
+		if (errR == nil) != (errP == nil) {
+			t.Fatalf("Reader err %v, ReadPacket err %v", errR, errP)
+		}
+		if errR == nil && (pt != fr.Type || !bytes.Equal(data, fr.Payload)) {
+			t.Fatalf("Reader %x/%x, ReadPacket %x/%x", fr.Type, fr.Payload, pt, data)
+		}
+	})
+}
+
+// loopReader serves the same encoded packets forever.
+type loopReader struct {
+	buf []byte
+	off int
+}
+
+func (l *loopReader) Read(p []byte) (int, error) {
+	if l.off == len(l.buf) {
+		l.off = 0
+	}
+	n := copy(p, l.buf[l.off:])
+	l.off += n
+	return n, nil
+}
+
+var benchFrame = Frame{
+	Type:     PacketTypeVideo,
+	Payload:  bytes.Repeat([]byte{0xab}, 8*1024),
+	Extended: true,
+	StreamID: 1,
+	Seq:      1,
+	PTS:      40 * time.Millisecond,
+}
+
+func BenchmarkReader_ReadFrame(b *testing.B) {
+	wire := legacyEncode(&benchFrame)
+	for _, bc := range []struct {
+		name string
+		opts []CodecOption
+	}{
+		{"alloc", nil},
+		{"pooled", []CodecOption{WithPool(NewBufferPool())}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			rd := NewReader(&loopReader{buf: wire}, bc.opts...)
+			var f Frame
+			b.SetBytes(int64(len(wire)))
+			b.ReportAllocs()
+			for b.Loop() {
+				if err := rd.ReadFrame(&f); err != nil {
+					b.Fatal(err)
+				}
+				f.Release()
+			}
+		})
+	}
+}
+
+func BenchmarkWriter_WriteFrame(b *testing.B) {
+	w := NewWriter(io.Discard)
+	b.SetBytes(int64(len(legacyEncode(&benchFrame))))
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := w.WriteFrame(&benchFrame); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
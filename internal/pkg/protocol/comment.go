@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// PacketTypeComment is the structured successor of PacketTypeText.
+// It is only sent to workers that negotiated FeatureComments; others still get plain text.
+const PacketTypeComment = 0x05 // Engine -> Worker, JSON Comment
+
+// Comment priorities, higher is more urgent
+const (
+	PriorityRegular  = 0
+	PriorityPaid     = 10
+	PriorityOperator = 100
+)
+
+// Author identifies the viewer who wrote a comment.
+type Author struct {
+	ID          string `json:"id,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// Comment is a viewer message forwarded to the worker.
+type Comment struct {
+	ID        string            `json:"id"`
+	Text      string            `json:"text"`
+	Author    Author            `json:"author"`
+	Platform  string            `json:"platform,omitempty"` // e.g. "web", "douyin", "bilibili"
+	Priority  int               `json:"priority,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt int64             `json:"created_at,omitempty"` // Unix milliseconds
+}
+
+var errEmptyComment = errors.New("comment text is empty")
+
+// Validate checks the fields a worker relies on.
+func (c *Comment) Validate() error {
+	if c.Text == "" {
+		return errEmptyComment
+	}
+	return nil
+}
+
+// DecodeComment parses a PacketTypeComment payload.
+func DecodeComment(payload []byte) (*Comment, error) {
+	var c Comment
+	if err := json.Unmarshal(payload, &c); err != nil {
+		return nil, err
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,157 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Control packets replace the old zero-length EOS hack. Each carries a small JSON body.
+const (
+	PacketTypeUtteranceStart = 0x20 // Worker -> Engine, UtteranceBody
+	PacketTypeUtteranceEnd   = 0x21 // Worker -> Engine, UtteranceBody
+	PacketTypeCancel         = 0x22 // Either direction, UtteranceBody
+	PacketTypeKeepalive      = 0x23 // Either direction, KeepaliveBody
+)
+
+// UtteranceBody identifies one reply of the worker.
+type UtteranceBody struct {
+	UtteranceID string `json:"utterance_id"`
+	StreamID    uint32 `json:"stream_id,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	CommentID   string `json:"comment_id,omitempty"` // comment this reply answers, if any
+}
+
+// KeepaliveBody is sent periodically so both sides can tell a quiet peer from a dead one.
+// With FeatureHeartbeat a keepalive is a ping, answered by a pong echoing Seq and SentAt.
+type KeepaliveBody struct {
+	Seq    uint64 `json:"seq"`
+	SentAt int64  `json:"sent_at"` // Unix milliseconds
+	Pong   bool   `json:"pong,omitempty"`
+}
+
+// Reply returns the pong answering a ping.
+func (k *KeepaliveBody) Reply() *KeepaliveBody {
+	return &KeepaliveBody{Seq: k.Seq, SentAt: k.SentAt, Pong: true}
+}
+
+// RTT is the round trip time of a pong, measured against now.
+func (k *KeepaliveBody) RTT(now time.Time) time.Duration {
+	return now.Sub(time.UnixMilli(k.SentAt))
+}
+
+// IsControl reports whether the packet type is a control packet (including PacketTypeError).
+func IsControl(packetType byte) bool {
+	switch packetType {
+	case PacketTypeError,
+		PacketTypeUtteranceStart,
+		PacketTypeUtteranceEnd,
+		PacketTypeCancel,
+		PacketTypeKeepalive,
+		PacketTypeStreamOpen,
+		PacketTypeStreamClose,
+		PacketTypeJobStatus:
+		return true
+	}
+	return false
+}
+
+// IsMedia reports whether the packet type carries audio or video.
+func IsMedia(packetType byte) bool {
+	return packetType == PacketTypeVideo || packetType == PacketTypeAudio
+}
+
+// IsKeyFrame reports whether a media packet can be decoded on its own.
+// Audio frames always can; for VP8 video bit 0 of the first byte is 0 on key frames.
+func IsKeyFrame(packetType byte, payload []byte) bool {
+	switch packetType {
+	case PacketTypeAudio:
+		return true
+	case PacketTypeVideo:
+		return len(payload) > 0 && payload[0]&0x01 == 0
+	}
+	return false
+}
+
+// TypeName returns a short name for logs and stats.
+func TypeName(packetType byte) string {
+	switch packetType {
+	case PacketTypeVideo:
+		return "video"
+	case PacketTypeAudio:
+		return "audio"
+	case PacketTypeText:
+		return "text"
+	case PacketTypeUserAudio:
+		return "user_audio"
+	case PacketTypeComment:
+		return "comment"
+	case PacketTypeHello:
+		return "hello"
+	case PacketTypeHelloAck:
+		return "hello_ack"
+	case PacketTypeError:
+		return "error"
+	case PacketTypeUtteranceStart:
+		return "utterance_start"
+	case PacketTypeUtteranceEnd:
+		return "utterance_end"
+	case PacketTypeCancel:
+		return "cancel"
+	case PacketTypeKeepalive:
+		return "keepalive"
+	case PacketTypeStreamOpen:
+		return "stream_open"
+	case PacketTypeStreamClose:
+		return "stream_close"
+	case PacketTypeJobStatus:
+		return "job_status"
+	}
+	return fmt.Sprintf("0x%02x", packetType)
+}
+
+// WriteUtteranceStart announces a new reply.
+func WriteUtteranceStart(w io.Writer, body *UtteranceBody) error {
+	return WriteJSON(w, PacketTypeUtteranceStart, body)
+}
+
+// WriteUtteranceEnd marks the end of a reply without closing the connection.
+func WriteUtteranceEnd(w io.Writer, body *UtteranceBody) error {
+	return WriteJSON(w, PacketTypeUtteranceEnd, body)
+}
+
+// WriteCancel asks the peer to abort the given utterance.
+func WriteCancel(w io.Writer, body *UtteranceBody) error {
+	return WriteJSON(w, PacketTypeCancel, body)
+}
+
+// WriteKeepalive sends a keepalive stamped with the current time.
+func WriteKeepalive(w io.Writer, seq uint64) error {
+	return WriteJSON(w, PacketTypeKeepalive, &KeepaliveBody{Seq: seq, SentAt: time.Now().UnixMilli()})
+}
+
+// DecodeKeepalive parses the body of a keepalive packet.
+func DecodeKeepalive(payload []byte) (*KeepaliveBody, error) {
+	var body KeepaliveBody
+	if len(payload) == 0 {
+		return &body, nil
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
+
+// DecodeUtterance parses the body of start/end/cancel packets.
+// An empty payload decodes to a zero body.
+func DecodeUtterance(payload []byte) (*UtteranceBody, error) {
+	var body UtteranceBody
+	if len(payload) == 0 {
+		return &body, nil
+	}
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
@@ -0,0 +1,251 @@
+package protocol
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ProtocolVersion is the wire protocol version spoken by this build.
+// Bump it whenever the framing or a control body changes incompatibly.
+const ProtocolVersion = 1
+
+// Worker roles announced in Hello.Role
+const (
+	RoleTalking  = "talking"  // produces talking-head A/V for the interactor
+	RoleAnnounce = "announce" // scripted announcements
+)
+
+// Optional features negotiated in Hello.Features / HelloAck.Features
+const (
+	FeatureTimestamps = "timestamps" // worker may send extended headers (see WriteFrame)
+	FeatureComments   = "comments"   // worker understands PacketTypeComment
+	FeatureSync       = "sync-crc"   // both directions switch to sync framing after the handshake (see sync.go)
+	FeatureHeartbeat  = "heartbeat"  // worker answers keepalive pings with pongs (see control.go)
+	FeatureJobs       = "jobs"       // worker acknowledges comments and reports job progress (see job.go)
+)
+
+// Error codes carried in ErrorBody.Code
+const (
+	ErrCodeBadHandshake     = "bad_handshake"
+	ErrCodeVersionMismatch  = "version_mismatch"
+	ErrCodeUnsupportedCodec = "unsupported_codec"
+	ErrCodeBadFormat        = "bad_format"
+	ErrCodeUnauthorized     = "unauthorized"
+)
+
+// Hello is the first packet a worker must send after dialing the engine.
+// Format: [PacketTypeHello][Length:4][JSON Hello]
+type Hello struct {
+	Version  int      `json:"version"`
+	Role     string   `json:"role"`
+	WorkerID string   `json:"worker_id"`
+	Codecs   []string `json:"codecs"` // e.g. "vp8", "opus"
+	Width    int      `json:"width,omitempty"`
+	Height   int      `json:"height,omitempty"`
+	FPS      int      `json:"fps,omitempty"`
+	Features []string `json:"features,omitempty"`
+	Token    string   `json:"token,omitempty"` // shared secret, see HandshakePolicy.Token
+}
+
+// Redacted returns a copy without the token, for logs and recordings.
+func (h *Hello) Redacted() *Hello {
+	c := *h
+	c.Token = ""
+	return &c
+}
+
+// HelloAck is the engine's reply to an accepted Hello.
+type HelloAck struct {
+	Version  int      `json:"version"`
+	Session  string   `json:"session"`
+	Features []string `json:"features,omitempty"` // subset of Hello.Features the engine enabled
+}
+
+// Has reports whether the engine enabled the given feature.
+func (a *HelloAck) Has(feature string) bool {
+	return a != nil && containsString(a.Features, feature)
+}
+
+// ErrorBody is the payload of PacketTypeError.
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// RemoteError is returned to the side that received a PacketTypeError.
+type RemoteError struct {
+	Code    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("remote error [%s]: %s", e.Code, e.Message)
+}
+
+// HandshakePolicy describes what the engine is willing to accept.
+type HandshakePolicy struct {
+	MinVersion int
+	MaxVersion int
+	Codecs     []string // codecs the engine can forward; empty = anything
+	Features   []string // optional features the engine understands
+	Token      string   // if set, Hello.Token must match
+}
+
+// DefaultHandshakePolicy accepts the current version with VP8 video and Opus audio.
+func DefaultHandshakePolicy() HandshakePolicy {
+	return HandshakePolicy{
+		MinVersion: ProtocolVersion,
+		MaxVersion: ProtocolVersion,
+		Codecs:     []string{"vp8", "opus"},
+		Features:   []string{FeatureTimestamps, FeatureComments, FeatureSync, FeatureHeartbeat, FeatureJobs},
+	}
+}
+
+// CodecOptions returns the Reader/Writer options matching the negotiated features.
+func CodecOptions(features []string, extra ...CodecOption) []CodecOption {
+	if containsString(features, FeatureSync) {
+		extra = append(extra, WithSync())
+	}
+	return extra
+}
+
+// Negotiate returns the features both sides support.
+func (p HandshakePolicy) Negotiate(h *Hello) []string {
+	var out []string
+	for _, f := range h.Features {
+		if containsString(p.Features, f) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// Check returns nil if the Hello is compatible, otherwise the error to send back.
+func (p HandshakePolicy) Check(h *Hello) *ErrorBody {
+	if p.Token != "" && subtle.ConstantTimeCompare([]byte(h.Token), []byte(p.Token)) != 1 {
+		// 先于其它检查，未授权的一方拿不到版本/编解码器信息
+		msg := "invalid token"
+		if h.Token == "" {
+			msg = "token required"
+		}
+		return &ErrorBody{Code: ErrCodeUnauthorized, Message: msg}
+	}
+	if h.Version < p.MinVersion || h.Version > p.MaxVersion {
+		return &ErrorBody{
+			Code:    ErrCodeVersionMismatch,
+			Message: fmt.Sprintf("worker speaks v%d, engine accepts v%d..v%d", h.Version, p.MinVersion, p.MaxVersion),
+		}
+	}
+	if h.WorkerID == "" {
+		return &ErrorBody{Code: ErrCodeBadHandshake, Message: "missing worker_id"}
+	}
+	if len(p.Codecs) > 0 {
+		for _, c := range h.Codecs {
+			if !containsString(p.Codecs, c) {
+				return &ErrorBody{
+					Code:    ErrCodeUnsupportedCodec,
+					Message: fmt.Sprintf("codec %q not supported (accepted: %v)", c, p.Codecs),
+				}
+			}
+		}
+	}
+	if h.Width < 0 || h.Height < 0 || h.FPS < 0 {
+		return &ErrorBody{Code: ErrCodeBadFormat, Message: "negative resolution or fps"}
+	}
+	return nil
+}
+
+// WriteJSON marshals v and writes it as a single packet.
+func WriteJSON(w io.Writer, packetType byte, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WritePacket(w, packetType, data)
+}
+
+// WriteError sends a typed error packet.
+func WriteError(w io.Writer, code, message string) error {
+	return WriteJSON(w, PacketTypeError, &ErrorBody{Code: code, Message: message})
+}
+
+// DecodeError turns a PacketTypeError payload into a *RemoteError.
+func DecodeError(payload []byte) *RemoteError {
+	var body ErrorBody
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return &RemoteError{Code: ErrCodeBadFormat, Message: string(payload)}
+	}
+	return &RemoteError{Code: body.Code, Message: body.Message}
+}
+
+// ClientHandshake is run by workers right after dialing: send Hello, wait for HelloAck.
+func ClientHandshake(rw io.ReadWriter, h *Hello) (*HelloAck, error) {
+	if h.Version == 0 {
+		h.Version = ProtocolVersion
+	}
+	if err := WriteJSON(rw, PacketTypeHello, h); err != nil {
+		return nil, fmt.Errorf("send hello: %w", err)
+	}
+	pktType, payload, err := ReadPacket(rw)
+	if err != nil {
+		return nil, fmt.Errorf("read hello ack: %w", err)
+	}
+	switch pktType {
+	case PacketTypeHelloAck:
+		var ack HelloAck
+		if err := json.Unmarshal(payload, &ack); err != nil {
+			return nil, fmt.Errorf("decode hello ack: %w", err)
+		}
+		return &ack, nil
+	case PacketTypeError:
+		return nil, DecodeError(payload)
+	default:
+		return nil, fmt.Errorf("unexpected packet 0x%02x during handshake", pktType)
+	}
+}
+
+// ServerHandshake reads the worker's Hello and answers with HelloAck or a typed error.
+// On rejection the returned error is a *RemoteError describing what was sent back.
+func ServerHandshake(rw io.ReadWriter, policy HandshakePolicy, session string) (*Hello, error) {
+	pktType, payload, err := ReadPacket(rw)
+	if err != nil {
+		return nil, fmt.Errorf("read hello: %w", err)
+	}
+	if pktType != PacketTypeHello {
+		msg := fmt.Sprintf("expected hello, got packet 0x%02x", pktType)
+		WriteError(rw, ErrCodeBadHandshake, msg)
+		return nil, &RemoteError{Code: ErrCodeBadHandshake, Message: msg}
+	}
+
+	var h Hello
+	if err := json.Unmarshal(payload, &h); err != nil {
+		msg := fmt.Sprintf("malformed hello: %v", err)
+		WriteError(rw, ErrCodeBadHandshake, msg)
+		return nil, &RemoteError{Code: ErrCodeBadHandshake, Message: msg}
+	}
+
+	if body := policy.Check(&h); body != nil {
+		WriteError(rw, body.Code, body.Message)
+		return &h, &RemoteError{Code: body.Code, Message: body.Message}
+	}
+
+	if err := WriteJSON(rw, PacketTypeHelloAck, &HelloAck{
+		Version:  h.Version,
+		Session:  session,
+		Features: policy.Negotiate(&h),
+	}); err != nil {
+		return &h, fmt.Errorf("send hello ack: %w", err)
+	}
+	return &h, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package protocol
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// PacketTypeJobStatus reports the progress of a comment job. Only sent by
+// workers that negotiated FeatureJobs.
+const PacketTypeJobStatus = 0x40 // Worker -> Engine, JobStatusBody
+
+// JobState is one step in the life of a comment job. The engine owns
+// JobPending; the worker reports the rest. Playing/done/failed are also
+// inferred from utterances carrying the comment ID, so workers without
+// FeatureJobs still get tracked.
+type JobState string
+
+const (
+	JobPending    JobState = "pending"          // Sent to the worker, not acknowledged yet
+	JobReceived   JobState = "received"         // Worker got the comment
+	JobQueued     JobState = "queued"           // Waiting behind earlier comments
+	JobLLM        JobState = "llm_responding"   // Reply text is being generated
+	JobTTSDone    JobState = "tts_done"         // Reply audio is ready
+	JobGenerating JobState = "generating_video" // Talking-head video is being rendered
+	JobPlaying    JobState = "playing"          // Reply is on air
+	JobDone       JobState = "done"
+	JobFailed     JobState = "failed"
+)
+
+// Terminal reports whether no further transition is expected.
+func (s JobState) Terminal() bool {
+	return s == JobDone || s == JobFailed
+}
+
+// JobStatusBody is the payload of PacketTypeJobStatus.
+type JobStatusBody struct {
+	CommentID   string   `json:"comment_id"`
+	State       JobState `json:"state"`
+	Detail      string   `json:"detail,omitempty"`       // e.g. the error of a failed job
+	UtteranceID string   `json:"utterance_id,omitempty"` // once the reply has one
+}
+
+// WriteJobStatus reports a job transition.
+func WriteJobStatus(w io.Writer, body *JobStatusBody) error {
+	return WriteJSON(w, PacketTypeJobStatus, body)
+}
+
+// DecodeJobStatus parses a PacketTypeJobStatus payload.
+func DecodeJobStatus(payload []byte) (*JobStatusBody, error) {
+	var body JobStatusBody
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return nil, err
+	}
+	return &body, nil
+}
@@ -1,9 +1,8 @@
 package protocol
 
 import (
-	"encoding/binary"
-	"fmt"
 	"io"
+	"time"
 )
 
 const (
@@ -12,47 +11,67 @@ const (
 	PacketTypeText      = 0x03
 	PacketTypeUserAudio = 0x04 // <--- 新增这个：代表用户说话的音频
 
+	// Handshake (see handshake.go)
+	PacketTypeHello    = 0x10 // Worker -> Engine, JSON Hello
+	PacketTypeHelloAck = 0x11 // Engine -> Worker, JSON HelloAck
+	PacketTypeError    = 0x12 // Either direction, JSON ErrorBody
 )
 
+// FlagExtended is OR-ed into the type byte when the packet carries the extended header.
+// Packet types themselves must therefore stay below 0x80.
+const FlagExtended = 0x80
+
+const (
+	headerSize         = 5               // [Type:1][Length:4]
+	extendedHeaderSize = headerSize + 16 // + [StreamID:4][Seq:4][PTS:8]
+	maxPayloadSize     = 10000000        // Sanity check (10MB)
+)
+
+// Frame is a decoded packet including the optional extended header.
+// Seq counts per (StreamID, Type): audio and video are numbered independently.
+type Frame struct {
+	Type     byte
+	Payload  []byte
+	Extended bool
+	StreamID uint32
+	Seq      uint32
+	PTS      time.Duration // Microsecond precision on the wire
+
+	pool *BufferPool // set when Payload must be handed back via Release
+}
+
 // WritePacket writes a type-prefixed, length-prefixed packet
 // Format: [Type:1][Length:4][Payload:N]
+// For hot paths prefer a long-lived Writer (see codec.go).
 func WritePacket(w io.Writer, packetType byte, data []byte) error {
-	length := uint32(len(data))
-	header := make([]byte, 5) // 1 byte type + 4 bytes length
-	header[0] = packetType
-	binary.BigEndian.PutUint32(header[1:], length)
-
-	// Write header
-	if _, err := w.Write(header); err != nil {
-		return err
-	}
-	// Write payload
-	if _, err := w.Write(data); err != nil {
-		return err
-	}
-	return nil
+	return NewWriter(w).WritePacket(packetType, data)
+}
+
+// WriteFrame writes a frame, using the extended header when f.Extended is set.
+// Extended format: [Type|0x80:1][Length:4][StreamID:4][Seq:4][PTS_us:8][Payload:N]
+// Only send extended frames to a peer that acknowledged FeatureTimestamps.
+func WriteFrame(w io.Writer, f *Frame) error {
+	return NewWriter(w).WriteFrame(f)
 }
 
 // ReadPacket reads a packet and returns type and data
+// The extended header, if present, is consumed and discarded.
+// Zero-length packets are returned as-is; end of an utterance is signalled with
+// PacketTypeUtteranceEnd (see control.go), not by an empty payload.
 func ReadPacket(r io.Reader) (byte, []byte, error) {
-	// Read header (5 bytes)
-	header := make([]byte, 5)
-	if _, err := io.ReadFull(r, header); err != nil {
+	f, err := ReadFrame(r)
+	if err != nil {
 		return 0, nil, err
 	}
+	return f.Type, f.Payload, nil
+}
 
-	packetType := header[0]
-	length := binary.BigEndian.Uint32(header[1:])
-
-	if length == 0 {
-		return packetType, nil, io.EOF // Logic: 0 length packet = End of Stream
-	} else if length > 10000000 { // Sanity check (10MB)
-		return 0, nil, fmt.Errorf("packet too large: %d", length)
-	}
-
-	data := make([]byte, length)
-	if _, err := io.ReadFull(r, data); err != nil {
-		return 0, nil, err
+// ReadFrame reads either header variant.
+// For hot paths prefer a long-lived Reader (see codec.go).
+func ReadFrame(r io.Reader) (*Frame, error) {
+	f := &Frame{}
+	if err := NewReader(r).ReadFrame(f); err != nil {
+		return nil, err
 	}
-	return packetType, data, nil
+	return f, nil
 }
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Session recordings capture the packets exchanged with a worker so a session
+// can be replayed later (see cmd/udsreplay). File layout:
+//
+//	[Magic:8] then records of [Dir:1][Conn:4][At_us:8][Packet (plain or extended header)]
+//
+// Conn numbers the worker connections of the session (each starts with the
+// worker's Hello), At is the time since the recording started. Packets are stored exactly as
+// they were framed on the wire, minus sync markers/CRC.
+var RecordMagic = [8]byte{'I', 'L', 'R', 'E', 'C', 0, 0, 1}
+
+// ErrBadRecording is returned when a file is not a session recording.
+var ErrBadRecording = errors.New("not a session recording")
+
+// Record directions, seen from the engine.
+const (
+	DirInbound  byte = 'I' // Worker -> Engine (Hello, media, control)
+	DirOutbound byte = 'O' // Engine -> Worker (comments, cancel, errors)
+)
+
+const recordHeaderSize = 13
+
+// Record is one recorded packet.
+type Record struct {
+	Dir   byte
+	Conn  uint32
+	At    time.Duration
+	Frame Frame
+}
+
+// RecordWriter appends packets to a recording. Safe for concurrent use.
+type RecordWriter struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	c     io.Closer
+	pw    *Writer
+	start time.Time
+	hdr   [recordHeaderSize]byte
+}
+
+// NewRecordWriter writes the file magic to w and starts the clock.
+func NewRecordWriter(w io.Writer) (*RecordWriter, error) {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	if _, err := bw.Write(RecordMagic[:]); err != nil {
+		return nil, err
+	}
+	rw := &RecordWriter{w: bw, pw: NewWriter(bw), start: time.Now()}
+	if c, ok := w.(io.Closer); ok {
+		rw.c = c
+	}
+	return rw, nil
+}
+
+// CreateRecording creates (truncates) a recording file at path.
+func CreateRecording(path string) (*RecordWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	rw, err := NewRecordWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Record stores f with the current arrival time. Non-media packets are
+// flushed right away so a crash loses at most a burst of media.
+func (rw *RecordWriter) Record(dir byte, conn uint32, f *Frame) error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	rw.hdr[0] = dir
+	binary.BigEndian.PutUint32(rw.hdr[1:5], conn)
+	binary.BigEndian.PutUint64(rw.hdr[5:], uint64(time.Since(rw.start)/time.Microsecond))
+	if _, err := rw.w.Write(rw.hdr[:]); err != nil {
+		return err
+	}
+	if err := rw.pw.WriteFrame(f); err != nil {
+		return err
+	}
+	if !IsMedia(f.Type) {
+		return rw.w.Flush()
+	}
+	return nil
+}
+
+// Flush writes buffered records to the underlying writer.
+func (rw *RecordWriter) Flush() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return rw.w.Flush()
+}
+
+// Close flushes and closes the underlying file, if any.
+func (rw *RecordWriter) Close() error {
+	err := rw.Flush()
+	if rw.c != nil {
+		if cerr := rw.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// RecordReader reads a recording written by RecordWriter.
+type RecordReader struct {
+	r   *bufio.Reader
+	pr  *Reader
+	hdr [recordHeaderSize]byte
+}
+
+// NewRecordReader checks the file magic and returns a reader positioned at the first record.
+func NewRecordReader(r io.Reader) (*RecordReader, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+	var magic [len(RecordMagic)]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil || magic != RecordMagic {
+		return nil, ErrBadRecording
+	}
+	return &RecordReader{r: br, pr: NewReader(br)}, nil
+}
+
+// Next reads the next record. It returns io.EOF at the end of the recording;
+// a recording cut short (e.g. the engine crashed) ends with io.ErrUnexpectedEOF.
+func (rr *RecordReader) Next(rec *Record) error {
+	if _, err := io.ReadFull(rr.r, rr.hdr[:]); err != nil {
+		return err
+	}
+	rec.Dir = rr.hdr[0]
+	rec.Conn = binary.BigEndian.Uint32(rr.hdr[1:5])
+	rec.At = time.Duration(binary.BigEndian.Uint64(rr.hdr[5:])) * time.Microsecond
+	if err := rr.pr.ReadFrame(&rec.Frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Logical streams let one worker connection carry several concurrent utterances
+// or feeds for several avatars. Media packets select their stream through the
+// StreamID of the extended header; packets without it belong to DefaultStreamID.
+const (
+	PacketTypeStreamOpen  = 0x30 // Worker -> Engine, StreamInfo
+	PacketTypeStreamClose = 0x31 // Worker -> Engine, StreamInfo (only StreamID/Reason used)
+)
+
+// DefaultStreamID is the implicit, always-open stream of legacy packets.
+const DefaultStreamID uint32 = 0
+
+var (
+	ErrStreamExists  = errors.New("stream already open")
+	ErrStreamUnknown = errors.New("stream not open")
+)
+
+// StreamInfo describes a logical stream.
+type StreamInfo struct {
+	StreamID uint32 `json:"stream_id"`
+	Target   string `json:"target,omitempty"` // room or avatar the stream is meant for; "" = default
+	Reason   string `json:"reason,omitempty"`
+	Implicit bool   `json:"-"` // opened by first use rather than StreamOpen
+}
+
+// WriteStreamOpen announces a new logical stream.
+func WriteStreamOpen(w io.Writer, info *StreamInfo) error {
+	return WriteJSON(w, PacketTypeStreamOpen, info)
+}
+
+// WriteStreamClose ends a logical stream.
+func WriteStreamClose(w io.Writer, streamID uint32, reason string) error {
+	return WriteJSON(w, PacketTypeStreamClose, &StreamInfo{StreamID: streamID, Reason: reason})
+}
+
+// DecodeStreamInfo parses the body of open/close packets.
+func DecodeStreamInfo(payload []byte) (*StreamInfo, error) {
+	var info StreamInfo
+	if err := json.Unmarshal(payload, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// StreamTable tracks the open streams of one connection.
+type StreamTable struct {
+	mu      sync.Mutex
+	streams map[uint32]StreamInfo
+}
+
+func NewStreamTable() *StreamTable {
+	return &StreamTable{streams: make(map[uint32]StreamInfo)}
+}
+
+// Open registers a stream. Re-opening an implicitly opened stream just updates it.
+func (t *StreamTable) Open(info StreamInfo) error {
+	if info.StreamID == DefaultStreamID {
+		return ErrStreamExists
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cur, ok := t.streams[info.StreamID]; ok && !cur.Implicit {
+		return ErrStreamExists
+	}
+	t.streams[info.StreamID] = info
+	return nil
+}
+
+// Close removes a stream and returns what it was.
+func (t *StreamTable) Close(id uint32) (StreamInfo, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.streams[id]
+	if !ok {
+		return StreamInfo{StreamID: id}, ErrStreamUnknown
+	}
+	delete(t.streams, id)
+	return info, nil
+}
+
+// Resolve returns the stream a packet belongs to, opening it implicitly on first use
+// so workers that never send StreamOpen keep working.
+func (t *StreamTable) Resolve(id uint32) StreamInfo {
+	if id == DefaultStreamID {
+		return StreamInfo{StreamID: id}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.streams[id]
+	if !ok {
+		info = StreamInfo{StreamID: id, Implicit: true}
+		t.streams[id] = info
+	}
+	return info
+}
+
+// CloseAll empties the table and returns the streams that were open.
+func (t *StreamTable) CloseAll() []StreamInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]StreamInfo, 0, len(t.streams))
+	for id, info := range t.streams {
+		out = append(out, info)
+		delete(t.streams, id)
+	}
+	return out
+}
+
+// Len returns the number of open streams.
+func (t *StreamTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.streams)
+}
@@ -0,0 +1,203 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Sync framing (FeatureSync) wraps every packet with a marker and checksums so
+// the reader can recover from a partial or corrupted packet:
+//
+//	[Magic:2][Header:5|21][HeaderCRC32:4][Payload:N][CRC32:4]
+//
+// Both CRCs are IEEE; the trailing one covers header and payload. The header
+// CRC is checked before the payload is read, so a corrupt length never makes
+// the reader wait for megabytes that aren't coming. After a bad checksum the
+// reader scans forward byte by byte to the next marker.
+var SyncMagic = [2]byte{0xA5, 0x5A}
+
+const crcSize = 4
+
+// SyncStats reports what the reader had to throw away to stay in sync.
+type SyncStats struct {
+	SkippedBytes   uint64 // bytes discarded while searching for a marker
+	SkippedPackets uint64 // candidate packets rejected (bad header, length or CRC)
+	Resyncs        uint64 // times the reader had to search for a marker
+}
+
+// WithSync enables sync framing on a Reader or Writer.
+// Both ends must agree, normally through FeatureSync in the handshake.
+func WithSync() CodecOption {
+	return func(c *codecConfig) { c.sync = true }
+}
+
+// WithResyncHandler is called after the Reader recovers, with the bytes and
+// packets skipped during that episode.
+func WithResyncHandler(fn func(skippedBytes, skippedPackets uint64)) CodecOption {
+	return func(c *codecConfig) { c.onResync = fn }
+}
+
+// SyncStats returns the cumulative resync counters (zero unless WithSync).
+func (r *Reader) SyncStats() SyncStats {
+	return r.syncStats
+}
+
+// syncSource is a buffered reader that supports pushing bytes back,
+// so a rejected packet can be rescanned from its second byte.
+type syncSource struct {
+	pending []byte
+	br      *bufio.Reader
+}
+
+func (s *syncSource) Read(p []byte) (int, error) {
+	if len(s.pending) > 0 {
+		n := copy(p, s.pending)
+		s.pending = s.pending[n:]
+		return n, nil
+	}
+	return s.br.Read(p)
+}
+
+func (s *syncSource) ReadByte() (byte, error) {
+	if len(s.pending) > 0 {
+		b := s.pending[0]
+		s.pending = s.pending[1:]
+		return b, nil
+	}
+	return s.br.ReadByte()
+}
+
+func (s *syncSource) unread(parts ...[]byte) {
+	var buf []byte
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	s.pending = append(buf, s.pending...)
+}
+
+// findMagic consumes bytes until the sync marker has been read.
+func (r *Reader) findMagic() (skipped uint64, err error) {
+	for {
+		b, err := r.src.ReadByte()
+		if err != nil {
+			return skipped, err
+		}
+		if b != SyncMagic[0] {
+			skipped++
+			continue
+		}
+		b2, err := r.src.ReadByte()
+		if err != nil {
+			return skipped, err
+		}
+		if b2 == SyncMagic[1] {
+			return skipped, nil
+		}
+		skipped++
+		r.src.unread([]byte{b2})
+	}
+}
+
+// readSynced is ReadFrame for sync framing.
+func (r *Reader) readSynced(f *Frame) error {
+	var epochBytes, epochPackets uint64
+	for {
+		skipped, err := r.findMagic()
+		epochBytes += skipped
+		r.syncStats.SkippedBytes += skipped
+		if err != nil {
+			if err == io.EOF && epochBytes > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		ok, err := r.readSyncedBody(f)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if epochBytes > 0 || epochPackets > 0 {
+				r.syncStats.Resyncs++
+				if r.onResync != nil {
+					r.onResync(epochBytes, epochPackets)
+				}
+			}
+			return nil
+		}
+		epochPackets++
+		r.syncStats.SkippedPackets++
+	}
+}
+
+// readSyncedBody reads header, payload and CRCs after a marker.
+// It returns false (and pushes the bytes back) if the packet is corrupt.
+func (r *Reader) readSyncedBody(f *Frame) (bool, error) {
+	hdr := r.hdr[:headerSize]
+	if _, err := io.ReadFull(r.src, hdr); err != nil {
+		return false, err
+	}
+	if hdr[0]&FlagExtended != 0 {
+		hdr = r.hdr[:extendedHeaderSize]
+		if _, err := io.ReadFull(r.src, hdr[headerSize:]); err != nil {
+			return false, err
+		}
+	}
+	var hcrcBuf, crcBuf [crcSize]byte
+	if _, err := io.ReadFull(r.src, hcrcBuf[:]); err != nil {
+		return false, err
+	}
+	length := binary.BigEndian.Uint32(hdr[1:5])
+	if crc32.ChecksumIEEE(hdr) != binary.BigEndian.Uint32(hcrcBuf[:]) || uint64(length) > uint64(r.maxPayload) {
+		// Garbage header: rescan from the byte after the marker
+		r.src.unread(hdr, hcrcBuf[:])
+		return false, nil
+	}
+
+	payload := r.allocPayload(int(length))
+	if _, err := io.ReadFull(r.src, payload); err != nil {
+		r.releasePayload(payload)
+		return false, err
+	}
+	if _, err := io.ReadFull(r.src, crcBuf[:]); err != nil {
+		r.releasePayload(payload)
+		return false, err
+	}
+
+	sum := crc32.Update(crc32.ChecksumIEEE(hdr), crc32.IEEETable, payload)
+	if sum != binary.BigEndian.Uint32(crcBuf[:]) {
+		r.src.unread(hdr, hcrcBuf[:], payload, crcBuf[:])
+		r.releasePayload(payload)
+		return false, nil
+	}
+
+	r.decodeHeader(f, hdr)
+	if length > 0 {
+		f.Payload = payload
+		if r.pool != nil {
+			f.pool = r.pool
+		}
+	} else {
+		r.releasePayload(payload)
+	}
+	return true, nil
+}
+
+// writeSynced writes marker, header, CRCs and payload in one vectored write.
+func (w *Writer) writeSynced(hdr, payload []byte) error {
+	hsum := crc32.ChecksumIEEE(hdr)
+	binary.BigEndian.PutUint32(w.hcrc[:], hsum)
+	binary.BigEndian.PutUint32(w.crc[:], crc32.Update(hsum, crc32.IEEETable, payload))
+	w.syncBufs = [5][]byte{SyncMagic[:], hdr, w.hcrc[:], payload, w.crc[:]}
+	err := w.flush(w.syncBufs[:])
+	w.syncBufs[3] = nil
+	return err
+}
+
+// String implements fmt.Stringer for logging.
+func (s SyncStats) String() string {
+	return fmt.Sprintf("skipped %d bytes / %d packets in %d resyncs", s.SkippedBytes, s.SkippedPackets, s.Resyncs)
+}
@@ -0,0 +1,135 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func syncEncode(t *testing.T, frames ...Frame) [][]byte {
+	t.Helper()
+	var out [][]byte
+	for i := range frames {
+		var buf bytes.Buffer
+		if err := NewWriter(&buf, WithSync()).WriteFrame(&frames[i]); err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, buf.Bytes())
+	}
+	return out
+}
+
+func TestSyncResync(t *testing.T) {
+	good := Frame{Type: PacketTypeAudio, Payload: bytes.Repeat([]byte{0x11}, 200), Extended: true, StreamID: 3, Seq: 9, PTS: 60 * time.Millisecond}
+	bad := Frame{Type: PacketTypeVideo, Payload: bytes.Repeat([]byte{0x22}, 100), Extended: true, StreamID: 3, Seq: 8, PTS: 40 * time.Millisecond}
+
+	tests := []struct {
+		name    string
+		corrupt func(pkt []byte) []byte // turns the encoded bad frame into what went on the wire
+	}{
+		{"truncated payload", func(pkt []byte) []byte {
+			return pkt[:2+extendedHeaderSize+crcSize+50]
+		}},
+		{"bad length", func(pkt []byte) []byte {
+			binary.BigEndian.PutUint32(pkt[3:7], 5_000_000)
+			return pkt
+		}},
+		{"bad header type", func(pkt []byte) []byte {
+			pkt[2] &^= FlagExtended
+			return pkt
+		}},
+		{"bad payload crc", func(pkt []byte) []byte {
+			pkt[2+extendedHeaderSize+crcSize+10] ^= 0xff
+			return pkt
+		}},
+		{"bad trailing crc", func(pkt []byte) []byte {
+			pkt[len(pkt)-1] ^= 0xff
+			return pkt
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkts := syncEncode(t, bad, good)
+			broken := tt.corrupt(pkts[0])
+
+			var gotBytes, gotPackets uint64
+			rd := NewReader(bytes.NewReader(append(broken, pkts[1]...)), WithSync(), WithResyncHandler(func(b, p uint64) {
+				gotBytes, gotPackets = b, p
+			}))
+			var f Frame
+			if err := rd.ReadFrame(&f); err != nil {
+				t.Fatal(err)
+			}
+			if f.Seq != good.Seq || !bytes.Equal(f.Payload, good.Payload) {
+				t.Fatalf("got seq %d, want the good packet (seq %d)", f.Seq, good.Seq)
+			}
+			want := SyncStats{SkippedBytes: uint64(len(broken) - 2), SkippedPackets: 1, Resyncs: 1}
+			if st := rd.SyncStats(); st != want {
+				t.Fatalf("SyncStats = %+v, want %+v", st, want)
+			}
+			if gotBytes != want.SkippedBytes || gotPackets != want.SkippedPackets {
+				t.Fatalf("resync handler got %d bytes / %d packets", gotBytes, gotPackets)
+			}
+			if err := rd.ReadFrame(&f); err != io.EOF {
+				t.Fatalf("after last packet err = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestSyncLeadingGarbage(t *testing.T) {
+	pkts := syncEncode(t, Frame{Type: PacketTypeText, Payload: []byte("hi")}, Frame{Type: PacketTypeUtteranceEnd})
+	garbage := []byte{0x00, SyncMagic[0], 0x01, 0x02}
+	rd := NewReader(bytes.NewReader(bytes.Join([][]byte{garbage, pkts[0], pkts[1]}, nil)), WithSync())
+
+	var f Frame
+	if err := rd.ReadFrame(&f); err != nil || string(f.Payload) != "hi" {
+		t.Fatalf("first frame = %q, %v", f.Payload, err)
+	}
+	if err := rd.ReadFrame(&f); err != nil || f.Type != PacketTypeUtteranceEnd || f.Payload != nil {
+		t.Fatalf("second frame = %+v, %v", f, err)
+	}
+	want := SyncStats{SkippedBytes: uint64(len(garbage)), Resyncs: 1}
+	if st := rd.SyncStats(); st != want {
+		t.Fatalf("SyncStats = %+v, want %+v", st, want)
+	}
+}
+
+// A corrupt length must not make the reader wait for a payload that isn't
+// coming while good packets are already buffered behind it.
+func TestSyncBadLengthDoesNotBlock(t *testing.T) {
+	pkts := syncEncode(t, Frame{Type: PacketTypeVideo, Payload: []byte{1, 2, 3}}, Frame{Type: PacketTypeAudio, Payload: []byte{4, 5}})
+	binary.BigEndian.PutUint32(pkts[0][3:7], DefaultMaxPayload-1)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go pw.Write(append(pkts[0], pkts[1]...)) // and then the writer stalls
+
+	done := make(chan error, 1)
+	rd := NewReader(pr, WithSync())
+	var f Frame
+	go func() { done <- rd.ReadFrame(&f) }()
+	select {
+	case err := <-done:
+		if err != nil || f.Type != PacketTypeAudio {
+			t.Fatalf("got %+v, %v", f, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ReadFrame blocked on the corrupt length")
+	}
+	if st := rd.SyncStats(); st.SkippedPackets != 1 || st.SkippedBytes != uint64(len(pkts[0])-2) {
+		t.Fatalf("SyncStats = %+v", st)
+	}
+}
+
+func TestSyncTruncatedAtEOF(t *testing.T) {
+	pkts := syncEncode(t, Frame{Type: PacketTypeVideo, Payload: bytes.Repeat([]byte{7}, 64)})
+	rd := NewReader(bytes.NewReader(pkts[0][:len(pkts[0])-10]), WithSync())
+	var f Frame
+	if err := rd.ReadFrame(&f); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err = %v, want ErrUnexpectedEOF", err)
+	}
+}
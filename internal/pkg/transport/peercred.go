@@ -0,0 +1,207 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// ErrPeerCredUnsupported is returned by PeerCredentials for connections that
+// do not carry peer credentials (anything but a Unix socket, or a non-Linux OS).
+var ErrPeerCredUnsupported = errors.New("transport: peer credentials not available")
+
+// PeerCred identifies the process on the other end of a Unix socket (SO_PEERCRED).
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+	Exe string // best effort, empty if unknown
+}
+
+func (c *PeerCred) String() string {
+	s := fmt.Sprintf("pid=%d uid=%d gid=%d", c.PID, c.UID, c.GID)
+	if c.Exe != "" {
+		s += " exe=" + c.Exe
+	}
+	return s
+}
+
+// PeerAllowlist restricts which local processes may connect to a Unix socket.
+// Every non-empty list must match; an empty allowlist admits everyone.
+type PeerAllowlist struct {
+	UIDs []uint32
+	GIDs []uint32
+	PIDs []int32 // mostly for tests and pinned sidecars; PIDs are reused
+}
+
+// Empty reports whether the allowlist admits everyone.
+func (a *PeerAllowlist) Empty() bool {
+	return a == nil || len(a.UIDs) == 0 && len(a.GIDs) == 0 && len(a.PIDs) == 0
+}
+
+// Allows reports whether the peer passes the allowlist.
+func (a *PeerAllowlist) Allows(c *PeerCred) bool {
+	if a.Empty() {
+		return true
+	}
+	if c == nil {
+		return false
+	}
+	if len(a.UIDs) > 0 && !containsUint32(a.UIDs, c.UID) {
+		return false
+	}
+	if len(a.GIDs) > 0 && !containsUint32(a.GIDs, c.GID) {
+		return false
+	}
+	if len(a.PIDs) > 0 {
+		found := false
+		for _, pid := range a.PIDs {
+			if pid == c.PID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ParsePeerAllowlist builds an allowlist from comma separated lists. Users and
+// groups may be given by name or number, e.g. ParsePeerAllowlist("live,1001", "video", "").
+func ParsePeerAllowlist(users, groups, pids string) (*PeerAllowlist, error) {
+	a := &PeerAllowlist{}
+	for _, u := range splitList(users) {
+		uid, err := LookupUID(u)
+		if err != nil {
+			return nil, err
+		}
+		a.UIDs = append(a.UIDs, uid)
+	}
+	for _, g := range splitList(groups) {
+		gid, err := LookupGID(g)
+		if err != nil {
+			return nil, err
+		}
+		a.GIDs = append(a.GIDs, gid)
+	}
+	for _, p := range splitList(pids) {
+		pid, err := strconv.ParseInt(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("transport: bad pid %q", p)
+		}
+		a.PIDs = append(a.PIDs, int32(pid))
+	}
+	return a, nil
+}
+
+// LookupUID resolves a user name or numeric uid.
+func LookupUID(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	u, err := user.Lookup(s)
+	if err != nil {
+		return 0, fmt.Errorf("transport: %w", err)
+	}
+	n, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("transport: user %s has non-numeric uid %q", s, u.Uid)
+	}
+	return uint32(n), nil
+}
+
+// LookupGID resolves a group name or numeric gid.
+func LookupGID(s string) (uint32, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, fmt.Errorf("transport: %w", err)
+	}
+	n, err := strconv.ParseUint(g.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("transport: group %s has non-numeric gid %q", s, g.Gid)
+	}
+	return uint32(n), nil
+}
+
+// SocketPerms sets the mode and owner of a Unix socket file.
+type SocketPerms struct {
+	Mode  os.FileMode // 0 keeps what the umask gave
+	Owner string      // user name or uid, "" keeps the current owner
+	Group string      // group name or gid, "" keeps the current group
+}
+
+// Apply changes the socket file at path.
+func (p SocketPerms) Apply(path string) error {
+	if p.Owner != "" || p.Group != "" {
+		uid, gid := -1, -1
+		if p.Owner != "" {
+			n, err := LookupUID(p.Owner)
+			if err != nil {
+				return err
+			}
+			uid = int(n)
+		}
+		if p.Group != "" {
+			n, err := LookupGID(p.Group)
+			if err != nil {
+				return err
+			}
+			gid = int(n)
+		}
+		if err := os.Chown(path, uid, gid); err != nil {
+			return fmt.Errorf("transport: chown %s: %w", path, err)
+		}
+	}
+	if p.Mode != 0 {
+		if err := os.Chmod(path, p.Mode); err != nil {
+			return fmt.Errorf("transport: chmod %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// PeerCredentials returns the credentials of the process behind conn.
+func PeerCredentials(conn net.Conn) (*PeerCred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, ErrPeerCredUnsupported
+	}
+	return unixPeerCred(uc)
+}
+
+// DescribePeer names the peer for logs: its credentials on a Unix socket,
+// otherwise the remote address.
+func DescribePeer(conn net.Conn) string {
+	if c, err := PeerCredentials(conn); err == nil {
+		return c.String()
+	}
+	return conn.RemoteAddr().String()
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func containsUint32(list []uint32, v uint32) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
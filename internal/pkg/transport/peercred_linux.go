@@ -0,0 +1,33 @@
+//go:build linux
+
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+func unixPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("transport: SO_PEERCRED: %w", credErr)
+	}
+	c := &PeerCred{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}
+	// 只用于日志；对端可能已经退出，或者 /proc 不可读
+	if exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", ucred.Pid)); err == nil {
+		c.Exe = exe
+	}
+	return c, nil
+}
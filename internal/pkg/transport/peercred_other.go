@@ -0,0 +1,9 @@
+//go:build !linux
+
+package transport
+
+import "net"
+
+func unixPeerCred(conn *net.UnixConn) (*PeerCred, error) {
+	return nil, ErrPeerCredUnsupported
+}
@@ -0,0 +1,262 @@
+// Package transport carries the worker packet protocol over Unix sockets,
+// TCP (optionally with mutual TLS) and WebSocket. Every transport yields a
+// plain net.Conn, so framing, handshake and codecs are shared.
+//
+// Addresses are URLs:
+//
+//	unix:///tmp/infinite-live.sock   (a bare path means the same)
+//	tcp://0.0.0.0:7070
+//	tls://0.0.0.0:7443               (needs a *tls.Config)
+//	ws://0.0.0.0:7080/worker
+//	wss://0.0.0.0:7443/worker        (needs a *tls.Config)
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Address schemes
+const (
+	SchemeUnix = "unix"
+	SchemeTCP  = "tcp"
+	SchemeTLS  = "tls"
+	SchemeWS   = "ws"
+	SchemeWSS  = "wss"
+)
+
+// ErrTLSRequired is returned for tls:// and wss:// addresses without a TLS config.
+var ErrTLSRequired = errors.New("transport: TLS config required")
+
+// Address is a parsed transport address.
+type Address struct {
+	Scheme string
+	Host   string // host:port for network schemes
+	Path   string // socket path (unix) or HTTP path (ws/wss)
+}
+
+// ParseAddress parses a transport URL. Strings without a scheme are Unix socket paths.
+func ParseAddress(s string) (Address, error) {
+	if !strings.Contains(s, "://") {
+		return Address{Scheme: SchemeUnix, Path: s}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return Address{}, fmt.Errorf("transport: bad address %q: %w", s, err)
+	}
+	a := Address{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	switch a.Scheme {
+	case SchemeUnix:
+		if a.Path == "" {
+			return Address{}, fmt.Errorf("transport: %q has no socket path", s)
+		}
+	case SchemeTCP, SchemeTLS:
+		if a.Host == "" {
+			return Address{}, fmt.Errorf("transport: %q has no host", s)
+		}
+	case SchemeWS, SchemeWSS:
+		if a.Host == "" {
+			return Address{}, fmt.Errorf("transport: %q has no host", s)
+		}
+		if a.Path == "" {
+			a.Path = "/"
+		}
+	default:
+		return Address{}, fmt.Errorf("transport: unsupported scheme %q", a.Scheme)
+	}
+	return a, nil
+}
+
+// Plaintext reports whether a carries neither TLS nor peer credentials
+// (tcp:// and ws://): anyone who reaches the port can connect.
+func (a Address) Plaintext() bool {
+	return a.Scheme == SchemeTCP || a.Scheme == SchemeWS
+}
+
+func (a Address) String() string {
+	if a.Scheme == SchemeUnix {
+		return a.Scheme + "://" + a.Path
+	}
+	return a.Scheme + "://" + a.Host + a.Path
+}
+
+// ListenConfig holds the per-scheme settings of ListenWith.
+type ListenConfig struct {
+	TLS    *tls.Config // for tls:// and wss://
+	Socket SocketPerms // for unix://
+
+	// Source, if set, may supply the raw socket instead of opening a new one
+	// (socket activation / restart handoff, see package handoff).
+	Source ListenerSource
+}
+
+// ListenerSource hands out listeners inherited from a previous process.
+type ListenerSource interface {
+	// Listen returns the inherited listener bound to network/address, or else
+	// the one opened by open. inherited tells which.
+	Listen(network, address string, open func() (net.Listener, error)) (ln net.Listener, inherited bool, err error)
+}
+
+func (c ListenConfig) listen(network, address string, open func() (net.Listener, error)) (net.Listener, bool, error) {
+	if c.Source == nil {
+		ln, err := open()
+		return ln, false, err
+	}
+	return c.Source.Listen(network, address, open)
+}
+
+func listenTCP(cfg ListenConfig, host string) (net.Listener, error) {
+	ln, _, err := cfg.listen("tcp", host, func() (net.Listener, error) { return net.Listen("tcp", host) })
+	return ln, err
+}
+
+// Listen opens a listener for addr. tlsConf is used by tls:// and wss://
+// (set ClientAuth for mutual TLS, see ServerTLSConfig).
+func Listen(addr string, tlsConf *tls.Config) (net.Listener, error) {
+	return ListenWith(addr, ListenConfig{TLS: tlsConf})
+}
+
+// ListenWith is Listen with socket permissions.
+func ListenWith(addr string, cfg ListenConfig) (net.Listener, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConf := cfg.TLS
+	switch a.Scheme {
+	case SchemeUnix:
+		// 继承来的 socket 已经在用，不能删文件，也不再改权限
+		ln, _, err := cfg.listen("unix", a.Path, func() (net.Listener, error) {
+			// Cleanup old socket
+			if _, err := os.Stat(a.Path); err == nil {
+				os.Remove(a.Path)
+			}
+			ln, err := net.Listen("unix", a.Path)
+			if err != nil {
+				return nil, err
+			}
+			// chmod 之前的短暂窗口里 socket 仍是 umask 权限，由 PeerAllowlist 兜底
+			if err := cfg.Socket.Apply(a.Path); err != nil {
+				ln.Close()
+				return nil, err
+			}
+			return ln, nil
+		})
+		return ln, err
+	case SchemeTCP:
+		return listenTCP(cfg, a.Host)
+	case SchemeTLS:
+		if tlsConf == nil {
+			return nil, ErrTLSRequired
+		}
+		ln, err := listenTCP(cfg, a.Host)
+		if err != nil {
+			return nil, err
+		}
+		return tls.NewListener(ln, tlsConf), nil
+	case SchemeWS, SchemeWSS:
+		if a.Scheme == SchemeWSS && tlsConf == nil {
+			return nil, ErrTLSRequired
+		}
+		if a.Scheme == SchemeWS {
+			tlsConf = nil
+		}
+		ln, err := listenTCP(cfg, a.Host)
+		if err != nil {
+			return nil, err
+		}
+		return serveWebSocket(a, ln, tlsConf), nil
+	}
+	return nil, fmt.Errorf("transport: unsupported scheme %q", a.Scheme)
+}
+
+// Dial connects to addr. tlsConf is used by tls:// and wss://; nil means the
+// system roots and no client certificate.
+func Dial(ctx context.Context, addr string, tlsConf *tls.Config) (net.Conn, error) {
+	a, err := ParseAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	switch a.Scheme {
+	case SchemeUnix:
+		return d.DialContext(ctx, "unix", a.Path)
+	case SchemeTCP:
+		return d.DialContext(ctx, "tcp", a.Host)
+	case SchemeTLS:
+		td := tls.Dialer{NetDialer: &d, Config: tlsConf}
+		return td.DialContext(ctx, "tcp", a.Host)
+	case SchemeWS, SchemeWSS:
+		wd := websocket.Dialer{TLSClientConfig: tlsConf, HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout}
+		ws, resp, err := wd.DialContext(ctx, a.String(), nil)
+		if err != nil {
+			if resp != nil {
+				return nil, fmt.Errorf("%w (HTTP %s)", err, resp.Status)
+			}
+			return nil, err
+		}
+		return NewWebSocketConn(ws), nil
+	}
+	return nil, fmt.Errorf("transport: unsupported scheme %q", a.Scheme)
+}
+
+// ServerTLSConfig loads the server certificate. When clientCAFile is set,
+// clients must present a certificate signed by it (mutual TLS).
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// ClientTLSConfig trusts caFile (system roots if empty) and presents the
+// client certificate when certFile/keyFile are set.
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("transport: no certificates in %s", path)
+	}
+	return pool, nil
+}
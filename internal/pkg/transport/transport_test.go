@@ -0,0 +1,64 @@
+package transport
+
+import "testing"
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		in        string
+		want      Address
+		str       string // String(); "" means in
+		plaintext bool
+		err       bool
+	}{
+		{in: "/tmp/infinite-live.sock", want: Address{Scheme: SchemeUnix, Path: "/tmp/infinite-live.sock"}, str: "unix:///tmp/infinite-live.sock"},
+		{in: "relative.sock", want: Address{Scheme: SchemeUnix, Path: "relative.sock"}, str: "unix://relative.sock"},
+		{in: "unix:///tmp/a.sock", want: Address{Scheme: SchemeUnix, Path: "/tmp/a.sock"}},
+		{in: "tcp://0.0.0.0:7070", want: Address{Scheme: SchemeTCP, Host: "0.0.0.0:7070"}, plaintext: true},
+		{in: "tls://:7443", want: Address{Scheme: SchemeTLS, Host: ":7443"}},
+		{in: "ws://0.0.0.0:7080/worker", want: Address{Scheme: SchemeWS, Host: "0.0.0.0:7080", Path: "/worker"}, plaintext: true},
+		{in: "ws://gpu-1:7080", want: Address{Scheme: SchemeWS, Host: "gpu-1:7080", Path: "/"}, str: "ws://gpu-1:7080/", plaintext: true},
+		{in: "wss://[::1]:7443/worker", want: Address{Scheme: SchemeWSS, Host: "[::1]:7443", Path: "/worker"}},
+		{in: "unix://", err: true},
+		{in: "tcp:///7070", err: true},
+		{in: "wss:///worker", err: true},
+		{in: "http://localhost:8080", err: true},
+		{in: "tcp://[::1", err: true},
+	}
+	for _, tt := range tests {
+		a, err := ParseAddress(tt.in)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseAddress(%q) = %+v, want an error", tt.in, a)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseAddress(%q): %v", tt.in, err)
+			continue
+		}
+		if a != tt.want {
+			t.Errorf("ParseAddress(%q) = %+v, want %+v", tt.in, a, tt.want)
+		}
+		str := tt.str
+		if str == "" {
+			str = tt.in
+		}
+		if a.String() != str {
+			t.Errorf("ParseAddress(%q).String() = %q, want %q", tt.in, a.String(), str)
+		}
+		if a.Plaintext() != tt.plaintext {
+			t.Errorf("ParseAddress(%q).Plaintext() = %v", tt.in, a.Plaintext())
+		}
+	}
+}
+
+func TestListenRequiresTLS(t *testing.T) {
+	for _, addr := range []string{"tls://127.0.0.1:0", "wss://127.0.0.1:0/worker"} {
+		if ln, err := Listen(addr, nil); err != ErrTLSRequired {
+			if ln != nil {
+				ln.Close()
+			}
+			t.Errorf("Listen(%q, nil) = %v, want ErrTLSRequired", addr, err)
+		}
+	}
+}
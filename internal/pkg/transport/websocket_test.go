@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+
+	"github.com/gorilla/websocket"
+)
+
+// listenWS returns a ws:// listener on loopback and its URL.
+func listenWS(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	ln, err := Listen("ws://127.0.0.1:0/worker", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	return ln, "ws://" + ln.Addr().String() + "/worker"
+}
+
+// accept returns the next connection on ln, failing the test after 5s.
+func accept(t *testing.T, ln net.Listener) net.Conn {
+	t.Helper()
+	ch := make(chan net.Conn, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			ch <- c
+		}
+	}()
+	select {
+	case c := <-ch:
+		t.Cleanup(func() { c.Close() })
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection accepted")
+		return nil
+	}
+}
+
+func dialRaw(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func encode(t *testing.T, packets ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := protocol.NewWriter(&buf)
+	for _, p := range packets {
+		if err := w.WritePacket(protocol.PacketTypeVideo, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Message boundaries carry no meaning: packets split across messages, two
+// packets sharing one, empty and text messages in between all read the same.
+func TestWebSocketConnReadAcrossMessages(t *testing.T) {
+	ln, url := listenWS(t)
+	ws := dialRaw(t, url)
+	conn := accept(t, ln)
+
+	first, second := bytes.Repeat([]byte{1}, 1000), []byte("second")
+	stream := encode(t, first, second)
+	type message struct {
+		mt   int
+		data []byte
+	}
+	split := []message{
+		{websocket.BinaryMessage, stream[:3]}, // inside the header
+		{websocket.BinaryMessage, stream[3:500]},
+		{websocket.TextMessage, []byte("ignored")},
+		{websocket.BinaryMessage, nil},
+		{websocket.BinaryMessage, stream[500 : len(stream)-4]}, // end of first, start of second
+	}
+	for _, b := range stream[len(stream)-4:] {
+		split = append(split, message{websocket.BinaryMessage, []byte{b}})
+	}
+	go func() {
+		for _, m := range split {
+			if err := ws.WriteMessage(m.mt, m.data); err != nil {
+				return
+			}
+		}
+	}()
+
+	r := protocol.NewReader(conn)
+	for _, want := range [][]byte{first, second} {
+		var f protocol.Frame
+		if err := r.ReadFrame(&f); err != nil {
+			t.Fatal(err)
+		}
+		if f.Type != protocol.PacketTypeVideo || !bytes.Equal(f.Payload, want) {
+			t.Fatalf("frame %d/%d bytes, want %d", f.Type, len(f.Payload), len(want))
+		}
+	}
+}
+
+// Each vectored write goes out as exactly one message, never header and
+// payload apart.
+func TestWebSocketConnWriteBuffers(t *testing.T) {
+	ln, url := listenWS(t)
+	ws := dialRaw(t, url)
+	conn := accept(t, ln)
+
+	payloads := [][]byte{[]byte("hello"), bytes.Repeat([]byte{7}, 100_000), {}}
+	go func() {
+		w := protocol.NewWriter(conn)
+		for _, p := range payloads {
+			if err := w.WritePacket(protocol.PacketTypeVideo, p); err != nil {
+				return
+			}
+		}
+	}()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, p := range payloads {
+		mt, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := encode(t, p); mt != websocket.BinaryMessage || !bytes.Equal(msg, want) {
+			t.Fatalf("message of %d bytes, want one binary message of %d", len(msg), len(want))
+		}
+	}
+}
+
+func TestWebSocketConnCloseIsEOF(t *testing.T) {
+	ln, url := listenWS(t)
+	client, err := Dial(context.Background(), url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accept(t, ln).Close()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read after close = %v, want io.EOF", err)
+	}
+}
+
+// A browser page must not be able to reach a worker port.
+func TestWebSocketRejectsBrowserOrigin(t *testing.T) {
+	_, url := listenWS(t)
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://example.com"}})
+	if err == nil {
+		t.Fatal("upgrade with an Origin header accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("response %v, want 403", resp)
+	}
+}
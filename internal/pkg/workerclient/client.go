@@ -0,0 +1,419 @@
+// Package workerclient is the Go SDK for workers talking to the engine over
+// the packet protocol: it dials, performs the HELLO handshake, reconnects with
+// backoff, serializes writes and turns inbound packets into Commands.
+package workerclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+	"infinite-live/internal/pkg/transport"
+)
+
+// DefaultSocketPath is where the engine listens (see cmd/server).
+const DefaultSocketPath = "/tmp/infinite-live.sock"
+
+var (
+	// ErrNotConnected is returned by send methods while the client is between connections.
+	ErrNotConnected = errors.New("workerclient: not connected")
+	// ErrStreamCanceled is returned by Stream writes after the engine cancelled the utterance.
+	ErrStreamCanceled = errors.New("workerclient: utterance cancelled by engine")
+)
+
+// Config describes how to reach the engine and who we are.
+type Config struct {
+	// Socket path or transport URL (tcp://, tls://, ws://, wss://, see
+	// transport.ParseAddress); DefaultSocketPath if empty
+	Addr  string
+	TLS   *tls.Config    // For tls:// and wss://; nil uses the system roots
+	Hello protocol.Hello // Sent on every (re)connect
+
+	MinBackoff time.Duration // First reconnect delay (default 500ms)
+	MaxBackoff time.Duration // Cap for the exponential backoff (default 10s)
+
+	// Lifecycle callbacks, called from the client goroutine. Optional.
+	OnConnect    func(ack *protocol.HelloAck)
+	OnDisconnect func(err error)
+}
+
+// CommandKind classifies inbound packets from the engine.
+type CommandKind int
+
+const (
+	CommandComment CommandKind = iota // Text or structured comment
+	CommandCancel                     // Abort the given utterance
+	CommandError                      // Engine reported an error
+)
+
+// Command is an inbound request from the engine.
+type Command struct {
+	Kind    CommandKind
+	Comment *protocol.Comment       // CommandComment
+	Cancel  *protocol.UtteranceBody // CommandCancel
+	Err     *protocol.RemoteError   // CommandError
+}
+
+// Client is a reconnecting connection to the engine. All send methods are
+// safe for concurrent use.
+type Client struct {
+	cfg      Config
+	commands chan Command
+
+	// Commands read but not yet taken from Commands(). The read loop only
+	// appends here, so a busy consumer never holds up pongs and cancels.
+	backlogMu sync.Mutex
+	backlog   []Command
+	wake      chan struct{}
+
+	mu     sync.Mutex // guards conn/writer/ack
+	conn   net.Conn
+	writer *protocol.Writer
+	ack    *protocol.HelloAck
+
+	writeMu  sync.Mutex // serializes packets on the wire
+	streamID uint32     // last allocated stream ID (atomic)
+
+	streamsMu sync.Mutex
+	streams   map[string]*Stream // open streams by utterance ID, for engine cancels
+}
+
+// ConfigFromEnv fills Addr and TLS from ENGINE_ADDR and ENGINE_TLS_CA /
+// ENGINE_TLS_CERT / ENGINE_TLS_KEY, so a worker can run on another host,
+// and Hello.Token from ENGINE_TOKEN.
+func ConfigFromEnv(cfg Config) (Config, error) {
+	if addr := os.Getenv("ENGINE_ADDR"); addr != "" {
+		cfg.Addr = addr
+	}
+	if token := os.Getenv("ENGINE_TOKEN"); token != "" {
+		cfg.Hello.Token = token
+	}
+	ca, cert, key := os.Getenv("ENGINE_TLS_CA"), os.Getenv("ENGINE_TLS_CERT"), os.Getenv("ENGINE_TLS_KEY")
+	if ca != "" || cert != "" || key != "" {
+		conf, err := transport.ClientTLSConfig(ca, cert, key)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.TLS = conf
+	}
+	return cfg, nil
+}
+
+func New(cfg Config) *Client {
+	if cfg.Addr == "" {
+		cfg.Addr = DefaultSocketPath
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 10 * time.Second
+	}
+	return &Client{
+		cfg:      cfg,
+		commands: make(chan Command, 64),
+		wake:     make(chan struct{}, 1),
+		streams:  make(map[string]*Stream),
+	}
+}
+
+// Commands delivers comments, cancels and errors sent by the engine.
+func (c *Client) Commands() <-chan Command {
+	return c.commands
+}
+
+// Connected reports whether a handshake-complete connection is up.
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writer != nil
+}
+
+// Has reports whether the current connection negotiated the feature.
+func (c *Client) Has(feature string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ack.Has(feature)
+}
+
+// Run keeps the client connected until ctx is done. A handshake rejected by
+// the engine is a configuration error and ends Run immediately.
+func (c *Client) Run(ctx context.Context) error {
+	go c.forwardCommands(ctx)
+	backoff := c.cfg.MinBackoff
+	for {
+		started := time.Now()
+		err := c.session(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var remote *protocol.RemoteError
+		if errors.As(err, &remote) {
+			return err
+		}
+		// 连接稳定运行过一段时间，说明不是快速失败，重置退避
+		if time.Since(started) > c.cfg.MaxBackoff {
+			backoff = c.cfg.MinBackoff
+		}
+		log.Printf("workerclient: %v. Reconnecting in %v...", err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > c.cfg.MaxBackoff {
+			backoff = c.cfg.MaxBackoff
+		}
+	}
+}
+
+// session runs one connection from dial to disconnect.
+func (c *Client) session(ctx context.Context) error {
+	conn, err := transport.Dial(ctx, c.cfg.Addr, c.cfg.TLS)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	hello := c.cfg.Hello
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	ack, err := protocol.ClientHandshake(conn, &hello)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.ack = ack
+	c.writer = protocol.NewWriter(conn, protocol.CodecOptions(ack.Features)...)
+	c.mu.Unlock()
+	log.Printf("workerclient: connected to %s as %s (features=%v)", c.cfg.Addr, hello.WorkerID, ack.Features)
+	if c.cfg.OnConnect != nil {
+		c.cfg.OnConnect(ack)
+	}
+
+	// Unblock the read loop when ctx ends
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	err = c.readLoop(conn, ack)
+
+	c.mu.Lock()
+	c.conn = nil
+	c.ack = nil
+	c.writer = nil
+	c.mu.Unlock()
+	if c.cfg.OnDisconnect != nil {
+		c.cfg.OnDisconnect(err)
+	}
+	return err
+}
+
+func (c *Client) readLoop(conn net.Conn, ack *protocol.HelloAck) error {
+	pool := protocol.NewBufferPool()
+	rd := protocol.NewReader(conn, protocol.CodecOptions(ack.Features, protocol.WithPool(pool))...)
+	var f protocol.Frame
+	for {
+		if err := rd.ReadFrame(&f); err != nil {
+			return err
+		}
+		if f.Type == protocol.PacketTypeKeepalive {
+			c.answerPing(f.Payload)
+			f.Release()
+			continue
+		}
+		cmd, ok := decodeCommand(&f)
+		f.Release()
+		if !ok {
+			continue
+		}
+		switch cmd.Kind {
+		case CommandCancel:
+			c.cancelStream(cmd.Cancel)
+		case CommandComment:
+			// 收到即确认，Worker 自己只需要报告后续进度 (见 ReportJob)
+			if ack.Has(protocol.FeatureJobs) && cmd.Comment.ID != "" {
+				c.ReportJob(cmd.Comment.ID, protocol.JobReceived, "")
+			}
+		}
+		c.enqueue(cmd)
+	}
+}
+
+// enqueue hands a command to forwardCommands without blocking.
+func (c *Client) enqueue(cmd Command) {
+	c.backlogMu.Lock()
+	c.backlog = append(c.backlog, cmd)
+	if n := len(c.backlog); n >= 256 && n&(n-1) == 0 {
+		log.Printf("workerclient: %d commands waiting, is the worker reading Commands()?", n)
+	}
+	c.backlogMu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// forwardCommands moves the backlog to the Commands channel, in order and
+// across reconnects, until ctx is done.
+func (c *Client) forwardCommands(ctx context.Context) {
+	for {
+		c.backlogMu.Lock()
+		cmds := c.backlog
+		c.backlog = nil
+		c.backlogMu.Unlock()
+
+		for _, cmd := range cmds {
+			select {
+			case c.commands <- cmd:
+			case <-ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-c.wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// answerPing replies to an engine heartbeat (FeatureHeartbeat).
+func (c *Client) answerPing(payload []byte) {
+	ping, err := protocol.DecodeKeepalive(payload)
+	if err != nil || ping.Pong {
+		return
+	}
+	if err := c.SendJSON(protocol.PacketTypeKeepalive, ping.Reply()); err != nil {
+		log.Printf("workerclient: pong failed: %v", err)
+	}
+}
+
+// cancelStream aborts the stream the engine cancelled, so its pending and
+// future writes fail with ErrStreamCanceled.
+func (c *Client) cancelStream(body *protocol.UtteranceBody) {
+	c.streamsMu.Lock()
+	s := c.streams[body.UtteranceID]
+	delete(c.streams, body.UtteranceID)
+	c.streamsMu.Unlock()
+	if s != nil {
+		log.Printf("workerclient: engine cancelled utterance %s (%s)", body.UtteranceID, body.Reason)
+		s.abort()
+	}
+}
+
+func (c *Client) trackStream(s *Stream) {
+	c.streamsMu.Lock()
+	c.streams[s.utterance.UtteranceID] = s
+	c.streamsMu.Unlock()
+}
+
+func (c *Client) untrackStream(s *Stream) {
+	c.streamsMu.Lock()
+	if c.streams[s.utterance.UtteranceID] == s {
+		delete(c.streams, s.utterance.UtteranceID)
+	}
+	c.streamsMu.Unlock()
+}
+
+// decodeCommand maps an inbound packet to a Command. Unknown packets are ignored.
+func decodeCommand(f *protocol.Frame) (Command, bool) {
+	switch f.Type {
+	case protocol.PacketTypeText:
+		return Command{Kind: CommandComment, Comment: &protocol.Comment{Text: string(f.Payload)}}, true
+	case protocol.PacketTypeComment:
+		comment, err := protocol.DecodeComment(f.Payload)
+		if err != nil {
+			log.Printf("workerclient: bad comment packet: %v", err)
+			return Command{}, false
+		}
+		return Command{Kind: CommandComment, Comment: comment}, true
+	case protocol.PacketTypeCancel:
+		body, err := protocol.DecodeUtterance(f.Payload)
+		if err != nil {
+			log.Printf("workerclient: bad cancel packet: %v", err)
+			return Command{}, false
+		}
+		return Command{Kind: CommandCancel, Cancel: body}, true
+	case protocol.PacketTypeError:
+		return Command{Kind: CommandError, Err: protocol.DecodeError(f.Payload)}, true
+	}
+	return Command{}, false
+}
+
+// -----------------------------------------------------------------------------
+// Sending
+// -----------------------------------------------------------------------------
+
+// SendFrame writes a raw frame. Extended headers are stripped if the engine
+// did not negotiate FeatureTimestamps.
+func (c *Client) SendFrame(f *protocol.Frame) error {
+	c.mu.Lock()
+	w, ack := c.writer, c.ack
+	c.mu.Unlock()
+	if w == nil {
+		return ErrNotConnected
+	}
+	if f.Extended && !ack.Has(protocol.FeatureTimestamps) {
+		plain := *f
+		plain.Extended = false
+		f = &plain
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return w.WriteFrame(f)
+}
+
+// SendPacket writes a plain packet.
+func (c *Client) SendPacket(packetType byte, payload []byte) error {
+	return c.SendFrame(&protocol.Frame{Type: packetType, Payload: payload})
+}
+
+// SendJSON writes a packet with a JSON body.
+func (c *Client) SendJSON(packetType byte, v interface{}) error {
+	c.mu.Lock()
+	w := c.writer
+	c.mu.Unlock()
+	if w == nil {
+		return ErrNotConnected
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return w.WriteJSON(packetType, v)
+}
+
+// SendError reports a typed error to the engine.
+func (c *Client) SendError(code, message string) error {
+	return c.SendJSON(protocol.PacketTypeError, &protocol.ErrorBody{Code: code, Message: message})
+}
+
+// ReportJob tells the engine how far the reply to a comment has got.
+// It is a no-op when the engine did not enable FeatureJobs or the comment
+// has no ID, so workers may call it unconditionally. Playing, done and failed
+// are also inferred from streams opened with StreamOptions.CommentID.
+func (c *Client) ReportJob(commentID string, state protocol.JobState, detail string) error {
+	if commentID == "" || !c.Has(protocol.FeatureJobs) {
+		return nil
+	}
+	return c.SendJSON(protocol.PacketTypeJobStatus, &protocol.JobStatusBody{CommentID: commentID, State: state, Detail: detail})
+}
+
+func (c *Client) nextStreamID() uint32 {
+	return atomic.AddUint32(&c.streamID, 1)
+}
@@ -0,0 +1,69 @@
+package workerclient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+// The engine must keep getting pongs while the worker is too busy to take
+// commands off Commands().
+func TestPongWhileCommandsPile(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "engine.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := New(Config{Addr: sock, Hello: protocol.Hello{WorkerID: "w1", Features: []string{protocol.FeatureHeartbeat}}})
+	go c.Run(ctx)
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := protocol.ServerHandshake(conn, protocol.DefaultHandshakePolicy(), "s1"); err != nil {
+		t.Fatal(err)
+	}
+
+	const comments = 3 * 64 // Commands() 的缓冲是 64
+	w := protocol.NewWriter(conn)
+	for i := range comments {
+		if err := w.WritePacket(protocol.PacketTypeText, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteJSON(protocol.PacketTypeKeepalive, &protocol.KeepaliveBody{Seq: 7}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	typ, payload, err := protocol.ReadPacket(conn)
+	if err != nil {
+		t.Fatalf("no pong while commands are pending: %v", err)
+	}
+	pong, err := protocol.DecodeKeepalive(payload)
+	if typ != protocol.PacketTypeKeepalive || err != nil || !pong.Pong || pong.Seq != 7 {
+		t.Fatalf("got %s %s, want pong 7", protocol.TypeName(typ), payload)
+	}
+
+	for i := range comments {
+		select {
+		case cmd := <-c.Commands():
+			if cmd.Kind != CommandComment || cmd.Comment.Text != fmt.Sprint(i) {
+				t.Fatalf("command %d = %+v", i, cmd.Comment)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("command %d never arrived", i)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package workerclient
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"infinite-live/internal/pkg/protocol"
+)
+
+// Stream is one logical stream (see protocol.StreamTable) carrying a single
+// utterance. Media written to it is stamped with sequence numbers and PTS and,
+// when pacing is on, released in real time according to the frame durations.
+type Stream struct {
+	c         *Client
+	id        uint32
+	utterance protocol.UtteranceBody
+
+	pace bool
+	lead time.Duration
+
+	mu    sync.Mutex
+	start time.Time // wall clock of PTS 0, set by the first media write
+	video track
+	audio track
+
+	abortOnce sync.Once
+	aborted   chan struct{} // closed when the engine cancels the utterance
+}
+
+type track struct {
+	seq uint32
+	pts time.Duration
+}
+
+// StreamOptions tunes a stream.
+type StreamOptions struct {
+	Target    string // Room/avatar the stream is for ("" = default)
+	CommentID string // Comment this reply answers
+	// Pace makes Write* block until each frame is due. Lead sends that much
+	// early to keep the engine's buffer healthy (the old tickers used ~7ms).
+	Pace bool
+	Lead time.Duration
+}
+
+// OpenStream opens a stream and announces its utterance.
+func (c *Client) OpenStream(utteranceID string, opts StreamOptions) (*Stream, error) {
+	s := &Stream{
+		c:       c,
+		id:      c.nextStreamID(),
+		pace:    opts.Pace,
+		lead:    opts.Lead,
+		aborted: make(chan struct{}),
+	}
+	s.utterance = protocol.UtteranceBody{UtteranceID: utteranceID, StreamID: s.id, CommentID: opts.CommentID}
+
+	if err := c.SendJSON(protocol.PacketTypeStreamOpen, &protocol.StreamInfo{StreamID: s.id, Target: opts.Target}); err != nil {
+		return nil, err
+	}
+	if err := c.SendJSON(protocol.PacketTypeUtteranceStart, &s.utterance); err != nil {
+		return nil, err
+	}
+	c.trackStream(s)
+	return s, nil
+}
+
+// Done is closed when the engine cancels the utterance (e.g. it stalled or
+// was interrupted); generation for it can stop.
+func (s *Stream) Done() <-chan struct{} {
+	return s.aborted
+}
+
+func (s *Stream) abort() {
+	s.abortOnce.Do(func() { close(s.aborted) })
+}
+
+// ID returns the stream ID used in extended headers.
+func (s *Stream) ID() uint32 {
+	return s.id
+}
+
+// WriteVideo sends one video frame lasting dur.
+func (s *Stream) WriteVideo(ctx context.Context, data []byte, dur time.Duration) error {
+	return s.write(ctx, protocol.PacketTypeVideo, data, dur)
+}
+
+// WriteAudio sends one audio frame lasting dur.
+func (s *Stream) WriteAudio(ctx context.Context, data []byte, dur time.Duration) error {
+	return s.write(ctx, protocol.PacketTypeAudio, data, dur)
+}
+
+// NextPTS returns the media time the next frame of the given type will get.
+// Useful to interleave audio and video from a single goroutine.
+func (s *Stream) NextPTS(packetType byte) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.trackFor(packetType).pts
+}
+
+func (s *Stream) trackFor(packetType byte) *track {
+	if packetType == protocol.PacketTypeVideo {
+		return &s.video
+	}
+	return &s.audio
+}
+
+func (s *Stream) write(ctx context.Context, packetType byte, data []byte, dur time.Duration) error {
+	select {
+	case <-s.aborted:
+		return ErrStreamCanceled
+	default:
+	}
+	s.mu.Lock()
+	if s.start.IsZero() {
+		s.start = time.Now()
+	}
+	t := s.trackFor(packetType)
+	frame := &protocol.Frame{
+		Type:     packetType,
+		Payload:  data,
+		Extended: true,
+		StreamID: s.id,
+		Seq:      t.seq,
+		PTS:      t.pts,
+	}
+	t.seq++
+	t.pts += dur
+	due := s.start.Add(frame.PTS - s.lead)
+	s.mu.Unlock()
+
+	if s.pace {
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-s.aborted:
+				timer.Stop()
+				return ErrStreamCanceled
+			}
+		}
+	}
+	return s.c.SendFrame(frame)
+}
+
+// End finishes the utterance and closes the stream.
+func (s *Stream) End() error {
+	s.c.untrackStream(s)
+	if err := s.c.SendJSON(protocol.PacketTypeUtteranceEnd, &s.utterance); err != nil {
+		return err
+	}
+	return s.c.SendJSON(protocol.PacketTypeStreamClose, &protocol.StreamInfo{StreamID: s.id, Reason: "done"})
+}
+
+// Cancel aborts the utterance (e.g. generation failed) and closes the stream.
+// If the engine cancelled it first, only the stream is closed.
+func (s *Stream) Cancel(reason string) error {
+	s.c.untrackStream(s)
+	select {
+	case <-s.aborted:
+	default:
+		body := s.utterance
+		body.Reason = reason
+		if err := s.c.SendJSON(protocol.PacketTypeCancel, &body); err != nil {
+			return err
+		}
+	}
+	return s.c.SendJSON(protocol.PacketTypeStreamClose, &protocol.StreamInfo{StreamID: s.id, Reason: reason})
+}
@@ -0,0 +1,279 @@
+package usecase
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"infinite-live/internal/domain"
+	"infinite-live/internal/pkg/protocol"
+)
+
+// AVSyncConfig tunes how audio and video are scheduled on the media clock.
+type AVSyncConfig struct {
+	// Offset delays audio (positive) or video (negative) against the other,
+	// for lip-sync tuning. Applies to frames with a PTS.
+	Offset time.Duration
+	// MaxLateness is how late a frame may still be published. Later audio is
+	// dropped; for video the stream slips instead (VP8 inter frames can't be
+	// dropped), which delays its audio by the same amount and keeps them in sync.
+	MaxLateness time.Duration
+}
+
+// DefaultAVSyncConfig returns the settings used unless SetAVSync is called.
+func DefaultAVSyncConfig() AVSyncConfig {
+	return AVSyncConfig{MaxLateness: 100 * time.Millisecond}
+}
+
+// resyncAfter is how far a PTS may be from the clock before it counts as a
+// discontinuity (new utterance on a reused stream, worker restart) and the
+// stream is re-anchored.
+const resyncAfter = time.Second
+
+// ClockStats reports how well the two tracks keep to the media clock.
+type ClockStats struct {
+	AVOffsetMs float64 `json:"av_offset_ms"`
+	// AVSkewMs is the measured audio lag minus video lag of the last talking
+	// stream, offset excluded; positive means audio plays late.
+	AVSkewMs     float64 `json:"av_skew_ms"`
+	VideoSlips   uint64  `json:"video_slips"`   // late video that moved its stream back
+	AudioDropped uint64  `json:"audio_dropped"` // late audio frames dropped
+	Resyncs      uint64  `json:"resyncs"`       // PTS discontinuities
+	LateSlots    uint64  `json:"late_slots"`    // loop woke up too late, timeline skipped ahead
+}
+
+type streamKey struct {
+	origin   string
+	streamID uint32
+}
+
+// 轨道下标
+const (
+	trackVideo = iota
+	trackAudio
+)
+
+func trackOf(typ byte) int {
+	if typ == protocol.PacketTypeAudio {
+		return trackAudio
+	}
+	return trackVideo
+}
+
+// streamClock maps one stream's PTS onto media time.
+//
+// Audio and video are queued separately, so when a stream jumps (a new
+// utterance restarting its PTS, a worker pause) one track reaches the jump
+// before the other. The stream gets a new anchor (epoch) then, and the other
+// track keeps the previous one until it reaches the jump itself.
+type streamClock struct {
+	anchors [2]time.Duration // media time of PTS 0, by epoch&1
+	epoch   int
+	track   [2]int // epoch each track is in
+	lastPTS [2]time.Duration
+	lag     [2]time.Duration // publish time minus due time of the last frame
+	played  [2]bool
+	seen    time.Duration
+}
+
+func (s *streamClock) anchor(t int) *time.Duration {
+	return &s.anchors[s.track[t]&1]
+}
+
+// streamIdle is how long a stream goes unused before it's forgotten.
+const streamIdle = 10 * time.Second
+
+// MediaClock is the one monotonic timeline both tracks are scheduled on.
+// Media time is the time since the clock started. Frames with a PTS are due
+// at their stream's anchor + PTS, so audio and video of a stream stay
+// together; other frames (local clips, workers without timestamps) are due
+// back to back, each track keeping its own position on the same timeline.
+type MediaClock struct {
+	start time.Time
+	now   func() time.Time // time.Now, replaced in tests
+
+	mu      sync.Mutex
+	cfg     AVSyncConfig
+	streams map[streamKey]*streamClock
+	stats   ClockStats
+	late    bool // inside a lateness episode (logged once)
+}
+
+func NewMediaClock(cfg AVSyncConfig) *MediaClock {
+	c := &MediaClock{now: time.Now, streams: make(map[streamKey]*streamClock)}
+	c.start = c.now()
+	c.configure(cfg)
+	return c
+}
+
+func (c *MediaClock) configure(cfg AVSyncConfig) {
+	if cfg.MaxLateness <= 0 {
+		cfg.MaxLateness = DefaultAVSyncConfig().MaxLateness
+	}
+	c.mu.Lock()
+	c.cfg = cfg
+	c.stats.AVOffsetMs = ms(cfg.Offset)
+	c.mu.Unlock()
+}
+
+// Now is the current media time.
+func (c *MediaClock) Now() time.Duration {
+	return c.now().Sub(c.start)
+}
+
+// Stats returns a copy of the counters.
+func (c *MediaClock) Stats() ClockStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// slot returns when the next frame without a PTS is due; next is the
+// track's position.
+func (c *MediaClock) slot(next *time.Duration) time.Duration {
+	now := c.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.catchUp(next, now)
+}
+
+// schedule returns when f is due; next is the track's position for frames
+// without a PTS. drop reports a late audio frame that must be skipped.
+func (c *MediaClock) schedule(f *domain.MediaFrame, next *time.Duration) (due time.Duration, drop bool) {
+	now := c.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !f.HasPTS {
+		return c.catchUp(next, now), false
+	}
+
+	key := streamKey{f.Origin, f.StreamID}
+	t := trackOf(f.Type)
+	offset := c.trackOffset(f.Type)
+	s := c.streams[key]
+	if s == nil {
+		c.prune(now)
+		s = &streamClock{}
+		s.anchors[0] = now - f.PTS
+		c.streams[key] = s
+	}
+	due = *s.anchor(t) + f.PTS + offset
+	if d := due - now; f.PTS < s.lastPTS[t] || d > resyncAfter || d < -resyncAfter {
+		if s.track[t] < s.epoch {
+			s.track[t] = s.epoch // 另一条轨道已经重新锚定过了
+		} else {
+			s.epoch++
+			s.track[t] = s.epoch
+			*s.anchor(t) = now - f.PTS
+			c.stats.Resyncs++
+			log.Printf("MediaClock: %s stream %d jumped to PTS %v, re-anchored", key.origin, key.streamID, f.PTS)
+		}
+		s.played[t] = false
+		due = *s.anchor(t) + f.PTS + offset
+	}
+	s.lastPTS[t], s.seen = f.PTS, now
+
+	if late := now - due; late > c.cfg.MaxLateness {
+		c.lateness(late, f.Type)
+		if t == trackAudio {
+			c.stats.AudioDropped++
+			return due, true
+		}
+		// 视频帧不能丢 (后面的帧依赖它)，整条流往后挪，音频跟着一起晚
+		c.stats.VideoSlips++
+		*s.anchor(t) += late
+		return now, false
+	}
+	c.late = false
+	return due, false
+}
+
+// prune forgets streams that haven't been used for a while. Called with c.mu held.
+func (c *MediaClock) prune(now time.Duration) {
+	for key, s := range c.streams {
+		if now-s.seen > streamIdle {
+			delete(c.streams, key)
+		}
+	}
+}
+
+// catchUp skips a track's position ahead when the loop fell too far behind.
+// Called with c.mu held.
+func (c *MediaClock) catchUp(next *time.Duration, now time.Duration) time.Duration {
+	if late := now - *next; late > c.cfg.MaxLateness {
+		c.stats.LateSlots++
+		c.lateness(late, 0)
+		*next = now
+	}
+	return *next
+}
+
+// lateness logs the start of a lateness episode. Called with c.mu held.
+func (c *MediaClock) lateness(late time.Duration, typ byte) {
+	if c.late {
+		return
+	}
+	c.late = true
+	what := "frame"
+	if typ != 0 {
+		what = protocol.TypeName(typ)
+	}
+	log.Printf("MediaClock: %s %v late (max %v), catching up", what, late.Round(time.Millisecond), c.cfg.MaxLateness)
+}
+
+// trackOffset splits the A/V offset between the tracks. Called with c.mu held.
+func (c *MediaClock) trackOffset(typ byte) time.Duration {
+	switch {
+	case typ == protocol.PacketTypeAudio && c.cfg.Offset > 0:
+		return c.cfg.Offset
+	case typ == protocol.PacketTypeVideo && c.cfg.Offset < 0:
+		return -c.cfg.Offset
+	}
+	return 0
+}
+
+// played records that f went out now and updates the measured skew.
+func (c *MediaClock) played(f *domain.MediaFrame) {
+	if !f.HasPTS {
+		return
+	}
+	now := c.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.streams[streamKey{f.Origin, f.StreamID}]
+	if s == nil {
+		return
+	}
+	t := trackOf(f.Type)
+	s.lag[t] = now - (*s.anchor(t) + f.PTS + c.trackOffset(f.Type))
+	s.played[t] = true
+	if s.played[trackVideo] && s.played[trackAudio] && s.track[trackVideo] == s.track[trackAudio] {
+		c.stats.AVSkewMs = ms(s.lag[trackAudio] - s.lag[trackVideo])
+	}
+}
+
+// wait returns how long until media time t.
+func (c *MediaClock) wait(t time.Duration) time.Duration {
+	return max(t-c.Now(), 0)
+}
+
+// frameDuration is how long f stays on screen / on air.
+func frameDuration(f *domain.MediaFrame) time.Duration {
+	if f.Duration > 0 {
+		return time.Duration(f.Duration) * time.Millisecond
+	}
+	if f.Type == protocol.PacketTypeAudio {
+		return audioFrameDuration
+	}
+	return videoFrameDuration
+}
+
+// 没有时长的帧按 Idle 素材的帧长算
+const (
+	audioFrameDuration = 20 * time.Millisecond
+	videoFrameDuration = 40 * time.Millisecond
+)
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,173 @@
+package usecase
+
+import (
+	"testing"
+	"time"
+
+	"infinite-live/internal/domain"
+	"infinite-live/internal/pkg/protocol"
+)
+
+// fakeClock returns a MediaClock on a manual time source and the function
+// that moves it forward.
+func fakeClock(cfg AVSyncConfig) (*MediaClock, func(time.Duration)) {
+	now := time.Unix(1000, 0)
+	c := &MediaClock{now: func() time.Time { return now }, streams: make(map[streamKey]*streamClock)}
+	c.start = now
+	c.configure(cfg)
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+func video(pts time.Duration) *domain.MediaFrame {
+	return &domain.MediaFrame{Type: protocol.PacketTypeVideo, HasPTS: true, PTS: pts, StreamID: 1, Origin: "w1"}
+}
+
+func audio(pts time.Duration) *domain.MediaFrame {
+	return &domain.MediaFrame{Type: protocol.PacketTypeAudio, HasPTS: true, PTS: pts, StreamID: 1, Origin: "w1"}
+}
+
+const ms100 = 100 * time.Millisecond
+
+func TestMediaClockSchedule(t *testing.T) {
+	type step struct {
+		advance  time.Duration // before scheduling
+		frame    *domain.MediaFrame
+		wantDue  time.Duration
+		wantDrop bool
+	}
+	tests := []struct {
+		name  string
+		cfg   AVSyncConfig
+		steps []step
+		want  ClockStats
+	}{
+		{
+			name: "on time",
+			steps: []step{
+				{0, video(0), 0, false},
+				{0, audio(0), 0, false},
+				{10 * time.Millisecond, audio(20 * time.Millisecond), 20 * time.Millisecond, false},
+				{0, video(40 * time.Millisecond), 40 * time.Millisecond, false},
+			},
+		},
+		{
+			name: "late audio is dropped",
+			steps: []step{
+				{0, audio(0), 0, false},
+				{300 * time.Millisecond, audio(20 * time.Millisecond), 20 * time.Millisecond, true},
+				// 锚点不动，后面准时的音频照常
+				{0, audio(300 * time.Millisecond), 300 * time.Millisecond, false},
+			},
+			want: ClockStats{AudioDropped: 1},
+		},
+		{
+			name: "audio within max lateness is kept",
+			steps: []step{
+				{0, audio(0), 0, false},
+				{80 * time.Millisecond, audio(20 * time.Millisecond), 20 * time.Millisecond, false},
+			},
+		},
+		{
+			name: "late video slips and takes its audio along",
+			steps: []step{
+				{0, video(0), 0, false},
+				{300 * time.Millisecond, video(40 * time.Millisecond), 300 * time.Millisecond, false},
+				// 流整体后移 260ms，同一时刻的音频不算晚，不丢
+				{0, audio(40 * time.Millisecond), 300 * time.Millisecond, false},
+				{0, video(80 * time.Millisecond), 340 * time.Millisecond, false},
+			},
+			want: ClockStats{VideoSlips: 1},
+		},
+		{
+			name: "positive offset delays audio",
+			cfg:  AVSyncConfig{Offset: 60 * time.Millisecond},
+			steps: []step{
+				{0, video(0), 0, false},
+				{0, audio(0), 60 * time.Millisecond, false},
+			},
+			want: ClockStats{AVOffsetMs: 60},
+		},
+		{
+			name: "negative offset delays video",
+			cfg:  AVSyncConfig{Offset: -60 * time.Millisecond},
+			steps: []step{
+				{0, audio(0), 0, false},
+				{0, video(0), 60 * time.Millisecond, false},
+			},
+			want: ClockStats{AVOffsetMs: -60},
+		},
+		{
+			name: "jump re-anchors both tracks once",
+			steps: []step{
+				{0, video(0), 0, false},
+				{0, audio(0), 0, false},
+				{2 * time.Second, video(0), 2 * time.Second, false},
+				{0, audio(0), 2 * time.Second, false},
+			},
+			want: ClockStats{Resyncs: 1},
+		},
+		{
+			name: "backward pts re-anchors",
+			steps: []step{
+				{0, video(500 * time.Millisecond), 0, false},
+				{40 * time.Millisecond, video(0), 40 * time.Millisecond, false},
+			},
+			want: ClockStats{Resyncs: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			if cfg.MaxLateness == 0 {
+				cfg.MaxLateness = ms100
+			}
+			c, advance := fakeClock(cfg)
+			var next time.Duration
+			for i, s := range tt.steps {
+				advance(s.advance)
+				due, drop := c.schedule(s.frame, &next)
+				if due != s.wantDue || drop != s.wantDrop {
+					t.Fatalf("step %d (%s pts %v at %v): due %v drop %v, want %v %v",
+						i, protocol.TypeName(s.frame.Type), s.frame.PTS, c.Now(), due, drop, s.wantDue, s.wantDrop)
+				}
+			}
+			if got := c.Stats(); got != tt.want {
+				t.Fatalf("stats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMediaClockSlotCatchUp(t *testing.T) {
+	c, advance := fakeClock(AVSyncConfig{MaxLateness: ms100})
+	var next time.Duration
+	if got := c.slot(&next); got != 0 {
+		t.Fatalf("first slot = %v", got)
+	}
+	next += audioFrameDuration
+	advance(50 * time.Millisecond)
+	if got := c.slot(&next); got != audioFrameDuration {
+		t.Fatalf("slot within max lateness = %v, want %v", got, audioFrameDuration)
+	}
+	advance(time.Second)
+	if got := c.slot(&next); got != c.Now() {
+		t.Fatalf("slot after falling behind = %v, want %v", got, c.Now())
+	}
+	if st := c.Stats(); st.LateSlots != 1 {
+		t.Fatalf("late slots = %d, want 1", st.LateSlots)
+	}
+}
+
+func TestMediaClockSkew(t *testing.T) {
+	c, advance := fakeClock(AVSyncConfig{MaxLateness: ms100})
+	var next time.Duration
+	v, a := video(0), audio(0)
+	c.schedule(v, &next)
+	c.schedule(a, &next)
+	c.played(v)
+	advance(15 * time.Millisecond)
+	c.played(a)
+	if st := c.Stats(); st.AVSkewMs != 15 {
+		t.Fatalf("skew = %vms, want 15ms", st.AVSkewMs)
+	}
+}
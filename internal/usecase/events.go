@@ -0,0 +1,109 @@
+package usecase
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind names what happened in an Event.
+type EventKind string
+
+const (
+	EventStateChanged      EventKind = "state_changed"      // From → To, Reason
+	EventUtteranceStarted  EventKind = "utterance_started"  // UtteranceID, CommentID
+	EventUtteranceFinished EventKind = "utterance_finished" // Reason is "cancel: ..." when cancelled
+	EventKeyframeWait      EventKind = "keyframe_wait"      // switching to To, holding the current picture until a keyframe
+	EventSourceReset       EventKind = "source_reset"       // clip of State rewound (Error if it failed)
+	EventPublishError      EventKind = "publish_error"      // first failure after a success
+	EventInterrupted       EventKind = "interrupted"        // UtteranceID cut by Interrupt, Reason is the trigger
+)
+
+// Event is one thing the avatar did. Only the fields relevant to Kind are set.
+type Event struct {
+	Kind EventKind `json:"kind"`
+	At   time.Time `json:"at"`
+
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	State  string `json:"state,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	UtteranceID string `json:"utterance_id,omitempty"`
+	CommentID   string `json:"comment_id,omitempty"`
+	StreamID    uint32 `json:"stream_id,omitempty"`
+	Origin      string `json:"origin,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Snapshot is the interactor's current state as seen from outside.
+type Snapshot struct {
+	State       string    `json:"state"`
+	Since       time.Time `json:"since"`
+	UtteranceID string    `json:"utterance_id,omitempty"` // reply on air
+	CommentID   string    `json:"comment_id,omitempty"`
+	PendingJobs int       `json:"pending_jobs"`
+
+	// WaitingFor is the state being switched to while the keyframe gate holds.
+	WaitingFor string `json:"waiting_for,omitempty"`
+
+	FramesPublished uint64 `json:"frames_published"`
+	PublishErrors   uint64 `json:"publish_errors"`
+	LastError       string `json:"last_error,omitempty"`
+
+	Clock ClockStats `json:"clock"` // A/V sync
+}
+
+// eventBufferSize is how many events a subscriber may lag behind before
+// events are dropped for it.
+const eventBufferSize = 64
+
+// EventBus fans Events out to subscribers. Publish never blocks: a
+// subscriber that doesn't keep up loses events (see Dropped).
+type EventBus struct {
+	mu      sync.RWMutex
+	subs    map[chan Event]struct{}
+	dropped atomic.Uint64
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[chan Event]struct{})}
+}
+
+// Subscribe delivers events until ctx is done; the channel is closed then.
+func (b *EventBus) Subscribe(ctx context.Context) <-chan Event {
+	ch := make(chan Event, eventBufferSize)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	context.AfterFunc(ctx, func() {
+		b.mu.Lock()
+		delete(b.subs, ch)
+		close(ch) // 持有写锁：Publish 不会同时往里发
+		b.mu.Unlock()
+	})
+	return ch
+}
+
+// Publish stamps ev and sends it to every subscriber.
+func (b *EventBus) Publish(ev Event) {
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped counts events lost by slow subscribers.
+func (b *EventBus) Dropped() uint64 {
+	return b.dropped.Load()
+}
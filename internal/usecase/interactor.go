@@ -1,13 +1,65 @@
 package usecase
 
 import (
+	"context"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"infinite-live/internal/domain"
 	"infinite-live/internal/pkg/protocol"
 )
 
+// StateTimeouts bound how long the avatar stays in Listening/Thinking.
+type StateTimeouts struct {
+	// ListeningMin keeps Listening on air at least this long, so a comment that
+	// is dispatched right away still gets its nod before Thinking.
+	ListeningMin time.Duration
+	// Listening and Thinking give up and go back to Idle (e.g. the comment was
+	// never dispatched, or the reply never arrived).
+	Listening time.Duration
+	Thinking  time.Duration
+}
+
+// DefaultStateTimeouts returns the timeouts used unless SetStateTimeouts is called.
+func DefaultStateTimeouts() StateTimeouts {
+	return StateTimeouts{ListeningMin: 1500 * time.Millisecond, Listening: 5 * time.Second, Thinking: 30 * time.Second}
+}
+
+// BargeIn selects what interrupts the reply on air, besides calling Interrupt.
+type BargeIn struct {
+	Comment bool // a new viewer comment
+	Voice   bool // a viewer speaking
+}
+
+// stateRequest asks the video loop for a state change.
+type stateRequest struct {
+	state     domain.AvatarState
+	reason    string
+	interrupt bool // Listening even over Talking/Thinking (see Interrupt)
+}
+
+// clipSet is the looping clips of one state; each entry into the state
+// plays the next one.
+type clipSet struct {
+	clips []domain.ResettableFrameSource
+	next  int
+}
+
+func (c *clipSet) pick() domain.ResettableFrameSource {
+	clip := c.clips[c.next%len(c.clips)]
+	c.next++
+	return clip
+}
+
+// talkFrame is a talking frame on its way to a loop, stamped with the flush
+// generation it was routed in (see flushTalking).
+type talkFrame struct {
+	frame *domain.MediaFrame
+	gen   uint64
+}
+
 type LiveInteractor struct {
 	publisher domain.StreamPublisher
 
@@ -15,12 +67,36 @@ type LiveInteractor struct {
 	idleAudioSource domain.ResettableFrameSource
 	talkingSource   domain.FrameSource
 
+	// Idle/Listening/Thinking 各自的循环片段；没配置的状态用 Idle 的
+	clips    map[domain.AvatarState]*clipSet
+	timeouts StateTimeouts
+	bargeIn  BargeIn
+
+	canceller domain.UtteranceCanceller // tells workers to abort; nil without workers
+
 	// 缓冲区加大到 1000，防止长时间视频导致通道阻塞死锁
-	talkingVideoCh chan *domain.MediaFrame
-	talkingAudioCh chan *domain.MediaFrame
+	talkingVideoCh chan talkFrame
+	talkingAudioCh chan talkFrame
+
+	mu             sync.Mutex
+	currentState   domain.AvatarState
+	pendingJobs    map[string]bool               // dispatched comments not on air yet
+	active         map[string]domain.StreamEvent // started utterances by ID, until they end
+	interrupted    map[streamKey]bool            // streams whose frames are dropped until their Cancel/End
+	snap           Snapshot                      // everything but State/PendingJobs, see Snapshot
+	publishFailing bool
+	stopChan       chan struct{}
+
+	events *EventBus
+	clock  *MediaClock // 音视频共用的时间轴
 
-	currentState domain.AvatarState
-	stopChan     chan struct{}
+	// flushes 每次 flush 前后各加一；帧在路由时记下当时的值，值变了的帧不再播放
+	flushes atomic.Uint64
+	playMu  sync.RWMutex // play 持读锁检查代数并发布，flush 持写锁推进代数
+
+	// 状态切换请求 (评论/语音 → Listening，job → Thinking，取消/卡死 → Idle)，
+	// 由视频循环在关键帧边界执行
+	stateRequest chan stateRequest
 }
 
 func NewLiveInteractor(
@@ -33,10 +109,106 @@ func NewLiveInteractor(
 		idleVideoSource: idleVideo,
 		idleAudioSource: idleAudio,
 		// 修改点：加大缓冲区
-		talkingVideoCh: make(chan *domain.MediaFrame, 1000),
-		talkingAudioCh: make(chan *domain.MediaFrame, 1000),
-		currentState:   domain.StateIdle,
-		stopChan:       make(chan struct{}),
+		talkingVideoCh: make(chan talkFrame, 1000),
+		talkingAudioCh: make(chan talkFrame, 1000),
+		clips: map[domain.AvatarState]*clipSet{
+			domain.StateIdle: {clips: []domain.ResettableFrameSource{idleVideo}},
+		},
+		timeouts:     DefaultStateTimeouts(),
+		currentState: domain.StateIdle,
+		pendingJobs:  make(map[string]bool),
+		active:       make(map[string]domain.StreamEvent),
+		interrupted:  make(map[streamKey]bool),
+		snap:         Snapshot{Since: time.Now()},
+		events:       NewEventBus(),
+		clock:        NewMediaClock(DefaultAVSyncConfig()),
+		stopChan:     make(chan struct{}),
+		stateRequest: make(chan stateRequest, 16),
+	}
+}
+
+// SetStateClips sets the looping clips played in state (Idle, Listening or
+// Thinking). Call it before StartLoop.
+func (l *LiveInteractor) SetStateClips(state domain.AvatarState, clips ...domain.ResettableFrameSource) {
+	if len(clips) == 0 {
+		delete(l.clips, state)
+		return
+	}
+	l.clips[state] = &clipSet{clips: clips}
+}
+
+// SetStateTimeouts replaces the Listening/Thinking timeouts. Call it before StartLoop.
+func (l *LiveInteractor) SetStateTimeouts(t StateTimeouts) {
+	def := DefaultStateTimeouts()
+	if t.ListeningMin < 0 {
+		t.ListeningMin = 0
+	}
+	if t.Listening <= 0 {
+		t.Listening = def.Listening
+	}
+	if t.Thinking <= 0 {
+		t.Thinking = def.Thinking
+	}
+	l.timeouts = t
+}
+
+// SetBargeIn selects whether comments and viewer speech interrupt the reply
+// on air. Call it before StartLoop.
+func (l *LiveInteractor) SetBargeIn(b BargeIn) {
+	l.bargeIn = b
+}
+
+// SetCanceller sets who is told to abort interrupted utterances. Call it before StartLoop.
+func (l *LiveInteractor) SetCanceller(c domain.UtteranceCanceller) {
+	l.canceller = c
+}
+
+// SetAVSync sets the A/V offset and how late frames may be published.
+func (l *LiveInteractor) SetAVSync(cfg AVSyncConfig) {
+	l.clock.configure(cfg)
+}
+
+// State returns the state currently on air.
+func (l *LiveInteractor) State() domain.AvatarState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.currentState
+}
+
+// Snapshot returns what the avatar is doing right now.
+func (l *LiveInteractor) Snapshot() Snapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	snap := l.snap
+	snap.State = l.currentState.String()
+	snap.PendingJobs = len(l.pendingJobs)
+	snap.Clock = l.clock.Stats()
+	return snap
+}
+
+// Events delivers the interactor's events until ctx is done.
+func (l *LiveInteractor) Events(ctx context.Context) <-chan Event {
+	return l.events.Subscribe(ctx)
+}
+
+// publish sends a frame to the viewers, counting failures.
+func (l *LiveInteractor) publish(frame *domain.MediaFrame) {
+	err := l.publisher.Publish(frame)
+	l.mu.Lock()
+	if err == nil {
+		l.snap.FramesPublished++
+		l.publishFailing = false
+		l.mu.Unlock()
+		return
+	}
+	l.snap.PublishErrors++
+	l.snap.LastError = err.Error()
+	first := !l.publishFailing
+	l.publishFailing = true
+	l.mu.Unlock()
+	if first {
+		log.Printf("❌ Publish failed: %v", err)
+		l.events.Publish(Event{Kind: EventPublishError, Error: err.Error()})
 	}
 }
 
@@ -62,21 +234,27 @@ func (l *LiveInteractor) routeTalkingData() {
 			}
 
 			frame, hasData, err := l.talkingSource.TryNextFrame()
+			// 控制事件与帧同序处理
+			l.drainEvents()
 			if err != nil || !hasData || frame == nil {
 				time.Sleep(5 * time.Millisecond)
 				continue
 			}
+			tf, ok := l.stamp(frame)
+			if !ok {
+				continue
+			}
 
 			// 阻塞写入，确保不丢包
 			if frame.Type == protocol.PacketTypeVideo {
 				select {
-				case l.talkingVideoCh <- frame:
+				case l.talkingVideoCh <- tf:
 				case <-l.stopChan:
 					return
 				}
 			} else if frame.Type == protocol.PacketTypeAudio {
 				select {
-				case l.talkingAudioCh <- frame:
+				case l.talkingAudioCh <- tf:
 				case <-l.stopChan:
 					return
 				}
@@ -85,107 +263,539 @@ func (l *LiveInteractor) routeTalkingData() {
 	}
 }
 
+// drainEvents 处理 talkingSource 发来的控制事件 (UtteranceStart/End/Cancel/Error)
+func (l *LiveInteractor) drainEvents() {
+	es, ok := l.talkingSource.(domain.EventSource)
+	if !ok {
+		return
+	}
+	for {
+		select {
+		case ev := <-es.Events():
+			l.handleStreamEvent(ev)
+		default:
+			return
+		}
+	}
+}
+
+func (l *LiveInteractor) handleStreamEvent(ev domain.StreamEvent) {
+	switch ev.Kind {
+	case domain.EventUtteranceStart:
+		log.Printf("Utterance %q started (stream %d, comment %q)", ev.UtteranceID, ev.StreamID, ev.CommentID)
+		l.settleJob(ev.CommentID)
+		l.utteranceEvent(EventUtteranceStarted, ev, ev.Reason)
+	case domain.EventUtteranceEnd:
+		log.Printf("Utterance %q ended (stream %d, comment %q) %s", ev.UtteranceID, ev.StreamID, ev.CommentID, ev.Reason)
+		l.utteranceEvent(EventUtteranceFinished, ev, ev.Reason)
+	case domain.EventUtteranceCancel:
+		// reason "stalled" 表示引擎的卡死检测取消了它 (见 infrastructure/health.go)
+		log.Printf("Utterance %q from %s cancelled: %s", ev.UtteranceID, ev.Origin, ev.Reason)
+		l.settleJob(ev.CommentID)
+		interrupted := l.isInterrupted(ev.Origin, ev.StreamID)
+		l.utteranceEvent(EventUtteranceFinished, ev, "cancel: "+ev.Reason)
+		if interrupted {
+			return // Interrupt 已经 flush 过并切到 Listening
+		}
+		l.flushTalking()
+		l.requestIdle("cancel: " + ev.Reason)
+	case domain.EventWorkerError:
+		log.Printf("❌ Worker error: %v", ev.Err)
+		l.flushTalking()
+		l.requestIdle("worker error")
+	}
+}
+
+// utteranceEvent tracks the utterance on air and publishes kind.
+func (l *LiveInteractor) utteranceEvent(kind EventKind, ev domain.StreamEvent, reason string) {
+	l.mu.Lock()
+	// 流上有了新的开始或结束，被打断的回复不会再有帧过来
+	delete(l.interrupted, streamKey{ev.Origin, ev.StreamID})
+	if kind == EventUtteranceStarted {
+		l.active[ev.UtteranceID] = ev
+		l.snap.UtteranceID, l.snap.CommentID = ev.UtteranceID, ev.CommentID
+	} else {
+		delete(l.active, ev.UtteranceID)
+		if l.snap.UtteranceID == ev.UtteranceID {
+			l.snap.UtteranceID, l.snap.CommentID = "", ""
+		}
+	}
+	l.mu.Unlock()
+	l.events.Publish(Event{
+		Kind:        kind,
+		Reason:      reason,
+		UtteranceID: ev.UtteranceID,
+		CommentID:   ev.CommentID,
+		StreamID:    ev.StreamID,
+		Origin:      ev.Origin,
+	})
+}
+
+// requestIdle 让视频循环在下一个 tick 结束当前回复 (还有待回复的 job 时回到 Thinking)
+func (l *LiveInteractor) requestIdle(reason string) {
+	l.requestState(domain.StateIdle, reason)
+}
+
+func (l *LiveInteractor) requestState(state domain.AvatarState, reason string) {
+	l.request(stateRequest{state: state, reason: reason})
+}
+
+func (l *LiveInteractor) request(req stateRequest) {
+	select {
+	case l.stateRequest <- req:
+	default:
+		log.Printf("Interactor: state request %s (%s) dropped, loop busy", req.state, req.reason)
+	}
+}
+
+// Interrupt cuts the reply on air: buffered talking frames are dropped, the
+// worker is told to abort the utterance, and the avatar goes to Listening at
+// the next keyframe of its clip. With nothing on air it is a plain Listening
+// request. It returns the IDs of the utterances cut.
+func (l *LiveInteractor) Interrupt(reason string) []string {
+	l.mu.Lock()
+	var cut []domain.StreamEvent
+	for id, u := range l.active {
+		cut = append(cut, u)
+		delete(l.active, id)
+		l.interrupted[streamKey{u.Origin, u.StreamID}] = true
+		if l.snap.UtteranceID == id {
+			l.snap.UtteranceID, l.snap.CommentID = "", ""
+		}
+	}
+	onAir := len(cut) > 0 || l.currentState == domain.StateTalking
+	l.mu.Unlock()
+
+	if !onAir {
+		l.requestState(domain.StateListening, reason)
+		return nil
+	}
+	l.flushTalking()
+	ids := make([]string, 0, len(cut))
+	for _, u := range cut {
+		log.Printf("Interactor: interrupting utterance %q from %s (%s)", u.UtteranceID, u.Origin, reason)
+		if l.canceller != nil {
+			if err := l.canceller.CancelUtterance(u.Origin, u.StreamID, "interrupted: "+reason); err != nil {
+				log.Printf("Interactor: cancel of utterance %q failed: %v", u.UtteranceID, err)
+			}
+		}
+		ids = append(ids, u.UtteranceID)
+		l.events.Publish(Event{
+			Kind:        EventInterrupted,
+			Reason:      reason,
+			UtteranceID: u.UtteranceID,
+			CommentID:   u.CommentID,
+			StreamID:    u.StreamID,
+			Origin:      u.Origin,
+		})
+	}
+	l.request(stateRequest{state: domain.StateListening, reason: "interrupted: " + reason, interrupt: true})
+	return ids
+}
+
+// stamp tags a routed frame with the current flush generation; false means
+// the frame belongs to an interrupted utterance. The generation is read
+// before the check: Interrupt marks the stream before it flushes, so a frame
+// that slips past the check is already stale when it reaches play.
+func (l *LiveInteractor) stamp(frame *domain.MediaFrame) (talkFrame, bool) {
+	tf := talkFrame{frame: frame, gen: l.flushes.Load()}
+	return tf, !l.isInterrupted(frame.Origin, frame.StreamID)
+}
+
+// isInterrupted reports whether frames of the stream belong to an interrupted utterance.
+func (l *LiveInteractor) isInterrupted(origin string, streamID uint32) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.interrupted[streamKey{origin, streamID}]
+}
+
+// settleJob forgets a dispatched comment once its reply started or failed.
+func (l *LiveInteractor) settleJob(commentID string) {
+	if commentID == "" {
+		return
+	}
+	l.mu.Lock()
+	delete(l.pendingJobs, commentID)
+	l.mu.Unlock()
+}
+
+// restState is where the avatar goes when a reply ends: Thinking while other
+// dispatched comments are waiting for theirs, Idle otherwise.
+func (l *LiveInteractor) restState() domain.AvatarState {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pendingJobs) > 0 {
+		return domain.StateThinking
+	}
+	return domain.StateIdle
+}
+
+// flushTalking 丢弃已缓冲但尚未播放的 Talking 帧。
+// 已经被循环取出、或路由器正要写入的帧由代数 (flushes) 拦下，见 play。
+func (l *LiveInteractor) flushTalking() {
+	l.playMu.Lock()
+	l.flushes.Add(1)
+	l.playMu.Unlock()
+	defer l.flushes.Add(1)
+	dropped := 0
+	for {
+		select {
+		case <-l.talkingVideoCh:
+			dropped++
+		case <-l.talkingAudioCh:
+			dropped++
+		default:
+			if dropped > 0 {
+				log.Printf("Flushed %d buffered talking frames", dropped)
+			}
+			return
+		}
+	}
+}
+
+// nextTalkFrame takes the next talking frame off ch and schedules it on the
+// clock, skipping flushed frames and frames that are too late to play.
+func (l *LiveInteractor) nextTalkFrame(ch <-chan talkFrame, next *time.Duration) (talkFrame, time.Duration) {
+	for {
+		select {
+		case tf := <-ch:
+			if tf.gen != l.flushes.Load() {
+				continue
+			}
+			due, drop := l.clock.schedule(tf.frame, next)
+			if !drop {
+				return tf, due
+			}
+		default:
+			return talkFrame{}, 0
+		}
+	}
+}
+
+// play publishes a scheduled talking frame, unless a flush started since it
+// was routed. It reports whether the frame went out.
+func (l *LiveInteractor) play(tf talkFrame) bool {
+	l.playMu.RLock()
+	defer l.playMu.RUnlock()
+	if tf.gen != l.flushes.Load() {
+		return false
+	}
+	l.publish(tf.frame)
+	l.clock.played(tf.frame)
+	return true
+}
+
 // 音频循环
+//
+// 说话音频按 PTS 在时间轴上到期时播放；其余时间按 next 连续播放 Idle 音频。
 func (l *LiveInteractor) runAudioLoop() {
-	ticker := time.NewTicker(20 * time.Millisecond)
-	defer ticker.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	next := l.clock.Now()
+	var held talkFrame // 下一个说话帧，等它到期
+	var heldDue time.Duration
 
 	for {
 		select {
 		case <-l.stopChan:
 			return
-		case <-ticker.C:
-			// 优先播放 Talking 音频
-			select {
-			case talkFrame := <-l.talkingAudioCh:
-				l.publisher.Publish(talkFrame)
-				continue
-			default:
-			}
+		case <-timer.C:
+		}
 
+		// 优先播放 Talking 音频
+		if held.frame != nil && held.gen != l.flushes.Load() {
+			held = talkFrame{} // flush 之前取出的
+		}
+		if held.frame == nil {
+			held, heldDue = l.nextTalkFrame(l.talkingAudioCh, &next)
+		}
+		slot := l.clock.slot(&next)
+		switch {
+		case held.frame != nil && heldDue <= l.clock.Now():
+			if l.play(held) {
+				next = heldDue + frameDuration(held.frame)
+			}
+			held = talkFrame{}
+		case held.frame != nil && heldDue < slot+audioFrameDuration:
+			// 说话帧马上到期，不再插 Idle 音频
+			next = max(slot, heldDue)
+		case slot <= l.clock.Now():
 			// 其次播放 Idle 音频
+			next = slot + audioFrameDuration
 			if l.idleAudioSource != nil {
-				frame, err := l.idleAudioSource.NextFrame()
-				if err == nil {
-					l.publisher.Publish(frame)
+				if frame, err := l.idleAudioSource.NextFrame(); err == nil {
+					l.publish(frame)
+					next = slot + frameDuration(frame)
 				}
 			}
 		}
+
+		wake := next
+		if held.frame != nil && heldDue < wake {
+			wake = heldDue
+		}
+		timer.Reset(l.clock.wait(wake))
 	}
 }
 
+// videoLoop is the state of runVideoLoop, owned by its goroutine.
+type videoLoop struct {
+	state     domain.AvatarState
+	since     time.Time
+	clip      domain.ResettableFrameSource // on air; nil while Talking
+	nextClip  domain.ResettableFrameSource // waiting for its keyframe
+	nextState domain.AvatarState
+	deferred  *stateRequest // Thinking requested before ListeningMin was up
+	talkGate  bool          // talking frames arrived, waiting for their keyframe
+}
+
 // 视频循环
+//
+// Idle → Listening (评论/用户语音) → Thinking (job 已派发) → Talking (第一个说话关键帧)
+// → Idle (回复结束；还有待回复的 job 时回到 Thinking)。
+// 片段之间的切换都在关键帧上：新片段的关键帧到来之前继续播旧片段。
+// 说话帧按 PTS 在时间轴上到期时播放，片段帧按 next 连续播放。
 func (l *LiveInteractor) runVideoLoop() {
-	ticker := time.NewTicker(40 * time.Millisecond)
-	defer ticker.Stop()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
 
-	waitingForKeyframe := true
-	lastState := domain.StateIdle
+	v := &videoLoop{state: domain.StateIdle, since: time.Now(), clip: l.idleVideoSource}
 	lastTalkTime := time.Now().Add(-10 * time.Hour)
+	next := l.clock.Now()
+	var held talkFrame // 下一个说话帧，等它到期
+	var heldDue time.Duration
 
 	for {
 		select {
 		case <-l.stopChan:
 			return
-		case <-ticker.C:
-			select {
-			case talkFrame := <-l.talkingVideoCh:
-				lastTalkTime = time.Now()
-
-				// 检测状态切换
-				if lastState == domain.StateIdle {
-					waitingForKeyframe = true
-				}
+		case req := <-l.stateRequest:
+			l.handleStateRequest(v, req)
+			continue
+		case <-timer.C:
+		}
 
-				lastState = domain.StateTalking
-				l.currentState = domain.StateTalking
-
-				// 关键帧检测
-				if waitingForKeyframe {
-					if !talkFrame.IsKey {
-						// 如果这里打印了日志，说明 main.go 的关键帧过滤没生效
-						// 或者 VP8 数据流有问题
-						// log.Println("⚠️ Skipped P-Frame, waiting for Keyframe...")
-						continue
-					}
+		if held.frame != nil && held.gen != l.flushes.Load() {
+			held = talkFrame{} // flush 之前取出的
+		}
+		if held.frame == nil {
+			held, heldDue = l.nextTalkFrame(l.talkingVideoCh, &next)
+		}
+		if held.frame != nil && heldDue <= l.clock.Now() {
+			talk := held
+			held = talkFrame{}
+			lastTalkTime = time.Now()
+
+			// 关键帧检测：等到说话的关键帧才切到 Talking，之前继续播当前片段
+			if v.state != domain.StateTalking && !talk.frame.IsKey {
+				if !v.talkGate {
+					v.talkGate = true
+					l.events.Publish(Event{Kind: EventKeyframeWait, From: v.state.String(), To: domain.StateTalking.String(), Reason: "talking"})
+				}
+			} else {
+				if v.state != domain.StateTalking {
 					log.Println("✅ Talking Started (Keyframe Rendered)")
-					waitingForKeyframe = false
+					l.enter(v, domain.StateTalking, "keyframe")
+				}
+				if l.play(talk) {
+					next = heldDue + frameDuration(talk.frame)
 				}
-
-				l.publisher.Publish(talkFrame)
-				continue
-
-			default:
 			}
+		}
 
-			// Anti-Flicker: 500ms 保护期
-			if time.Since(lastTalkTime) < 80*time.Millisecond {
-				continue
+		clipDue := v.state != domain.StateTalking
+		if v.state == domain.StateTalking && held.frame == nil {
+			// Anti-Flicker: 80ms 保护期
+			if time.Since(lastTalkTime) >= 80*time.Millisecond {
+				if v.nextClip == nil {
+					log.Println("Talking finished.")
+					l.switchTo(v, l.restState(), "reply finished")
+				}
+				clipDue = true
 			}
+		}
+		if slot := l.clock.slot(&next); slot <= l.clock.Now() {
+			next = slot + videoFrameDuration
+			if clipDue {
+				l.checkTimers(v)
+				if frame := l.publishClip(v); frame != nil {
+					next = slot + frameDuration(frame)
+				}
+			}
+		}
 
-			if lastState == domain.StateTalking {
-				log.Println("Talking finished. Switching back to Idle.")
-				lastState = domain.StateIdle
-				l.currentState = domain.StateIdle
-				waitingForKeyframe = true
+		wake := next
+		if held.frame != nil && heldDue < wake {
+			wake = heldDue
+		}
+		timer.Reset(l.clock.wait(wake))
+	}
+}
 
-				// 只重置视频！
-				if err := l.idleVideoSource.Reset(); err != nil {
-					log.Printf("❌ Failed to reset idle video: %v", err)
-				}
+// handleStateRequest applies a requested state. Listening and Thinking only
+// move the avatar forward (a comment during Thinking doesn't go back to
+// Listening, nor does anything interrupt Talking); Idle ends whatever is on.
+func (l *LiveInteractor) handleStateRequest(v *videoLoop, req stateRequest) {
+	target := v.state
+	if v.nextClip != nil {
+		target = v.nextState
+	}
+	if req.interrupt {
+		if v.state == domain.StateTalking || v.talkGate {
+			log.Printf("Talking interrupted (%s).", req.reason)
+		}
+		v.talkGate = false
+		l.switchTo(v, domain.StateListening, req.reason)
+		return
+	}
+	switch req.state {
+	case domain.StateIdle:
+		if v.state == domain.StateTalking {
+			log.Printf("Talking aborted (%s).", req.reason)
+		}
+		l.switchTo(v, l.restState(), req.reason)
+	case domain.StateListening, domain.StateThinking:
+		if target == domain.StateTalking || req.state <= target {
+			return
+		}
+		if req.state == domain.StateThinking && target == domain.StateListening &&
+			(v.nextClip != nil || time.Since(v.since) < l.timeouts.ListeningMin) {
+			v.deferred = &req
+			return
+		}
+		l.switchTo(v, req.state, req.reason)
+	}
+}
 
-			}
+// checkTimers applies a deferred Thinking and gives up on Listening/Thinking
+// that lasted too long.
+func (l *LiveInteractor) checkTimers(v *videoLoop) {
+	if v.deferred != nil && (v.state != domain.StateListening || v.nextClip == nil && time.Since(v.since) >= l.timeouts.ListeningMin) {
+		req := *v.deferred
+		v.deferred = nil
+		l.handleStateRequest(v, req)
+	}
+	var limit time.Duration
+	switch v.state {
+	case domain.StateListening:
+		limit = l.timeouts.Listening
+	case domain.StateThinking:
+		limit = l.timeouts.Thinking
+	default:
+		return
+	}
+	if v.nextClip != nil || time.Since(v.since) < limit {
+		return
+	}
+	if v.state == domain.StateThinking {
+		l.mu.Lock()
+		clear(l.pendingJobs)
+		l.mu.Unlock()
+	}
+	l.switchTo(v, domain.StateIdle, v.state.String()+" timed out")
+}
 
-			frame, err := l.idleVideoSource.NextFrame()
-			if err == nil && frame != nil {
-				l.publisher.Publish(frame)
-			}
+// switchTo starts a transition to a clip state. The current clip stays on air
+// until the new one delivers a keyframe (see publishClip).
+func (l *LiveInteractor) switchTo(v *videoLoop, state domain.AvatarState, reason string) {
+	if state != domain.StateListening {
+		v.deferred = nil
+	}
+	if v.nextClip != nil && v.nextState == state || v.nextClip == nil && v.state == state {
+		return
+	}
+	set := l.clips[state]
+	if set == nil {
+		set = l.clips[domain.StateIdle]
+	}
+	clip := set.pick()
+	if clip == v.clip {
+		// 同一个片段 (没有单独配置的状态)，不用重新开始
+		v.nextClip = nil
+		l.enter(v, state, reason)
+		return
+	}
+	reset := Event{Kind: EventSourceReset, State: state.String()}
+	if err := clip.Reset(); err != nil {
+		log.Printf("❌ Failed to reset %s clip: %v", state, err)
+		reset.Error = err.Error()
+	}
+	l.events.Publish(reset)
+	v.nextClip, v.nextState = clip, state
+	log.Printf("Interactor: %s → %s (%s), waiting for keyframe", v.state, state, reason)
+	l.mu.Lock()
+	l.snap.WaitingFor = state.String()
+	l.mu.Unlock()
+	l.events.Publish(Event{Kind: EventKeyframeWait, From: v.state.String(), To: state.String(), Reason: reason})
+}
+
+// enter makes state current.
+func (l *LiveInteractor) enter(v *videoLoop, state domain.AvatarState, reason string) {
+	if state == domain.StateTalking {
+		v.clip, v.nextClip = nil, nil
+	}
+	from := v.state
+	v.state, v.since, v.talkGate = state, time.Now(), false
+	l.mu.Lock()
+	l.currentState = state
+	l.snap.Since, l.snap.WaitingFor = v.since, ""
+	l.mu.Unlock()
+	if from != state {
+		log.Printf("Interactor: %s → %s (%s)", from, state, reason)
+		l.events.Publish(Event{Kind: EventStateChanged, From: from.String(), To: state.String(), Reason: reason})
+	}
+}
+
+// publishClip publishes one frame of the clip on air, switching to the
+// pending clip once it has a keyframe. It returns the frame published, if any.
+func (l *LiveInteractor) publishClip(v *videoLoop) *domain.MediaFrame {
+	if v.nextClip != nil {
+		frame, err := v.nextClip.NextFrame()
+		if err == nil && frame != nil && frame.IsKey {
+			v.clip, v.nextClip = v.nextClip, nil
+			l.enter(v, v.nextState, "keyframe")
+			l.publish(frame)
+			return frame
 		}
 	}
+	if v.clip == nil {
+		return nil
+	}
+	frame, err := v.clip.NextFrame()
+	if err != nil || frame == nil {
+		return nil
+	}
+	l.publish(frame)
+	return frame
 }
 
+// OnUserComment shows that the avatar is listening.
 func (l *LiveInteractor) OnUserComment(text string) {
 	log.Printf("Interactor received: %s", text)
+	if l.bargeIn.Comment {
+		l.Interrupt("comment")
+		return
+	}
+	l.requestState(domain.StateListening, "comment")
+}
+
+// OnUserVoice is called while a viewer is speaking.
+func (l *LiveInteractor) OnUserVoice(identity string) {
+	if l.bargeIn.Voice {
+		l.Interrupt("voice from " + identity)
+		return
+	}
+	l.requestState(domain.StateListening, "voice from "+identity)
+}
+
+// OnJobDispatched is called once a comment was handed to a worker; the avatar
+// thinks until the reply is on air.
+func (l *LiveInteractor) OnJobDispatched(commentID string) {
+	l.mu.Lock()
+	l.pendingJobs[commentID] = true
+	l.mu.Unlock()
+	l.requestState(domain.StateThinking, "job "+commentID)
 }
 
 func (l *LiveInteractor) SetTalkingSource(s domain.FrameSource) {
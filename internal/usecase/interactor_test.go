@@ -0,0 +1,217 @@
+package usecase
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"infinite-live/internal/domain"
+	"infinite-live/internal/pkg/protocol"
+)
+
+// loopClip is an endless local clip of keyframes.
+type loopClip struct{ typ byte }
+
+func (c *loopClip) NextFrame() (*domain.MediaFrame, error) {
+	return &domain.MediaFrame{Type: c.typ, Data: []byte{0}, IsKey: true}, nil
+}
+func (c *loopClip) TryNextFrame() (*domain.MediaFrame, bool, error) {
+	f, err := c.NextFrame()
+	return f, true, err
+}
+func (c *loopClip) Type() domain.AvatarState { return domain.StateIdle }
+func (c *loopClip) Close() error             { return nil }
+func (c *loopClip) Reset() error             { return nil }
+
+// workerStream is a talking source fed by the test. Like the UDS adapter it
+// turns control packets into events as they are read, so events stay in
+// order with the frames.
+type workerStream struct {
+	packets chan any // *domain.MediaFrame or domain.StreamEvent
+	events  chan domain.StreamEvent
+}
+
+func (s *workerStream) NextFrame() (*domain.MediaFrame, error) {
+	for {
+		if f, ok, _ := s.TryNextFrame(); ok {
+			return f, nil
+		}
+	}
+}
+
+func (s *workerStream) TryNextFrame() (*domain.MediaFrame, bool, error) {
+	select {
+	case p := <-s.packets:
+		if ev, ok := p.(domain.StreamEvent); ok {
+			s.events <- ev
+			return nil, false, nil
+		}
+		return p.(*domain.MediaFrame), true, nil
+	default:
+		return nil, false, nil
+	}
+}
+func (s *workerStream) Type() domain.AvatarState          { return domain.StateTalking }
+func (s *workerStream) Close() error                      { return nil }
+func (s *workerStream) Events() <-chan domain.StreamEvent { return s.events }
+
+// airLog records what went on air and whether it was after the interrupt.
+type airLog struct {
+	interrupted atomic.Bool
+	talking     atomic.Int64 // talking frames published
+	late        atomic.Int64 // talking frames published after Interrupt returned
+}
+
+func (a *airLog) Publish(f *domain.MediaFrame) error {
+	if f.Origin != "" {
+		a.talking.Add(1)
+		if a.interrupted.Load() {
+			a.late.Add(1)
+		}
+	}
+	return nil
+}
+
+type cancelLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (c *cancelLog) CancelUtterance(origin string, streamID uint32, reason string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls = append(c.calls, origin)
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Interrupting mid-utterance: nothing of the cut reply may go on air once
+// Interrupt returns, even frames already taken off the channels or being
+// routed at that moment, and the avatar goes to Listening.
+func TestInterruptMidStream(t *testing.T) {
+	air := &airLog{}
+	canceller := &cancelLog{}
+	l := NewLiveInteractor(air, &loopClip{typ: protocol.PacketTypeVideo}, &loopClip{typ: protocol.PacketTypeAudio})
+	l.SetCanceller(canceller)
+	l.SetStateTimeouts(StateTimeouts{Listening: time.Minute})
+	src := &workerStream{packets: make(chan any, 64), events: make(chan domain.StreamEvent, 4)}
+	l.SetTalkingSource(src)
+	go l.StartLoop()
+	defer l.Stop()
+
+	utterance := domain.StreamEvent{Kind: domain.EventUtteranceStart, UtteranceID: "u1", StreamID: 1, Origin: "w1"}
+	src.packets <- utterance
+
+	// Worker 一直按实时速度往外推帧，打断之后也不停 (Cancel 还在路上)
+	stop := make(chan struct{})
+	fed := make(chan struct{})
+	go func() {
+		defer close(fed)
+		start := time.Now()
+		for i := 0; ; i++ {
+			pts := time.Duration(i) * audioFrameDuration
+			frames := []*domain.MediaFrame{{Type: protocol.PacketTypeAudio, Data: []byte{1}, HasPTS: true, PTS: pts, StreamID: 1, Origin: "w1"}}
+			if i%2 == 0 {
+				frames = append(frames, &domain.MediaFrame{Type: protocol.PacketTypeVideo, Data: []byte{1}, IsKey: i%50 == 0, HasPTS: true, PTS: pts, StreamID: 1, Origin: "w1"})
+			}
+			for _, f := range frames {
+				select {
+				case src.packets <- f:
+				case <-stop:
+					return
+				}
+			}
+			time.Sleep(time.Until(start.Add(pts)))
+		}
+	}()
+
+	waitFor(t, "talking", func() bool { return l.State() == domain.StateTalking && air.talking.Load() > 20 })
+	ids := l.Interrupt("test")
+	air.interrupted.Store(true)
+	if len(ids) != 1 || ids[0] != "u1" {
+		t.Fatalf("Interrupt cut %v, want [u1]", ids)
+	}
+
+	waitFor(t, "listening", func() bool { return l.State() == domain.StateListening })
+	time.Sleep(200 * time.Millisecond) // Worker 还在推这条流
+	close(stop)
+	<-fed
+	src.packets <- domain.StreamEvent{Kind: domain.EventUtteranceCancel, UtteranceID: "u1", StreamID: 1, Origin: "w1", Reason: "interrupted: test"}
+	time.Sleep(100 * time.Millisecond)
+
+	if n := air.late.Load(); n > 0 {
+		t.Fatalf("%d frames of the interrupted reply went on air after Interrupt returned", n)
+	}
+	if st := l.State(); st != domain.StateListening {
+		t.Fatalf("state after the cancel echo = %s, want Listening", st)
+	}
+	canceller.mu.Lock()
+	defer canceller.mu.Unlock()
+	if len(canceller.calls) != 1 || canceller.calls[0] != "w1" {
+		t.Fatalf("canceller calls = %v, want [w1]", canceller.calls)
+	}
+}
+
+// The interleavings of Interrupt with a frame on its way to the air, one by one.
+func TestInterruptRacingFrame(t *testing.T) {
+	talking := func(seq uint32) *domain.MediaFrame {
+		return &domain.MediaFrame{Type: protocol.PacketTypeAudio, Data: []byte{1}, HasPTS: true, Seq: seq, StreamID: 1, Origin: "w1"}
+	}
+	tests := []struct {
+		name string
+		run  func(l *LiveInteractor) bool // reports whether the frame went out
+	}{
+		{"taken off the channel before the interrupt", func(l *LiveInteractor) bool {
+			tf, _ := l.stamp(talking(1))
+			l.talkingAudioCh <- tf
+			var next time.Duration
+			held, _ := l.nextTalkFrame(l.talkingAudioCh, &next)
+			l.Interrupt("test")
+			return l.play(held)
+		}},
+		{"routed before the interrupt, queued after the flush", func(l *LiveInteractor) bool {
+			tf, ok := l.stamp(talking(1))
+			if !ok {
+				t.Fatal("frame dropped before the interrupt")
+			}
+			l.Interrupt("test")
+			l.talkingAudioCh <- tf
+			var next time.Duration
+			held, _ := l.nextTalkFrame(l.talkingAudioCh, &next)
+			return held.frame != nil && l.play(held)
+		}},
+		{"routed after the interrupt", func(l *LiveInteractor) bool {
+			l.Interrupt("test")
+			_, ok := l.stamp(talking(1))
+			return ok
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			air := &airLog{}
+			l := NewLiveInteractor(air, &loopClip{typ: protocol.PacketTypeVideo}, &loopClip{typ: protocol.PacketTypeAudio})
+			l.handleStreamEvent(domain.StreamEvent{Kind: domain.EventUtteranceStart, UtteranceID: "u1", StreamID: 1, Origin: "w1"})
+			if tt.run(l) || air.talking.Load() != 0 {
+				t.Fatal("frame of the interrupted utterance went on air")
+			}
+
+			// 下一条回复照常播放
+			l.handleStreamEvent(domain.StreamEvent{Kind: domain.EventUtteranceStart, UtteranceID: "u2", StreamID: 1, Origin: "w1"})
+			tf, ok := l.stamp(talking(2))
+			if !ok || !l.play(tf) || air.talking.Load() != 1 {
+				t.Fatal("frame of the next utterance was dropped")
+			}
+		})
+	}
+}